@@ -0,0 +1,597 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+//
+// Based on gopkg.in/mgo.v2/bson by Gustavo Niemeyer
+// See THIRD-PARTY-NOTICES for original license terms.
+
+package mgobson
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/mongodb/mongo-go-driver/bson/decimal"
+	"github.com/mongodb/mongo-go-driver/bson/objectid"
+)
+
+// AppendBSON appends the BSON encoding of d to dst and returns the extended
+// buffer. The bytes are the same that MarshalBSON returns, but they're
+// written straight into dst, so that a buffer can be reused across calls.
+// On error dst is returned unchanged.
+func (d D) AppendBSON(dst []byte) ([]byte, error) {
+	b, err := newEncoder(defaultEncodeMode).appendD(dst, d)
+	if err != nil {
+		return dst, rootMarshalError(err, d)
+	}
+	return b, nil
+}
+
+// AppendBSON appends the BSON encoding of m to dst and returns the extended
+// buffer, as D.AppendBSON does.
+func (m M) AppendBSON(dst []byte) ([]byte, error) {
+	b, err := newEncoder(defaultEncodeMode).appendM(dst, m)
+	if err != nil {
+		return dst, rootMarshalError(err, m)
+	}
+	return b, nil
+}
+
+// AppendBSON appends the elements of r to dst as a BSON document and returns
+// the extended buffer, as D.AppendBSON does. The data of the elements is
+// copied as is, unless SetStrictMarshal enabled validating it.
+func (r RawD) AppendBSON(dst []byte) ([]byte, error) {
+	return appendRawD(dst, r)
+}
+
+func (r RawD) appendBSON(dst []byte) []byte {
+	dst, start := beginDocument(dst)
+	for _, elem := range r {
+		dst = appendHeader(dst, elem.Value.Kind, elem.Name)
+		dst = append(dst, elem.Value.Data...)
+	}
+	return endDocument(dst, start)
+}
+
+// maxPooledBuffer is the capacity above which buffers used for marshaling
+// aren't kept for reuse, so that a few large documents don't pin memory.
+const maxPooledBuffer = 1 << 20
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 512)
+		return &b
+	},
+}
+
+// marshal encodes in, which may be any value accepted by Marshal, into a
+// pooled buffer, and returns a copy of the result.
+func (e *encoder) marshal(in interface{}) ([]byte, error) {
+	bp := bufferPool.Get().(*[]byte)
+	b, err := e.appendDocument((*bp)[:0], in)
+
+	var out []byte
+	if err == nil {
+		out = make([]byte, len(b))
+		copy(out, b)
+	}
+
+	if cap(b) <= maxPooledBuffer {
+		*bp = b[:0]
+		bufferPool.Put(bp)
+	}
+	return out, err
+}
+
+// appendDocument appends the BSON document for value to dst. value may be a
+// D, an M, a RawD, a *bson.Document, a struct or a map with string keys, a
+// pointer to one of them, or a Getter that returns one of them.
+func (e *encoder) appendDocument(dst []byte, value interface{}) ([]byte, error) {
+	if getter, ok := value.(Getter); ok {
+		v, err := getter.GetBSON()
+		if err != nil {
+			return dst, err
+		}
+
+		return e.appendDocument(dst, v)
+	}
+
+	switch v := value.(type) {
+	case D:
+		return e.appendD(dst, v)
+	case M:
+		return e.appendM(dst, v)
+	case RawD:
+		return appendRawD(dst, v)
+	case *bson.Document:
+		b, err := v.MarshalBSON()
+		if err != nil {
+			return dst, err
+		}
+		return append(dst, b...), nil
+	default:
+		return e.appendValueDocument(dst, reflect.ValueOf(value))
+	}
+}
+
+func (e *encoder) appendD(dst []byte, d D) ([]byte, error) {
+	dst, start := beginDocument(dst)
+	for _, elem := range d {
+		var err error
+		dst, err = e.appendToDoc(dst, elem.Name, elem.Value)
+		if err != nil {
+			return dst, err
+		}
+	}
+	return endDocument(dst, start), nil
+}
+
+func (e *encoder) appendM(dst []byte, m M) ([]byte, error) {
+	dst, start := beginDocument(dst)
+
+	if e.sortKeys {
+		for _, k := range e.mapKeys(reflect.ValueOf(m)) {
+			var err error
+			dst, err = e.appendToDoc(dst, k.String(), m[k.String()])
+			if err != nil {
+				return dst, err
+			}
+		}
+
+		return endDocument(dst, start), nil
+	}
+
+	for k, v := range m {
+		var err error
+		dst, err = e.appendToDoc(dst, k, v)
+		if err != nil {
+			return dst, err
+		}
+	}
+	return endDocument(dst, start), nil
+}
+
+// appendValueDocument appends the document for a struct or a map with
+// string keys, or a pointer to one of them.
+func (e *encoder) appendValueDocument(dst []byte, v reflect.Value) ([]byte, error) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return dst, fmt.Errorf("Can't marshal nil %s as a BSON document", v.Type())
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		return e.appendStruct(dst, v)
+	case reflect.Map:
+		if v.Type().Key().Kind() == reflect.String {
+			dst, start := beginDocument(dst)
+			for _, k := range e.mapKeys(v) {
+				var err error
+				dst, err = e.appendToDoc(dst, k.String(), v.MapIndex(k).Interface())
+				if err != nil {
+					return dst, err
+				}
+			}
+			return endDocument(dst, start), nil
+		}
+	}
+
+	if !v.IsValid() {
+		return dst, fmt.Errorf("Can't marshal nil as a BSON document")
+	}
+	return dst, fmt.Errorf("Can't marshal %s as a BSON document", v.Type())
+}
+
+func (e *encoder) appendStruct(dst []byte, v reflect.Value) ([]byte, error) {
+	sinfo, err := getStructInfo(v.Type())
+	if err != nil {
+		return dst, err
+	}
+
+	dst, start := beginDocument(dst)
+
+	for _, info := range sinfo.FieldsList {
+		var value reflect.Value
+		if info.Inline == nil {
+			value = v.Field(info.Num)
+		} else {
+			value = v.FieldByIndex(info.Inline)
+		}
+		if info.OmitEmpty && isZero(value) {
+			continue
+		}
+		elem := value.Interface()
+		if info.MinSize {
+			if elem, err = minSize(value); err != nil {
+				return dst, elementMarshalError(err, info.Key, value.Interface())
+			}
+		}
+
+		dst, err = e.appendToDoc(dst, info.Key, elem)
+		if err != nil {
+			return dst, err
+		}
+	}
+
+	if sinfo.InlineMap >= 0 {
+		m := v.Field(sinfo.InlineMap)
+		for _, k := range e.mapKeys(m) {
+			key := k.String()
+			if _, found := sinfo.FieldsMap[key]; found {
+				return dst, fmt.Errorf("Can't have key %q in inlined map; conflicts with struct field", key)
+			}
+
+			dst, err = e.appendToDoc(dst, key, m.MapIndex(k).Interface())
+			if err != nil {
+				return dst, err
+			}
+		}
+	}
+
+	return endDocument(dst, start), nil
+}
+
+// appendToDoc appends the element for key and value to dst. Errors are
+// returned as a *MarshalError whose path starts with key.
+func (e *encoder) appendToDoc(dst []byte, key string, value interface{}) ([]byte, error) {
+	b, err := e.appendElement(dst, key, value)
+	if err != nil {
+		return dst, elementMarshalError(err, key, value)
+	}
+	return b, nil
+}
+
+// appendElement appends the element for key and value to dst. Driver types
+// and, in DriverEncodeMode, named scalar types are left to the driver's
+// bson.EC.Interface.
+func (e *encoder) appendElement(dst []byte, key string, value interface{}) ([]byte, error) {
+	if getter, ok := value.(Getter); ok {
+		if rv := reflect.ValueOf(value); rv.Kind() == reflect.Ptr && rv.IsNil() {
+			return appendHeader(dst, 0x0A, key), nil
+		}
+
+		v, err := getter.GetBSON()
+		if err != nil {
+			return dst, err
+		}
+
+		return e.appendElement(dst, key, v)
+	}
+
+	switch v := value.(type) {
+	case nil:
+		return appendHeader(dst, 0x0A, key), nil
+	case D:
+		return e.appendD(appendHeader(dst, 0x03, key), v)
+	case M:
+		return e.appendM(appendHeader(dst, 0x03, key), v)
+	case ObjectId:
+		if !v.Valid() {
+			return dst, &MarshalError{Kind: 0x07, Err: fmt.Errorf("ObjectIDs must be exactly 12 bytes long (got %d)", len(v))}
+		}
+		return append(appendHeader(dst, 0x07, key), v...), nil
+	case Binary:
+		return appendBinary(appendHeader(dst, 0x05, key), v.Kind, v.Data), nil
+	case RegEx:
+		dst = appendCString(appendHeader(dst, 0x0B, key), v.Pattern)
+		return appendCString(dst, v.Options), nil
+	case JavaScript:
+		if v.Scope == nil {
+			return appendString(appendHeader(dst, 0x0D, key), v.Code), nil
+		}
+
+		dst = appendHeader(dst, 0x0F, key)
+		start := len(dst)
+		dst = appendString(append(dst, 0, 0, 0, 0), v.Code)
+		dst, err := e.appendDocument(dst, v.Scope)
+		if err != nil {
+			return dst, err
+		}
+		binary.LittleEndian.PutUint32(dst[start:], uint32(len(dst)-start))
+		return dst, nil
+	case Symbol:
+		return appendString(appendHeader(dst, 0x0E, key), string(v)), nil
+	case DBPointer:
+		if !v.Id.Valid() {
+			return dst, &MarshalError{Kind: 0x0C, Err: fmt.Errorf("ObjectIDs must be exactly 12 bytes long (got %d)", len(v.Id))}
+		}
+		dst = appendString(appendHeader(dst, 0x0C, key), v.Namespace)
+		return append(dst, v.Id...), nil
+	case time.Time:
+		// MongoDB handles timestamps as milliseconds.
+		return appendInt64(appendHeader(dst, 0x09, key), v.Unix()*1e3+int64(v.Nanosecond()/1e6)), nil
+	case MongoTimestamp:
+		return appendInt64(appendHeader(dst, 0x11, key), int64(v)), nil
+	case Decimal128:
+		dst = appendInt64(appendHeader(dst, 0x13, key), int64(v.l))
+		return appendInt64(dst, int64(v.h)), nil
+	case undefined:
+		return appendHeader(dst, 0x06, key), nil
+	case orderKey:
+		switch v {
+		case MinKey:
+			return appendHeader(dst, 0xFF, key), nil
+		case MaxKey:
+			return appendHeader(dst, 0x7F, key), nil
+		}
+		return dst, fmt.Errorf("unknown orderKey value %d", int64(v))
+	case RawD:
+		return appendRawD(appendHeader(dst, 0x03, key), v)
+	case Raw:
+		return appendRaw(dst, key, v)
+	case bson.Binary, bson.Regex, bson.DBPointer, bson.CodeWithScope, bson.Timestamp,
+		bson.JavaScriptCode, bson.Symbol, decimal.Decimal128, objectid.ObjectID,
+		*bson.Element, *bson.Document, *bson.Value, bson.Reader:
+		return appendDriverElement(dst, key, value)
+	case bool, int8, int16, int32, int, int64, uint8, uint16, uint, uint32, uint64, float32, float64, string:
+		if e.mode == MgoEncodeMode {
+			return e.appendMgoScalar(dst, key, reflect.ValueOf(value))
+		}
+		return appendDriverScalar(dst, key, value), nil
+	}
+
+	rv := reflect.ValueOf(value)
+	if e.mode != MgoEncodeMode && (rv.Kind() == reflect.Map || rv.Kind() == reflect.Slice) && rv.IsNil() {
+		// The driver encodes nil maps and slices as null; mgo encodes them
+		// as empty values.
+		return appendHeader(dst, 0x0A, key), nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return appendHeader(dst, 0x0A, key), nil
+		}
+
+		return e.appendElement(dst, key, rv.Elem().Interface())
+	case reflect.Struct, reflect.Map:
+		if e.mode == MgoEncodeMode && rv.Type() == typeURL {
+			u := rv.Interface().(url.URL)
+			return appendString(appendHeader(dst, 0x02, key), u.String()), nil
+		}
+
+		return e.appendValueDocument(appendHeader(dst, 0x03, key), rv)
+	case reflect.Slice, reflect.Array:
+		et := rv.Type().Elem()
+		switch {
+		case rv.Kind() == reflect.Slice && et == typeDocElem:
+			return e.appendElement(dst, key, rv.Convert(typeD).Interface())
+		case rv.Kind() == reflect.Slice && et == typeRawDocElem:
+			return e.appendElement(dst, key, rv.Convert(typeRawD).Interface())
+		case et.Kind() == reflect.Uint8:
+			dst = appendHeader(dst, 0x05, key)
+			dst = appendInt32(dst, int32(rv.Len()))
+			dst = append(dst, 0x00)
+			if rv.Kind() == reflect.Slice {
+				return append(dst, rv.Bytes()...), nil
+			}
+			for i := 0; i < rv.Len(); i++ {
+				dst = append(dst, byte(rv.Index(i).Uint()))
+			}
+			return dst, nil
+		}
+
+		dst, start := beginDocument(appendHeader(dst, 0x04, key))
+		for i := 0; i < rv.Len(); i++ {
+			var err error
+			dst, err = e.appendToDoc(dst, strconv.Itoa(i), rv.Index(i).Interface())
+			if err != nil {
+				return dst, err
+			}
+		}
+		return endDocument(dst, start), nil
+	default:
+		if e.mode == MgoEncodeMode {
+			return e.appendMgoScalar(dst, key, rv)
+		}
+	}
+
+	return appendDriverElement(dst, key, value)
+}
+
+// appendDriverElement appends the element that the driver's bson.EC.Interface
+// builds for key and value.
+func appendDriverElement(dst []byte, key string, value interface{}) ([]byte, error) {
+	b, err := bson.EC.Interface(key, value).MarshalBSON()
+	if err != nil {
+		return dst, err
+	}
+	return append(dst, b...), nil
+}
+
+// appendRaw appends the element for key and the value held by raw. The data
+// is copied as is, as RawD.MarshalBSON does, unless SetStrictMarshal enabled
+// validating it.
+func appendRaw(dst []byte, key string, raw Raw) ([]byte, error) {
+	kind := raw.Kind
+	if kind == 0x00 {
+		kind = 0x03
+	}
+	if len(raw.Data) == 0 && kind != 0x06 && kind != 0x0A && kind != 0xFF && kind != 0x7F {
+		return dst, &MarshalError{Kind: kind, Err: errors.New("Attempt to marshal empty Raw document")}
+	}
+
+	if strictMarshal {
+		if err := validateRaw(kind, raw.Data); err != nil {
+			return dst, err
+		}
+	}
+
+	return append(appendHeader(dst, kind, key), raw.Data...), nil
+}
+
+// appendRawD appends the document made of the elements of r. Their data is
+// copied as is, as RawD.MarshalBSON does, unless SetStrictMarshal enabled
+// validating it.
+func appendRawD(dst []byte, r RawD) ([]byte, error) {
+	if strictMarshal {
+		if err := r.Validate(); err != nil {
+			return dst, err
+		}
+	}
+
+	return r.appendBSON(dst), nil
+}
+
+// appendDriverScalar appends a value of a predeclared scalar type as
+// bson.EC.Interface encodes it.
+func appendDriverScalar(dst []byte, key string, value interface{}) []byte {
+	switch v := value.(type) {
+	case bool:
+		b := byte(0)
+		if v {
+			b = 1
+		}
+		return append(appendHeader(dst, 0x08, key), b)
+	case int8:
+		return appendInt32(appendHeader(dst, 0x10, key), int32(v))
+	case int16:
+		return appendInt32(appendHeader(dst, 0x10, key), int32(v))
+	case int32:
+		return appendInt32(appendHeader(dst, 0x10, key), v)
+	case int:
+		return appendInt64(appendHeader(dst, 0x12, key), int64(v))
+	case int64:
+		return appendInt64(appendHeader(dst, 0x12, key), v)
+	case uint8:
+		return appendInt32(appendHeader(dst, 0x10, key), int32(v))
+	case uint16:
+		return appendInt32(appendHeader(dst, 0x10, key), int32(v))
+	case uint32:
+		return appendInt64(appendHeader(dst, 0x12, key), int64(v))
+	case uint:
+		return appendDriverUint64(dst, key, uint64(v))
+	case uint64:
+		return appendDriverUint64(dst, key, v)
+	case float32:
+		return appendInt64(appendHeader(dst, 0x01, key), int64(math.Float64bits(float64(v))))
+	case float64:
+		return appendInt64(appendHeader(dst, 0x01, key), int64(math.Float64bits(v)))
+	case string:
+		return appendString(appendHeader(dst, 0x02, key), v)
+	}
+	panic("unreachable")
+}
+
+func appendDriverUint64(dst []byte, key string, u uint64) []byte {
+	switch {
+	case u < math.MaxInt32:
+		return appendInt32(appendHeader(dst, 0x10, key), int32(u))
+	case u > math.MaxInt64:
+		return appendHeader(dst, 0x0A, key)
+	default:
+		return appendInt64(appendHeader(dst, 0x12, key), int64(u))
+	}
+}
+
+// appendMgoScalar appends v, which must not be a document, an array or any
+// of the special types handled by appendElement, using the rules of
+// gopkg.in/mgo.v2/bson.
+func (e *encoder) appendMgoScalar(dst []byte, key string, v reflect.Value) ([]byte, error) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32:
+		if i := v.Int(); i >= math.MinInt32 && i <= math.MaxInt32 {
+			// It fits into an int32, encode as such.
+			return appendInt32(appendHeader(dst, 0x10, key), int32(i)), nil
+		}
+		return appendInt64(appendHeader(dst, 0x12, key), v.Int()), nil
+	case reflect.Int64:
+		return appendInt64(appendHeader(dst, 0x12, key), v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u := v.Uint()
+		switch {
+		case int64(u) < 0:
+			return dst, &MarshalError{Kind: 0x12, Err: errors.New("BSON has no uint64 type, and value is too large to fit correctly in an int64")}
+		case u <= math.MaxInt32 && v.Kind() <= reflect.Uint32:
+			return appendInt32(appendHeader(dst, 0x10, key), int32(u)), nil
+		default:
+			return appendInt64(appendHeader(dst, 0x12, key), int64(u)), nil
+		}
+	case reflect.Float32, reflect.Float64:
+		return appendInt64(appendHeader(dst, 0x01, key), int64(math.Float64bits(v.Float()))), nil
+	case reflect.Bool:
+		b := byte(0)
+		if v.Bool() {
+			b = 1
+		}
+		return append(appendHeader(dst, 0x08, key), b), nil
+	case reflect.String:
+		if v.Type() == typeJSONNumber {
+			n := v.Interface().(json.Number)
+			if i, err := n.Int64(); err == nil {
+				return appendInt64(appendHeader(dst, 0x12, key), i), nil
+			} else if f, err := n.Float64(); err == nil {
+				return appendInt64(appendHeader(dst, 0x01, key), int64(math.Float64bits(f))), nil
+			}
+			return dst, fmt.Errorf("failed to convert json.Number to a number: %s", n)
+		}
+
+		return appendString(appendHeader(dst, 0x02, key), v.String()), nil
+	}
+
+	return dst, fmt.Errorf("Can't marshal %s in a BSON document", v.Type())
+}
+
+// beginDocument appends a placeholder for the length of a document to dst,
+// and returns the offset at which the document starts.
+func beginDocument(dst []byte) ([]byte, int) {
+	return append(dst, 0, 0, 0, 0), len(dst)
+}
+
+// endDocument terminates the document started at offset start, and sets its
+// length.
+func endDocument(dst []byte, start int) []byte {
+	dst = append(dst, 0)
+	binary.LittleEndian.PutUint32(dst[start:], uint32(len(dst)-start))
+	return dst
+}
+
+func appendHeader(dst []byte, kind byte, key string) []byte {
+	dst = append(dst, kind)
+	return appendCString(dst, key)
+}
+
+func appendCString(dst []byte, s string) []byte {
+	dst = append(dst, s...)
+	return append(dst, 0)
+}
+
+func appendString(dst []byte, s string) []byte {
+	dst = appendInt32(dst, int32(len(s)+1))
+	return appendCString(dst, s)
+}
+
+func appendBinary(dst []byte, kind byte, data []byte) []byte {
+	if kind == 0x02 {
+		// The obsolete binary subtype repeats the length of the data.
+		dst = appendInt32(dst, int32(len(data)+4))
+		dst = append(dst, kind)
+		dst = appendInt32(dst, int32(len(data)))
+		return append(dst, data...)
+	}
+
+	dst = appendInt32(dst, int32(len(data)))
+	dst = append(dst, kind)
+	return append(dst, data...)
+}
+
+func appendInt32(dst []byte, i int32) []byte {
+	return append(dst, byte(i), byte(i>>8), byte(i>>16), byte(i>>24))
+}
+
+func appendInt64(dst []byte, i int64) []byte {
+	return append(dst, byte(i), byte(i>>8), byte(i>>16), byte(i>>24), byte(i>>32), byte(i>>40), byte(i>>48), byte(i>>56))
+}
@@ -0,0 +1,265 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+//
+// Based on gopkg.in/mgo.v2/bson by Gustavo Niemeyer
+// See THIRD-PARTY-NOTICES for original license terms.
+
+package mgobson_test
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/mongodb-labs/mgobson"
+	"github.com/mongodb/mongo-go-driver/bson"
+	"github.com/stretchr/testify/require"
+)
+
+type namedInt int
+
+type namedString string
+
+func appendTestDocument(t testing.TB) mgobson.D {
+	dec, err := mgobson.ParseDecimal128("1.50")
+	require.NoError(t, err)
+	u, err := url.Parse("http://example.com/a")
+	require.NoError(t, err)
+	oid := mgobson.ObjectIdHex("5a4af6a50000000000000001")
+
+	return mgobson.D{
+		{"nil", nil},
+		{"bool", true},
+		{"int", 1},
+		{"bigint", 1 << 40},
+		{"int8", int8(-2)},
+		{"int16", int16(3)},
+		{"int32", int32(4)},
+		{"int64", int64(5)},
+		{"uint8", uint8(6)},
+		{"uint16", uint16(7)},
+		{"uint32", uint32(8)},
+		{"uint", uint(9)},
+		{"biguint", uint64(1 << 40)},
+		{"float32", float32(1.5)},
+		{"float64", math.Inf(-1)},
+		{"string", "s\x00t"},
+		{"named int", namedInt(10)},
+		{"named string", namedString("n")},
+		{"number", json.Number("11")},
+		{"url", *u},
+		{"objectid", oid},
+		{"binary", mgobson.Binary{Kind: 0x80, Data: []byte{1}}},
+		{"binary old", mgobson.Binary{Kind: 0x02, Data: []byte{1, 2}}},
+		{"bytes", []byte{3, 4}},
+		{"fixed", [2]byte{5, 6}},
+		{"regex", mgobson.RegEx{Pattern: "^a", Options: "i"}},
+		{"code", mgobson.JavaScript{Code: "f()"}},
+		{"scope", mgobson.JavaScript{Code: "f()", Scope: mgobson.M{"a": int32(1)}}},
+		{"symbol", mgobson.Symbol("s")},
+		{"dbpointer", mgobson.DBPointer{Namespace: "db.c", Id: oid}},
+		{"date", time.Date(2018, 1, 2, 3, 4, 5, 6e6, time.UTC)},
+		{"timestamp", mgobson.MongoTimestamp(5<<32 | 6)},
+		{"decimal", dec},
+		{"undefined", mgobson.Undefined},
+		{"minkey", mgobson.MinKey},
+		{"maxkey", mgobson.MaxKey},
+		{"raw", mgobson.Raw{Kind: 0x10, Data: []byte{1, 0, 0, 0}}},
+		{"rawd", mgobson.RawD{{"a", mgobson.Raw{Kind: 0x08, Data: []byte{1}}}}},
+		{"driver", bson.EC.Int32("ignored", 12)},
+		{"m", mgobson.M{"a": int32(1)}},
+		{"d", mgobson.D{{"b", mgobson.A{int32(1), "two", nil}}}},
+		{"elems", []mgobson.DocElem{{"c", int32(3)}}},
+		{"struct", &roundTripType{Id: oid, Tags: []string{"a"}, Nested: &inlineBase{X: 1}}},
+		{"inline", inlineMapType{A: 1, Extra: mgobson.M{"b": "c"}}},
+		{"map", map[string]int32{"e": 1}},
+		{"getter", &getterType{value: mgobson.D{{"g", int32(1)}}}},
+		{"nil getter", (*getterType)(nil)},
+		{"nil pointer", (*int)(nil)},
+		{"pointer", &oid},
+	}
+}
+
+func TestAppendBSON(t *testing.T) {
+	in := appendTestDocument(t)
+
+	for _, mode := range []mgobson.EncodeMode{mgobson.DriverEncodeMode, mgobson.MgoEncodeMode} {
+		mgobson.SetDefaultEncodeMode(mode)
+
+		// Every way of marshaling gives the same bytes.
+		expected, err := in.AppendBSON(nil)
+		require.NoError(t, err)
+
+		actual, err := in.MarshalBSON()
+		require.NoError(t, err)
+		require.Equal(t, expected, actual, "mode %d", mode)
+
+		actual, err = mgobson.Marshal(in)
+		require.NoError(t, err)
+		require.Equal(t, expected, actual, "mode %d", mode)
+
+		doc, err := in.MarshalBSONDocument()
+		require.NoError(t, err)
+		actual, err = doc.MarshalBSON()
+		require.NoError(t, err)
+		require.Equal(t, expected, actual, "mode %d", mode)
+
+		// Raw values, RawD values and driver values are written as they
+		// were given.
+		var r mgobson.RawD
+		require.NoError(t, r.UnmarshalBSON(expected))
+		values := map[string]mgobson.Raw{}
+		for _, elem := range r {
+			values[elem.Name] = elem.Value
+		}
+		require.Equal(t, mgobson.Raw{Kind: 0x10, Data: []byte{1, 0, 0, 0}}, values["raw"])
+		require.Equal(t, mgobson.Raw{Kind: 0x03, Data: []byte{9, 0, 0, 0, 0x08, 'a', 0, 1, 0}}, values["rawd"])
+		require.Equal(t, mgobson.Raw{Kind: 0x10, Data: []byte{12, 0, 0, 0}}, values["ignored"])
+
+		ints := map[mgobson.EncodeMode]byte{mgobson.DriverEncodeMode: 0x12, mgobson.MgoEncodeMode: 0x10}
+		require.Equal(t, ints[mode], values["int"].Kind)
+	}
+	mgobson.SetDefaultEncodeMode(mgobson.DriverEncodeMode)
+
+	t.Run("appends", func(t *testing.T) {
+		m := mgobson.M{"a": int32(1)}
+		expected, err := m.MarshalBSON()
+		require.NoError(t, err)
+
+		dst := []byte("prefix")
+		dst, err = m.AppendBSON(dst)
+		require.NoError(t, err)
+		require.Equal(t, append([]byte("prefix"), expected...), dst)
+
+		r := mgobson.RawD{{"a", mgobson.Raw{Kind: 0x10, Data: []byte{1, 0, 0, 0}}}}
+		dst, err = r.AppendBSON(dst[:6])
+		require.NoError(t, err)
+		require.Equal(t, append([]byte("prefix"), expected...), dst)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		dst := []byte("prefix")
+		actual, err := mgobson.D{{"a", int32(1)}, {"b", mgobson.A{mgobson.ObjectId("short")}}}.AppendBSON(dst)
+		require.Equal(t, dst, actual)
+
+		var merr *mgobson.MarshalError
+		require.True(t, errors.As(err, &merr), "%v", err)
+		require.Equal(t, "b.0", merr.Path)
+
+		_, err = mgobson.M{"a": &getterType{err: errors.New("get")}}.AppendBSON(nil)
+		require.True(t, errors.As(err, &merr), "%v", err)
+		require.Equal(t, "a", merr.Path)
+
+		mgobson.SetStrictMarshal(true)
+		defer mgobson.SetStrictMarshal(false)
+
+		_, err = mgobson.D{{"r", mgobson.Raw{Kind: 0x10, Data: []byte{1}}}}.AppendBSON(nil)
+		require.True(t, errors.As(err, &merr), "%v", err)
+		require.Equal(t, "r", merr.Path)
+
+		_, err = mgobson.D{{"r", mgobson.RawD{{"a", mgobson.Raw{Kind: 0x10, Data: []byte{1}}}}}}.AppendBSON(nil)
+		require.True(t, errors.As(err, &merr), "%v", err)
+		require.Equal(t, "r.a", merr.Path)
+
+		actual, err = mgobson.RawD{{"a", mgobson.Raw{Kind: 0x10, Data: []byte{1}}}}.AppendBSON(dst)
+		require.Error(t, err)
+		require.Equal(t, dst, actual)
+	})
+
+	t.Run("allocations", func(t *testing.T) {
+		d := mgobson.D{{"a", int32(1)}, {"b", "two"}, {"c", mgobson.D{{"d", 3.0}}}}
+		buf := make([]byte, 0, 256)
+		allocs := testing.AllocsPerRun(100, func() {
+			_, _ = d.AppendBSON(buf[:0])
+		})
+		require.Zero(t, allocs)
+	})
+}
+
+// BenchmarkMarshal measures the encoding paths of M, D and RawD. The
+// MarshalBSONDocument benchmarks encode with AppendBSON and then parse the
+// result into a *bson.Document, so they measure the cost of that
+// conversion rather than a separate encoder.
+func BenchmarkMarshal(b *testing.B) {
+	// The whole test document is used, including the nested documents,
+	// Raw, RawD and driver values, structs and Getters.
+	d := appendTestDocument(b)
+	m := mgobson.M{}
+	for _, elem := range d {
+		m[elem.Name] = elem.Value
+	}
+
+	b.Run("D/MarshalBSONDocument", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			doc, _ := d.MarshalBSONDocument()
+			_, _ = doc.MarshalBSON()
+		}
+	})
+	b.Run("D/MarshalBSON", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, _ = d.MarshalBSON()
+		}
+	})
+	b.Run("D/AppendBSON", func(b *testing.B) {
+		b.ReportAllocs()
+		var buf []byte
+		for i := 0; i < b.N; i++ {
+			buf, _ = d.AppendBSON(buf[:0])
+		}
+	})
+
+	b.Run("M/MarshalBSONDocument", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			doc, _ := m.MarshalBSONDocument()
+			_, _ = doc.MarshalBSON()
+		}
+	})
+	b.Run("M/MarshalBSON", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, _ = m.MarshalBSON()
+		}
+	})
+	b.Run("M/AppendBSON", func(b *testing.B) {
+		b.ReportAllocs()
+		var buf []byte
+		for i := 0; i < b.N; i++ {
+			buf, _ = m.AppendBSON(buf[:0])
+		}
+	})
+
+	raw, err := d.MarshalBSON()
+	require.NoError(b, err)
+	var r mgobson.RawD
+	require.NoError(b, r.UnmarshalBSON(raw))
+
+	b.Run("RawD/MarshalBSONDocument", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			doc, _ := r.MarshalBSONDocument()
+			_, _ = doc.MarshalBSON()
+		}
+	})
+	b.Run("RawD/MarshalBSON", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			_, _ = r.MarshalBSON()
+		}
+	})
+	b.Run("RawD/AppendBSON", func(b *testing.B) {
+		b.ReportAllocs()
+		var buf []byte
+		for i := 0; i < b.N; i++ {
+			buf, _ = r.AppendBSON(buf[:0])
+		}
+	})
+}
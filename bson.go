@@ -10,7 +10,22 @@
 package mgobson
 
 import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
 	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/mongodb/mongo-go-driver/bson"
 )
@@ -23,53 +38,214 @@ var (
 	_ bson.Unmarshaler = (*M)(nil)
 	_ bson.Unmarshaler = (*D)(nil)
 	_ bson.Unmarshaler = (*RawD)(nil)
+
+	_ json.Marshaler   = (D)(nil)
+	_ json.Unmarshaler = (*D)(nil)
 )
 
-func DocsToArray(docs []interface{}) *bson.Array {
-	array := bson.NewArray()
+// Getter interface: a value implementing the bson.Getter interface will have its GetBSON
+// method called when the given value has to be marshalled, and the result
+// of this method will be marshaled in place of the actual object.
+//
+// If GetBSON returns return a non-nil error, the marshalling procedure
+// will stop and error out with the provided value.
+type Getter interface {
+	GetBSON() (interface{}, error)
+}
 
-	for _, doc := range docs {
-		d, err := bson.NewDocumentEncoder().EncodeDocument(doc)
-		if err != nil {
-			panic(err)
-		}
+// A value implementing the bson.Setter interface will receive the BSON
+// value via the SetBSON method during unmarshaling, and the object
+// itself will not be changed as usual.
+//
+// If setting the value works, the method should return nil or alternatively
+// bson.ErrSetZero to set the respective field to its zero value (nil for
+// pointer types). If SetBSON returns a value of type bson.TypeError, the
+// BSON value will be omitted from a map or slice being decoded and the
+// unmarshalling will continue. If it returns any other non-nil error, the
+// unmarshalling procedure will stop and error out with an *UnmarshalError
+// holding the provided value.
+//
+// This interface is generally useful in pointer receivers, since the method
+// will want to change the receiver. A type field that implements the Setter
+// interface doesn't have to be a pointer, though.
+//
+// Unlike the usual behavior, unmarshalling onto a value that implements a
+// Setter interface will NOT reset the value to its zero state. This allows
+// the value to decide by itself how to be unmarshalled.
+type Setter interface {
+	SetBSON(raw Raw) error
+}
 
-		array.Append(bson.VC.Document(d))
+// ErrSetZero may be returned from a SetBSON method to have the value set to
+// its respective zero value. When used in pointer values, this will set the
+// field to nil rather than to the pre-allocated value.
+var ErrSetZero = errors.New("set to zero")
+
+// SetZero is the name mgo used for ErrSetZero.
+var SetZero = ErrSetZero
+
+// TypeError may be returned by a SetBSON method to report that the BSON
+// value could not be stored into the value.
+type TypeError struct {
+	Type reflect.Type
+	Kind byte
+}
+
+func (e *TypeError) Error() string {
+	return fmt.Sprintf("BSON kind 0x%02x isn't compatible with type %s", e.Kind, e.Type.String())
+}
+
+// MarshalError is returned when a value can't be marshaled. Path is the
+// dotted path of the element that failed within the document being
+// marshaled, such as "items.3.price", and is empty if the document itself
+// couldn't be marshaled. Type is the Go type of the value at Path, and Kind
+// is the BSON kind that it was being marshaled as, or 0 if that wasn't
+// known yet. Err is the underlying error.
+type MarshalError struct {
+	Path string
+	Type reflect.Type
+	Kind byte
+	Err  error
+}
+
+func (e *MarshalError) Error() string {
+	return "error marshaling " + describeElement(e.Path, e.Type, e.Kind) + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *MarshalError) Unwrap() error {
+	return e.Err
+}
+
+// UnmarshalError is returned when a BSON value can't be unmarshaled. Path
+// is the dotted path of the element that failed within the document being
+// unmarshaled, such as "items.3.price", and is empty if the document itself
+// couldn't be unmarshaled. Type is the Go type that the value at Path was
+// being unmarshaled into, and Kind is its BSON kind. Err is the underlying
+// error.
+type UnmarshalError struct {
+	Path string
+	Type reflect.Type
+	Kind byte
+	Err  error
+}
+
+func (e *UnmarshalError) Error() string {
+	return "error unmarshaling " + describeElement(e.Path, e.Type, e.Kind) + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *UnmarshalError) Unwrap() error {
+	return e.Err
+}
+
+func describeElement(path string, t reflect.Type, kind byte) string {
+	var details []string
+	if t != nil {
+		details = append(details, "Go type "+t.String())
+	}
+	if kind != 0 {
+		details = append(details, fmt.Sprintf("BSON kind 0x%02x", kind))
 	}
 
-	return array
+	s := "document"
+	if path != "" {
+		s = strconv.Quote(path)
+	}
+	if len(details) > 0 {
+		s += " (" + strings.Join(details, ", ") + ")"
+	}
+	return s
 }
 
-func appendToDoc(doc *bson.Document, key string, value interface{}) error {
-	switch v := value.(type) {
-	case D:
-		d, err := v.MarshalBSONDocument()
-		if err != nil {
-			return err
-		}
+// joinPath prepends key to path, the dotted path of an element nested
+// within it.
+func joinPath(key, path string) string {
+	if path == "" || key == "" {
+		return key + path
+	}
+	return key + "." + path
+}
+
+// elementMarshalError returns err as a *MarshalError for the element key
+// holding value. If err is already a *MarshalError for an element nested
+// within value, key is prepended to its path.
+func elementMarshalError(err error, key string, value interface{}) error {
+	me, ok := err.(*MarshalError)
+	if !ok {
+		return &MarshalError{Path: key, Type: reflect.TypeOf(value), Err: err}
+	}
 
-		doc.Append(bson.EC.SubDocument(key, d))
-	case M:
-		d, err := v.MarshalBSONDocument()
+	wrapped := *me
+	if wrapped.Path == "" && wrapped.Type == nil {
+		wrapped.Type = reflect.TypeOf(value)
+	}
+	wrapped.Path = joinPath(key, wrapped.Path)
+	return &wrapped
+}
+
+// rootMarshalError returns err as a *MarshalError for in, the document
+// being marshaled, leaving it unchanged if it's one already.
+func rootMarshalError(err error, in interface{}) error {
+	if _, ok := err.(*MarshalError); ok || err == nil {
+		return err
+	}
+	return &MarshalError{Type: reflect.TypeOf(in), Kind: 0x03, Err: err}
+}
+
+// elementUnmarshalError returns err as an *UnmarshalError for the element
+// key holding a value of the given BSON kind, which was being unmarshaled
+// into a value of type t. If err is already an *UnmarshalError for an
+// element nested within that value, key is prepended to its path.
+func elementUnmarshalError(err error, key string, kind byte, t reflect.Type) error {
+	ue, ok := err.(*UnmarshalError)
+	if !ok {
+		return &UnmarshalError{Path: key, Type: t, Kind: kind, Err: err}
+	}
+
+	wrapped := *ue
+	wrapped.Path = joinPath(key, wrapped.Path)
+	return &wrapped
+}
+
+// rootUnmarshalError returns err as an *UnmarshalError for the value of the
+// given BSON kind being unmarshaled into a value of type t, leaving it
+// unchanged if it's one already.
+func rootUnmarshalError(err error, kind byte, t reflect.Type) error {
+	if _, ok := err.(*UnmarshalError); ok || err == nil {
+		return err
+	}
+	return &UnmarshalError{Type: t, Kind: kind, Err: err}
+}
+
+// DocsToArray marshals each of docs, which may be any value accepted by
+// Marshal, into a document of the returned array. If one of them can't be
+// marshaled, a *MarshalError is returned whose path starts with its index.
+func DocsToArray(docs []interface{}) (*bson.Array, error) {
+	array := bson.NewArray()
+	enc := newEncoder(defaultEncodeMode)
+
+	for i, doc := range docs {
+		b, err := enc.appendDocument(nil, doc)
 		if err != nil {
-			return err
+			return nil, elementMarshalError(err, strconv.Itoa(i), doc)
 		}
 
-		doc.Append(bson.EC.SubDocument(key, d))
-	case RawD:
-		d, err := v.MarshalBSONDocument()
+		d, err := bson.UnmarshalDocument(b)
 		if err != nil {
-			return err
+			return nil, elementMarshalError(err, strconv.Itoa(i), doc)
 		}
 
-		doc.Append(bson.EC.SubDocument(key, d))
-	default:
-		doc.Append(bson.EC.Interface(key, v))
+		array.Append(bson.VC.Document(d))
 	}
 
-	return nil
+	return array, nil
 }
 
+// zeroTimeMillis is the BSON datetime a zero time.Time is marshaled as. It is
+// decoded back into a zero time.Time rather than into the local time zone.
+const zeroTimeMillis = -62135596800000
+
 // M is a convenient alias for a map[string]interface{} map, useful for
 // dealing with BSON in a native way.  For instance:
 //
@@ -77,7 +253,8 @@ func appendToDoc(doc *bson.Document, key string, value interface{}) error {
 //
 // There's no special handling for this type in addition to what's done anyway
 // for an equivalent map type.  Elements in the map will be dumped in an
-// undefined ordered. See also the bson.D type for an ordered alternative.
+// undefined ordered, unless SetSortMapKeys is used to have them sorted by key.
+// See also the bson.D type for an ordered alternative.
 type M map[string]interface{}
 
 func (m M) MarshalBSONDocumentUnsafe() *bson.Document {
@@ -89,36 +266,48 @@ func (m M) MarshalBSONDocumentUnsafe() *bson.Document {
 	return doc
 }
 
+// MarshalBSONDocument marshals m as MarshalBSON does, and returns the result
+// as a *bson.Document.
 func (m M) MarshalBSONDocument() (*bson.Document, error) {
-	doc := bson.NewDocument()
-
-	for k, v := range m {
-		err := appendToDoc(doc, k, v)
-		if err != nil {
-			return nil, err
-		}
+	b, err := m.AppendBSON(nil)
+	if err != nil {
+		return nil, err
 	}
 
-	return doc, nil
+	doc, err := bson.UnmarshalDocument(b)
+	return doc, rootMarshalError(err, m)
 }
 
 func (m M) MarshalBSON() ([]byte, error) {
-	return bson.Marshal(map[string]interface{}(m))
+	return m.MarshalBSONWithMode(defaultEncodeMode)
+}
+
+// MarshalBSONWithMode is like MarshalBSON, but maps Go values to BSON types
+// as selected by mode instead of the package default.
+func (m M) MarshalBSONWithMode(mode EncodeMode) ([]byte, error) {
+	b, err := newEncoder(mode).marshal(m)
+	return b, rootMarshalError(err, m)
 }
 
 func (m *M) UnmarshalBSON(b []byte) error {
-	newM := make(map[string]interface{})
+	return m.UnmarshalBSONWithMode(b, defaultDecodeMode)
+}
 
-	err := bson.Unmarshal(b, newM)
-	if err != nil {
-		return err
+// UnmarshalBSONWithMode is like UnmarshalBSON, but maps BSON values to Go
+// types as selected by mode instead of the package default.
+func (m *M) UnmarshalBSONWithMode(b []byte, mode DecodeMode) error {
+	dec := newDecoder(mode)
+	raw, err := dec.check(Raw{Kind: 0x03, Data: b})
+	if err == nil {
+		err = m.unmarshalBSON(raw.Data, dec)
 	}
+	return rootUnmarshalError(err, 0x03, typeM)
+}
 
-	for key, val := range newM {
-		switch v := val.(type) {
-		case map[string]interface{}:
-			newM[key] = M(v)
-		}
+func (m *M) unmarshalBSON(b []byte, dec *decoder) error {
+	newM, err := dec.decodeMInto(nil, b)
+	if err != nil {
+		return err
 	}
 
 	*m = newM
@@ -144,61 +333,154 @@ func (d D) MarshalBSONDocumentUnsafe() *bson.Document {
 	return doc
 }
 
+// MarshalBSONDocument marshals d as MarshalBSON does, and returns the result
+// as a *bson.Document.
 func (d D) MarshalBSONDocument() (*bson.Document, error) {
-	doc := bson.NewDocument()
+	b, err := d.AppendBSON(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	doc, err := bson.UnmarshalDocument(b)
+	return doc, rootMarshalError(err, d)
+}
+
+func (d D) MarshalBSON() ([]byte, error) {
+	return d.MarshalBSONWithMode(defaultEncodeMode)
+}
+
+// MarshalBSONWithMode is like MarshalBSON, but maps Go values to BSON types
+// as selected by mode instead of the package default.
+func (d D) MarshalBSONWithMode(mode EncodeMode) ([]byte, error) {
+	b, err := newEncoder(mode).marshal(d)
+	return b, rootMarshalError(err, d)
+}
+
+func (d *D) UnmarshalBSON(b []byte) error {
+	return d.UnmarshalBSONWithMode(b, defaultDecodeMode)
+}
+
+// UnmarshalBSONWithMode is like UnmarshalBSON, but maps BSON values to Go
+// types as selected by mode instead of the package default.
+func (d *D) UnmarshalBSONWithMode(b []byte, mode DecodeMode) error {
+	dec := newDecoder(mode)
+	raw, err := dec.check(Raw{Kind: 0x03, Data: b})
+	if err == nil {
+		err = d.unmarshalBSON(raw.Data, dec)
+	}
+	return rootUnmarshalError(err, 0x03, typeD)
+}
+
+func (d *D) unmarshalBSON(b []byte, dec *decoder) error {
+	newD, err := dec.decodeDInto(nil, b)
+	if err != nil {
+		return err
+	}
+
+	*d = newD
+	return nil
+}
+
+// MarshalJSON encodes d as a JSON object with the elements of d in order.
+// The values are encoded as json.Marshal would encode them.
+func (d D) MarshalJSON() ([]byte, error) {
+	if d == nil {
+		return []byte("null"), nil
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, elem := range d {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
 
-	for _, elem := range d {
-		err := appendToDoc(doc, elem.Name, elem.Value)
+		key, err := json.Marshal(elem.Name)
 		if err != nil {
 			return nil, err
 		}
+		buf.Write(key)
+		buf.WriteByte(':')
+
+		value, err := json.Marshal(elem.Value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(value)
 	}
+	buf.WriteByte('}')
 
-	return doc, nil
+	return buf.Bytes(), nil
 }
 
-func (d D) MarshalBSON() ([]byte, error) {
-	doc, err := d.MarshalBSONDocument()
+// UnmarshalJSON decodes the JSON object in data into d, keeping the order
+// of its keys. Nested objects are decoded as D as well, so that their order
+// is kept too, and arrays as []interface{}. Other values are decoded as
+// json.Unmarshal would decode them into an interface{}.
+func (d *D) UnmarshalJSON(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+
+	v, err := readJSONValue(dec)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("invalid JSON data after top-level value")
 	}
 
-	return doc.MarshalBSON()
+	switch v := v.(type) {
+	case nil:
+		*d = nil
+	case D:
+		*d = v
+	default:
+		return fmt.Errorf("cannot unmarshal JSON %T into mgobson.D", v)
+	}
+	return nil
 }
 
-func (d *D) UnmarshalBSON(b []byte) error {
-	doc, err := bson.UnmarshalDocument(b)
+// readJSONValue reads the next JSON value from dec, decoding objects as D.
+func readJSONValue(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	newD := make(D, 0, doc.Len())
+	switch tok {
+	case json.Delim('{'):
+		doc := D{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
 
-	itr := doc.Iterator()
-	for itr.Next() {
-		elem := itr.Element()
+			value, err := readJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+
+			doc = append(doc, DocElem{key.(string), value})
+		}
 
-		var val interface{}
-		switch elem.Value().Type() {
-		case bson.TypeEmbeddedDocument:
-			subD := make(D, 0)
-			err := subD.UnmarshalBSON(elem.Value().ReaderDocument())
+		_, err := dec.Token()
+		return doc, err
+	case json.Delim('['):
+		a := []interface{}{}
+		for dec.More() {
+			value, err := readJSONValue(dec)
 			if err != nil {
-				return err
+				return nil, err
 			}
-			val = subD
-		default:
-			val = elem.Value().Interface()
+
+			a = append(a, value)
 		}
 
-		newD = append(newD, DocElem{elem.Key(), val})
-	}
-	if err := itr.Err(); err != nil {
-		return err
+		_, err := dec.Token()
+		return a, err
+	default:
+		return tok, nil
 	}
-
-	*d = newD
-	return nil
 }
 
 // DocElem is an element of the bson.D document representation.
@@ -207,10 +489,25 @@ type DocElem struct {
 	Value interface{}
 }
 
+// A represents a BSON array, and is a convenient alias for a []interface{}
+// slice that can be used alongside M and D. For example:
+//
+//     bson.D{{"$in", bson.A{1, "two", bson.M{"three": 3}}}}
+//
+// Like any other slice or array, its elements may themselves be M, D, RawD,
+// A or Getter values, which are encoded recursively.
+type A []interface{}
+
 // The Raw type represents raw unprocessed BSON documents and elements.
 // Kind is the kind of element as defined per the BSON specification, and
 // Data is the raw unprocessed data for the respective element.
-// Using this type it is possible to unmarshal or marshal values partially:// Relevant documentation:
+// Using this type it is possible to unmarshal or marshal values partially.
+//
+// When a Raw or RawD is unmarshaled from a document, its Data is a subslice
+// of the document rather than a copy, and Copy returns one that doesn't
+// depend on the document.
+//
+// Relevant documentation:
 //
 //     http://bsonspec.org/#/specification
 //
@@ -246,55 +543,552 @@ func (r RawD) MarshalBSONDocument() (*bson.Document, error) {
 		return nil, err
 	}
 
-	return bson.UnmarshalDocument(b)
+	doc, err := bson.UnmarshalDocument(b)
+	return doc, rootMarshalError(err, r)
 }
 
+// MarshalBSON concatenates the elements of r into a BSON document. The data
+// of the elements is copied as is, unless SetStrictMarshal enabled
+// validating it.
 func (r RawD) MarshalBSON() ([]byte, error) {
-	b := []byte{0, 0, 0, 0}
+	if strictMarshal {
+		if err := r.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	return r.marshalBSON(), nil
+}
 
+func (r RawD) marshalBSON() []byte {
+	size := 5
 	for _, elem := range r {
-		b = append(b, elem.Value.Kind)
-		b = append(b, elem.Name...)
-		b = append(b, 0)
-		b = append(b, elem.Value.Data...)
+		size += 1 + len(elem.Name) + 1 + len(elem.Value.Data)
 	}
 
-	b = append(b, 0)
-	length := uint32(len(b))
-	binary.LittleEndian.PutUint32(b, length)
-
-	return b, nil
+	return r.appendBSON(make([]byte, 0, size))
 }
 
+// UnmarshalBSON sets r to the elements of the BSON document in b. The data
+// of the elements isn't copied: the Data of each element is a subslice of
+// b, so b must not be modified or reused while r is in use. Copy returns a
+// RawD that doesn't depend on b.
 func (r *RawD) UnmarshalBSON(b []byte) error {
-	itr, err := bson.NewReaderIterator(b)
+	raw, err := newDecoder(defaultDecodeMode).check(Raw{Kind: 0x03, Data: b})
+	if err != nil {
+		return rootUnmarshalError(err, 0x03, typeRawD)
+	}
+
+	newR, err := splitDocument(raw.Data)
+	if err != nil {
+		return rootUnmarshalError(err, 0x03, typeRawD)
+	}
+
+	*r = newR
+	return nil
+}
+
+// Copy returns a copy of r whose data doesn't share memory with r, so that
+// it can be kept after the buffer r was unmarshaled from is reused. The data
+// of all elements is copied into a single new buffer.
+func (r RawD) Copy() RawD {
+	if r == nil {
+		return nil
+	}
+
+	n := 0
+	for _, elem := range r {
+		n += len(elem.Value.Data)
+	}
+
+	buf := make([]byte, 0, n)
+	c := make(RawD, len(r))
+	for i, elem := range r {
+		start := len(buf)
+		buf = append(buf, elem.Value.Data...)
+		c[i] = RawDocElem{Name: elem.Name, Value: Raw{Kind: elem.Value.Kind, Data: buf[start:len(buf):len(buf)]}}
+	}
+	return c
+}
+
+// Copy returns a copy of raw whose Data doesn't share memory with raw.
+func (raw Raw) Copy() Raw {
+	if raw.Data == nil {
+		return raw
+	}
+	return Raw{Kind: raw.Kind, Data: append([]byte{}, raw.Data...)}
+}
+
+// splitDocument splits the document at the start of b into its elements,
+// whose data are subslices of b. Only the bounds of the elements are
+// checked, not their content.
+func splitDocument(b []byte) (RawD, error) {
+	r := make(RawD, 0)
+	err := eachElement(b, func(kind byte, name, data []byte) error {
+		r = append(r, RawDocElem{Name: string(name), Value: Raw{Kind: kind, Data: data}})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// eachElement calls f with the kind, name and data of each element of the
+// document at the start of b, in order, stopping at the first error. The
+// name and data are subslices of b, and data is capped at its length. Only
+// the bounds of the elements are checked, not their content.
+func eachElement(b []byte, f func(kind byte, name, data []byte) error) error {
+	n, err := valueLength(0x03, b)
 	if err != nil {
 		return err
 	}
+	if b[n-1] != 0 {
+		return errors.New("document isn't terminated by a NUL byte")
+	}
 
-	newR := make(RawD, 0)
+	elems := b[4 : n-1]
+	for len(elems) > 0 {
+		kind := elems[0]
+		i := bytes.IndexByte(elems[1:], 0)
+		if i < 0 {
+			return errors.New("element name isn't terminated by a NUL byte")
+		}
+		name := elems[1 : 1+i]
+		elems = elems[2+i:]
 
-	for itr.Next() {
-		readerElem := itr.Element()
-		elemBytes, err := readerElem.MarshalBSON()
+		m, err := valueLength(kind, elems)
 		if err != nil {
+			return elementUnmarshalError(err, string(name), kind, typeRaw)
+		}
+
+		if err := f(kind, name, elems[:m:m]); err != nil {
 			return err
 		}
+		elems = elems[m:]
+	}
 
-		rawDocElem := RawDocElem{
-			Name: readerElem.Key(),
-			Value: Raw{
-				Kind: byte(readerElem.Value().Type()),
-				Data: elemBytes[1+len(readerElem.Key())+1:],
-			},
+	return nil
+}
+
+// ObjectId is a unique ID identifying a BSON value. It must be exactly 12 bytes
+// long. MongoDB objects by default have such a property set in their "_id"
+// property.
+//
+// http://www.mongodb.org/display/DOCS/Object+IDs
+type ObjectId string
+
+// ObjectIdHex returns an ObjectId from the provided hex representation.
+// Calling this function with an invalid hex representation will
+// cause a runtime panic. See the IsObjectIdHex function.
+func ObjectIdHex(s string) ObjectId {
+	d, err := hex.DecodeString(s)
+	if err != nil || len(d) != 12 {
+		panic(fmt.Sprintf("invalid input to ObjectIdHex: %q", s))
+	}
+	return ObjectId(d)
+}
+
+// IsObjectIdHex returns whether s is a valid hex representation of
+// an ObjectId. See the ObjectIdHex function.
+func IsObjectIdHex(s string) bool {
+	if len(s) != 24 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// objectIdCounter is atomically incremented when generating a new ObjectId
+// using NewObjectId() function. It's used as a counter part of an id.
+var objectIdCounter = readRandomUint32()
+
+// readRandomUint32 returns a random objectIdCounter.
+func readRandomUint32() uint32 {
+	var b [4]byte
+	_, err := io.ReadFull(rand.Reader, b[:])
+	if err != nil {
+		panic(fmt.Errorf("cannot read random object id: %v", err))
+	}
+	return binary.LittleEndian.Uint32(b[:])
+}
+
+// machineId stores machine id generated once and used in subsequent calls
+// to NewObjectId function.
+var machineId = readMachineId()
+var processId = os.Getpid()
+
+// readMachineId generates and returns a machine id.
+// If this function fails to get the hostname it will cause a runtime error.
+func readMachineId() []byte {
+	var sum [3]byte
+	id := sum[:]
+	hostname, err1 := os.Hostname()
+	if err1 != nil {
+		_, err2 := io.ReadFull(rand.Reader, id)
+		if err2 != nil {
+			panic(fmt.Errorf("cannot get hostname: %v; %v", err1, err2))
 		}
+		return id
+	}
+	hw := md5.New()
+	hw.Write([]byte(hostname))
+	copy(id, hw.Sum(nil))
+	return id
+}
 
-		newR = append(newR, rawDocElem)
+// NewObjectId returns a new unique ObjectId.
+func NewObjectId() ObjectId {
+	var b [12]byte
+	// Timestamp, 4 bytes, big endian
+	binary.BigEndian.PutUint32(b[:], uint32(time.Now().Unix()))
+	// Machine, first 3 bytes of md5(hostname)
+	b[4] = machineId[0]
+	b[5] = machineId[1]
+	b[6] = machineId[2]
+	// Pid, 2 bytes, specs don't specify endianness, but we use big endian.
+	b[7] = byte(processId >> 8)
+	b[8] = byte(processId)
+	// Increment, 3 bytes, big endian
+	i := atomic.AddUint32(&objectIdCounter, 1)
+	b[9] = byte(i >> 16)
+	b[10] = byte(i >> 8)
+	b[11] = byte(i)
+	return ObjectId(b[:])
+}
+
+// NewObjectIdWithTime returns a dummy ObjectId with the timestamp part filled
+// with the provided number of seconds from epoch UTC, and all other parts
+// filled with zeroes. It's not safe to insert a document with an id generated
+// by this method, it is useful only for queries to find documents with ids
+// generated before or after the specified timestamp.
+func NewObjectIdWithTime(t time.Time) ObjectId {
+	var b [12]byte
+	binary.BigEndian.PutUint32(b[:4], uint32(t.Unix()))
+	return ObjectId(b[:])
+}
+
+// String returns a hex string representation of the id.
+// Example: ObjectIdHex("4d88e15b60f486e428412dc9").
+func (id ObjectId) String() string {
+	return fmt.Sprintf(`ObjectIdHex("%x")`, string(id))
+}
+
+// Hex returns a hex representation of the ObjectId.
+func (id ObjectId) Hex() string {
+	return hex.EncodeToString([]byte(id))
+}
+
+// MarshalJSON turns a bson.ObjectId into a json.Marshaller.
+func (id ObjectId) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`"%x"`, string(id))), nil
+}
+
+var nullBytes = []byte("null")
+
+// UnmarshalJSON turns *bson.ObjectId into a json.Unmarshaller. Besides the
+// plain hex string, the {"$oid": "..."} and ObjectId("...") forms accepted
+// by mgo are also understood.
+func (id *ObjectId) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '{' {
+		var v struct {
+			Id json.RawMessage `json:"$oid"`
+		}
+		if err := json.Unmarshal(data, &v); err == nil && len(v.Id) > 0 {
+			data = v.Id
+		}
+	} else if bytes.HasPrefix(data, []byte("ObjectId(")) && bytes.HasSuffix(data, []byte(")")) {
+		data = bytes.TrimSpace(data[len("ObjectId(") : len(data)-1])
 	}
-	if err := itr.Err(); err != nil {
-		return err
+	if len(data) == 2 && data[0] == '"' && data[1] == '"' || bytes.Equal(data, nullBytes) {
+		*id = ""
+		return nil
 	}
+	if len(data) != 26 || data[0] != '"' || data[25] != '"' {
+		return fmt.Errorf("invalid ObjectId in JSON: %s", string(data))
+	}
+	var buf [12]byte
+	_, err := hex.Decode(buf[:], data[1:25])
+	if err != nil {
+		return fmt.Errorf("invalid ObjectId in JSON: %s (%s)", string(data), err)
+	}
+	*id = ObjectId(buf[:])
+	return nil
+}
 
-	*r = newR
+// MarshalText turns bson.ObjectId into an encoding.TextMarshaler.
+func (id ObjectId) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("%x", string(id))), nil
+}
+
+// UnmarshalText turns *bson.ObjectId into an encoding.TextUnmarshaler.
+func (id *ObjectId) UnmarshalText(data []byte) error {
+	if len(data) == 1 && data[0] == ' ' || len(data) == 0 {
+		*id = ""
+		return nil
+	}
+	if len(data) != 24 {
+		return fmt.Errorf("invalid ObjectId: %s", data)
+	}
+	var buf [12]byte
+	_, err := hex.Decode(buf[:], data[:])
+	if err != nil {
+		return fmt.Errorf("invalid ObjectId: %s (%s)", data, err)
+	}
+	*id = ObjectId(buf[:])
 	return nil
 }
+
+// Valid returns true if id is valid. A valid id must contain exactly 12 bytes.
+func (id ObjectId) Valid() bool {
+	return len(id) == 12
+}
+
+// byteSlice returns byte slice of id from start to end.
+// Calling this function with an invalid id will cause a runtime panic.
+func (id ObjectId) byteSlice(start, end int) []byte {
+	if len(id) != 12 {
+		panic(fmt.Sprintf("invalid ObjectId: %q", string(id)))
+	}
+	return []byte(string(id)[start:end])
+}
+
+// Time returns the timestamp part of the id.
+// It's a runtime error to call this method with an invalid id.
+func (id ObjectId) Time() time.Time {
+	// First 4 bytes of ObjectId is 32-bit big-endian seconds from epoch.
+	secs := int64(binary.BigEndian.Uint32(id.byteSlice(0, 4)))
+	return time.Unix(secs, 0)
+}
+
+// Machine returns the 3-byte machine id part of the id.
+// It's a runtime error to call this method with an invalid id.
+func (id ObjectId) Machine() []byte {
+	return id.byteSlice(4, 7)
+}
+
+// Pid returns the process id part of the id.
+// It's a runtime error to call this method with an invalid id.
+func (id ObjectId) Pid() uint16 {
+	return binary.BigEndian.Uint16(id.byteSlice(7, 9))
+}
+
+// Counter returns the incrementing value part of the id.
+// It's a runtime error to call this method with an invalid id.
+func (id ObjectId) Counter() int32 {
+	b := id.byteSlice(9, 12)
+	// Counter is stored as big-endian 3-byte value
+	return int32(uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2]))
+}
+
+// Binary is a representation for non-standard binary values.  Any kind should
+// work, but the following are known as of this writing:
+//
+//   0x00 - Generic. This is decoded as []byte(data), not Binary{0x00, data}.
+//   0x01 - Function (!?)
+//   0x02 - Obsolete generic.
+//   0x03 - UUID
+//   0x05 - MD5
+//   0x80 - User defined.
+//
+type Binary struct {
+	Kind byte
+	Data []byte
+}
+
+// Undefined represents the undefined BSON value.
+var Undefined undefined
+
+type undefined struct{}
+
+// MinKey is a special value that compares lower than all other possible BSON
+// values in a MongoDB database.
+var MinKey = orderKey(-1 << 63)
+
+// MaxKey is a special value that compares higher than all other possible BSON
+// values in a MongoDB database.
+var MaxKey = orderKey(1<<63 - 1)
+
+type orderKey int64
+
+// Symbol is a BSON symbol value. It is deprecated in the BSON specification
+// and is kept only to round-trip values written by older applications.
+type Symbol string
+
+// RegEx represents a regular expression.  The Options field may contain
+// individual characters defining the way in which the pattern should be
+// applied, and must be sorted. Valid options as of this writing are 'i' for
+// case insensitive matching, 'm' for multi-line matching, 'x' for verbose
+// mode, 'l' to make \w, \W, and similar be locale-dependent, 's' for dot-all
+// mode (a '.' matches everything), and 'u' to make \w, \W, and similar match
+// unicode. The value of the Options parameter is not verified before being
+// marshaled into the BSON format.
+type RegEx struct {
+	Pattern string
+	Options string
+}
+
+// JavaScript is a type that holds JavaScript code. If Scope is non-nil, it
+// will be marshaled as a mapping from identifiers to values that may be
+// used when evaluating the provided Code.
+type JavaScript struct {
+	Code  string
+	Scope interface{}
+}
+
+// DBPointer refers to a document id in a namespace.
+//
+// This type is deprecated in the BSON specification and should not be used
+// except for backwards compatibility with ancient applications.
+type DBPointer struct {
+	Namespace string
+	Id        ObjectId
+}
+
+// MongoTimestamp is a special internal type used by MongoDB that for some
+// strange reason has its own datatype defined in BSON. The most significant
+// 32 bits hold the seconds since the epoch and the least significant 32 bits
+// hold an ordinal that makes values with the same second unique.
+type MongoTimestamp int64
+
+// Now returns the current time with millisecond precision. MongoDB stores
+// timestamps with the same precision, so a Time returned from this method
+// will not change after a roundtrip to the database. That's the only reason
+// why this function exists. Using the time.Now function also works fine
+// otherwise.
+func Now() time.Time {
+	return time.Unix(0, time.Now().UnixNano()/1e6*1e6)
+}
+
+// structInfo describes how the exported fields of a struct type map onto
+// document keys.
+type structInfo struct {
+	FieldsMap  map[string]fieldInfo
+	FieldsList []fieldInfo
+	InlineMap  int
+}
+
+type fieldInfo struct {
+	Key       string
+	Num       int
+	OmitEmpty bool
+	MinSize   bool
+	Inline    []int
+}
+
+var structMap = struct {
+	sync.RWMutex
+	m map[reflect.Type]*structInfo
+}{m: make(map[reflect.Type]*structInfo)}
+
+// getStructInfo returns how the fields of st are marshaled, following the
+// tag rules documented in Marshal. The result is cached per type.
+func getStructInfo(st reflect.Type) (*structInfo, error) {
+	structMap.RLock()
+	sinfo, found := structMap.m[st]
+	structMap.RUnlock()
+	if found {
+		return sinfo, nil
+	}
+
+	n := st.NumField()
+	fieldsMap := make(map[string]fieldInfo)
+	fieldsList := make([]fieldInfo, 0, n)
+	inlineMap := -1
+	for i := 0; i != n; i++ {
+		field := st.Field(i)
+		if field.PkgPath != "" {
+			continue // Private field
+		}
+
+		info := fieldInfo{Num: i}
+
+		tag := field.Tag.Get("bson")
+		if tag == "" && !strings.Contains(string(field.Tag), ":") {
+			tag = string(field.Tag)
+		}
+		if tag == "-" {
+			continue
+		}
+
+		inline := false
+		fields := strings.Split(tag, ",")
+		if len(fields) > 1 {
+			for _, flag := range fields[1:] {
+				switch flag {
+				case "omitempty":
+					info.OmitEmpty = true
+				case "minsize":
+					info.MinSize = true
+				case "inline":
+					inline = true
+				default:
+					return nil, fmt.Errorf("Unsupported flag %q in tag %q of type %s", flag, tag, st)
+				}
+			}
+			tag = fields[0]
+		}
+
+		if inline {
+			switch field.Type.Kind() {
+			case reflect.Map:
+				if inlineMap >= 0 {
+					return nil, errors.New("Multiple ,inline maps in struct " + st.String())
+				}
+				if field.Type.Key().Kind() != reflect.String {
+					return nil, errors.New("Option ,inline needs a map with string keys in struct " + st.String())
+				}
+				inlineMap = info.Num
+			case reflect.Struct:
+				sinfo, err := getStructInfo(field.Type)
+				if err != nil {
+					return nil, err
+				}
+				for _, finfo := range sinfo.FieldsList {
+					if _, found := fieldsMap[finfo.Key]; found {
+						return nil, errors.New("Duplicated key '" + finfo.Key + "' in struct " + st.String())
+					}
+					if finfo.Inline == nil {
+						finfo.Inline = []int{i, finfo.Num}
+					} else {
+						finfo.Inline = append([]int{i}, finfo.Inline...)
+					}
+					fieldsMap[finfo.Key] = finfo
+					fieldsList = append(fieldsList, finfo)
+				}
+				if sinfo.InlineMap >= 0 {
+					return nil, errors.New("Option ,inline can't be used on a struct with an inline map in struct " + st.String())
+				}
+			default:
+				return nil, errors.New("Option ,inline needs a struct value or map field in struct " + st.String())
+			}
+			continue
+		}
+
+		if tag != "" {
+			info.Key = tag
+		} else {
+			info.Key = strings.ToLower(field.Name)
+		}
+
+		if _, found = fieldsMap[info.Key]; found {
+			return nil, errors.New("Duplicated key '" + info.Key + "' in struct " + st.String())
+		}
+
+		fieldsList = append(fieldsList, info)
+		fieldsMap[info.Key] = info
+	}
+
+	sinfo = &structInfo{
+		FieldsMap:  fieldsMap,
+		FieldsList: fieldsList,
+		InlineMap:  inlineMap,
+	}
+
+	structMap.Lock()
+	structMap.m[st] = sinfo
+	structMap.Unlock()
+
+	return sinfo, nil
+}
@@ -11,7 +11,11 @@ package mgobson_test
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/mongodb-labs/mgobson"
@@ -250,6 +254,53 @@ func TestAll(t *testing.T) {
 					},
 					nil,
 				},
+				{
+					"nested in array",
+					mgobson.M{},
+					[]byte{
+						// length - 44
+						0x2c, 0x0, 0x0, 0x0,
+
+						// type - array
+						0x4,
+						// key - "foo"
+						0x66, 0x6f, 0x6f, 0x0,
+
+						// ----- begin array -----
+
+						// length - 34
+						0x22, 0x0, 0x0, 0x0,
+
+						// type - document
+						0x3,
+						// key - "0"
+						0x30, 0x0,
+						// value - {"bar": false}
+						0xb, 0x0, 0x0, 0x0, 0x8, 0x62, 0x61, 0x72, 0x0, 0x0, 0x0,
+
+						// type - array
+						0x4,
+						// key - "1"
+						0x31, 0x0,
+						// value - [int32(1)]
+						0xc, 0x0, 0x0, 0x0, 0x10, 0x30, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0,
+
+						// null terminator
+						0x0,
+
+						// ----- end array -----
+
+						// null terminator
+						0x0,
+					},
+					mgobson.M{
+						"foo": []interface{}{
+							mgobson.M{"bar": false},
+							[]interface{}{int32(1)},
+						},
+					},
+					nil,
+				},
 			}
 
 			for _, tc := range testCases {
@@ -494,6 +545,53 @@ func TestAll(t *testing.T) {
 					},
 					nil,
 				},
+				{
+					"nested in array",
+					mgobson.D{},
+					[]byte{
+						// length - 44
+						0x2c, 0x0, 0x0, 0x0,
+
+						// type - array
+						0x4,
+						// key - "foo"
+						0x66, 0x6f, 0x6f, 0x0,
+
+						// ----- begin array -----
+
+						// length - 34
+						0x22, 0x0, 0x0, 0x0,
+
+						// type - document
+						0x3,
+						// key - "0"
+						0x30, 0x0,
+						// value - {"bar": false}
+						0xb, 0x0, 0x0, 0x0, 0x8, 0x62, 0x61, 0x72, 0x0, 0x0, 0x0,
+
+						// type - array
+						0x4,
+						// key - "1"
+						0x31, 0x0,
+						// value - [int32(1)]
+						0xc, 0x0, 0x0, 0x0, 0x10, 0x30, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0,
+
+						// null terminator
+						0x0,
+
+						// ----- end array -----
+
+						// null terminator
+						0x0,
+					},
+					mgobson.D{
+						{"foo", []interface{}{
+							mgobson.D{{"bar", false}},
+							[]interface{}{int32(1)},
+						}},
+					},
+					nil,
+				},
 			}
 
 			for _, tc := range testCases {
@@ -856,4 +954,534 @@ func TestAll(t *testing.T) {
 			}
 		})
 	})
+
+	t.Run("mgobson.ObjectId", func(t *testing.T) {
+		t.Run("Hex", func(t *testing.T) {
+			id := mgobson.ObjectIdHex("4d88e15b60f486e428412dc9")
+
+			require.True(t, id.Valid())
+			require.Equal(t, "4d88e15b60f486e428412dc9", id.Hex())
+			require.Equal(t, `ObjectIdHex("4d88e15b60f486e428412dc9")`, id.String())
+			require.Equal(t, time.Unix(0x4d88e15b, 0), id.Time())
+			require.Equal(t, []byte{0x60, 0xf4, 0x86}, id.Machine())
+			require.Equal(t, uint16(0xe428), id.Pid())
+			require.Equal(t, int32(0x412dc9), id.Counter())
+
+			require.True(t, mgobson.IsObjectIdHex("4d88e15b60f486e428412dc9"))
+			require.False(t, mgobson.IsObjectIdHex("4d88e15b60f486e428412dc"))
+			require.False(t, mgobson.IsObjectIdHex("4d88e15b60f486e428412dcz"))
+			require.Panics(t, func() { mgobson.ObjectIdHex("4d88") })
+		})
+
+		t.Run("New", func(t *testing.T) {
+			a := mgobson.NewObjectId()
+			b := mgobson.NewObjectId()
+
+			require.True(t, a.Valid())
+			require.NotEqual(t, a, b)
+			require.Equal(t, a.Machine(), b.Machine())
+			require.Equal(t, a.Pid(), b.Pid())
+			require.Equal(t, (a.Counter()+1)&0xffffff, b.Counter())
+
+			tm := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+			c := mgobson.NewObjectIdWithTime(tm)
+			require.Equal(t, tm.Unix(), c.Time().Unix())
+			require.Equal(t, "5a4af6a50000000000000000", c.Hex())
+		})
+
+		t.Run("JSON", func(t *testing.T) {
+			id := mgobson.ObjectIdHex("4d88e15b60f486e428412dc9")
+
+			b, err := json.Marshal(id)
+			require.NoError(t, err)
+			require.Equal(t, `"4d88e15b60f486e428412dc9"`, string(b))
+
+			testCases := []struct {
+				name     string
+				json     string
+				expected mgobson.ObjectId
+				err      bool
+			}{
+				{"hex", `"4d88e15b60f486e428412dc9"`, id, false},
+				{"$oid", `{"$oid": "4d88e15b60f486e428412dc9"}`, id, false},
+				{"func", `ObjectId("4d88e15b60f486e428412dc9")`, id, false},
+				{"empty", `""`, "", false},
+				{"null", `null`, "", false},
+				{"short", `"4d88e15b"`, "", true},
+				{"not hex", `"4d88e15b60f486e428412dcz"`, "", true},
+			}
+
+			for _, tc := range testCases {
+				var actual mgobson.ObjectId
+				err := actual.UnmarshalJSON([]byte(tc.json))
+				if tc.err {
+					require.Error(t, err, tc.name)
+					continue
+				}
+
+				require.NoError(t, err, tc.name)
+				require.Equal(t, tc.expected, actual, tc.name)
+			}
+		})
+
+		t.Run("Text", func(t *testing.T) {
+			id := mgobson.ObjectIdHex("4d88e15b60f486e428412dc9")
+
+			b, err := id.MarshalText()
+			require.NoError(t, err)
+			require.Equal(t, "4d88e15b60f486e428412dc9", string(b))
+
+			var actual mgobson.ObjectId
+			require.NoError(t, actual.UnmarshalText(b))
+			require.Equal(t, id, actual)
+
+			require.NoError(t, actual.UnmarshalText(nil))
+			require.Equal(t, mgobson.ObjectId(""), actual)
+
+			require.Error(t, actual.UnmarshalText([]byte("4d88")))
+		})
+
+		t.Run("RoundTrip", func(t *testing.T) {
+			id := mgobson.ObjectIdHex("4d88e15b60f486e428412dc9")
+
+			b, err := mgobson.D{{"_id", id}}.MarshalBSON()
+			require.NoError(t, err)
+			require.Equal(t, []byte{
+				// length - 22
+				0x16, 0x0, 0x0, 0x0,
+
+				// type - objectid
+				0x7,
+				// key - "_id"
+				0x5f, 0x69, 0x64, 0x0,
+				// value - 4d88e15b60f486e428412dc9
+				0x4d, 0x88, 0xe1, 0x5b, 0x60, 0xf4,
+				0x86, 0xe4, 0x28, 0x41, 0x2d, 0xc9,
+
+				// null terminator
+				0x0,
+			}, b)
+
+			var d mgobson.D
+			require.NoError(t, d.UnmarshalBSON(b))
+			require.Equal(t, mgobson.D{{"_id", id}}, d)
+
+			b, err = mgobson.M{"_id": id}.MarshalBSON()
+			require.NoError(t, err)
+
+			var m mgobson.M
+			require.NoError(t, m.UnmarshalBSON(b))
+			require.Equal(t, mgobson.M{"_id": id}, m)
+
+			_, err = mgobson.D{{"_id", mgobson.ObjectId("short")}}.MarshalBSON()
+			require.Error(t, err)
+		})
+	})
+
+	t.Run("mgobson.Binary", func(t *testing.T) {
+		testCases := []struct {
+			name     string
+			value    interface{}
+			b        []byte
+			expected interface{}
+		}{
+			{
+				"generic",
+				[]byte{0x1, 0x2},
+				[]byte{
+					// length - 17
+					0x11, 0x0, 0x0, 0x0,
+
+					// type - binary
+					0x5,
+					// key - "foo"
+					0x66, 0x6f, 0x6f, 0x0,
+					// value - length 2, subtype 0x00
+					0x2, 0x0, 0x0, 0x0, 0x0, 0x1, 0x2,
+
+					// null terminator
+					0x0,
+				},
+				[]byte{0x1, 0x2},
+			},
+			{
+				"generic kind",
+				mgobson.Binary{Kind: 0x00, Data: []byte{0x1, 0x2}},
+				[]byte{
+					// length - 17
+					0x11, 0x0, 0x0, 0x0,
+
+					// type - binary
+					0x5,
+					// key - "foo"
+					0x66, 0x6f, 0x6f, 0x0,
+					// value - length 2, subtype 0x00
+					0x2, 0x0, 0x0, 0x0, 0x0, 0x1, 0x2,
+
+					// null terminator
+					0x0,
+				},
+				[]byte{0x1, 0x2},
+			},
+			{
+				"old generic",
+				mgobson.Binary{Kind: 0x02, Data: []byte{0x1, 0x2}},
+				[]byte{
+					// length - 21
+					0x15, 0x0, 0x0, 0x0,
+
+					// type - binary
+					0x5,
+					// key - "foo"
+					0x66, 0x6f, 0x6f, 0x0,
+					// value - length 6, subtype 0x02, inner length 2
+					0x6, 0x0, 0x0, 0x0, 0x2, 0x2, 0x0, 0x0, 0x0, 0x1, 0x2,
+
+					// null terminator
+					0x0,
+				},
+				mgobson.Binary{Kind: 0x02, Data: []byte{0x1, 0x2}},
+			},
+			{
+				"user defined",
+				mgobson.Binary{Kind: 0x80, Data: []byte{0x1, 0x2}},
+				[]byte{
+					// length - 17
+					0x11, 0x0, 0x0, 0x0,
+
+					// type - binary
+					0x5,
+					// key - "foo"
+					0x66, 0x6f, 0x6f, 0x0,
+					// value - length 2, subtype 0x80
+					0x2, 0x0, 0x0, 0x0, 0x80, 0x1, 0x2,
+
+					// null terminator
+					0x0,
+				},
+				mgobson.Binary{Kind: 0x80, Data: []byte{0x1, 0x2}},
+			},
+		}
+
+		for _, tc := range testCases {
+			b, err := mgobson.D{{"foo", tc.value}}.MarshalBSON()
+			require.NoError(t, err, tc.name)
+			require.Equal(t, tc.b, b, tc.name)
+
+			b, err = mgobson.M{"foo": tc.value}.MarshalBSON()
+			require.NoError(t, err, tc.name)
+			require.Equal(t, tc.b, b, tc.name)
+
+			var d mgobson.D
+			require.NoError(t, d.UnmarshalBSON(tc.b), tc.name)
+			require.Equal(t, mgobson.D{{"foo", tc.expected}}, d, tc.name)
+
+			var m mgobson.M
+			require.NoError(t, m.UnmarshalBSON(tc.b), tc.name)
+			require.Equal(t, mgobson.M{"foo": tc.expected}, m, tc.name)
+
+			var r mgobson.RawD
+			require.NoError(t, r.UnmarshalBSON(tc.b), tc.name)
+			require.Equal(t, byte(0x5), r[0].Value.Kind, tc.name)
+
+			b, err = r.MarshalBSON()
+			require.NoError(t, err, tc.name)
+			require.Equal(t, tc.b, b, tc.name)
+		}
+	})
+
+	t.Run("special types", func(t *testing.T) {
+		id := mgobson.ObjectIdHex("4d88e15b60f486e428412dc9")
+
+		testCases := []struct {
+			name  string
+			value interface{}
+			kind  byte
+			d     interface{}
+			m     interface{}
+		}{
+			{
+				"regex",
+				mgobson.RegEx{Pattern: "^foo", Options: "i"},
+				0x0B,
+				mgobson.RegEx{Pattern: "^foo", Options: "i"},
+				mgobson.RegEx{Pattern: "^foo", Options: "i"},
+			},
+			{
+				"javascript",
+				mgobson.JavaScript{Code: "function() {}"},
+				0x0D,
+				mgobson.JavaScript{Code: "function() {}"},
+				mgobson.JavaScript{Code: "function() {}"},
+			},
+			{
+				"javascript with scope",
+				mgobson.JavaScript{Code: "x", Scope: mgobson.D{{"x", int32(1)}}},
+				0x0F,
+				mgobson.JavaScript{Code: "x", Scope: mgobson.D{{"x", int32(1)}}},
+				mgobson.JavaScript{Code: "x", Scope: mgobson.M{"x": int32(1)}},
+			},
+			{
+				"symbol",
+				mgobson.Symbol("foo"),
+				0x0E,
+				mgobson.Symbol("foo"),
+				mgobson.Symbol("foo"),
+			},
+			{
+				"dbpointer",
+				mgobson.DBPointer{Namespace: "db.coll", Id: id},
+				0x0C,
+				mgobson.DBPointer{Namespace: "db.coll", Id: id},
+				mgobson.DBPointer{Namespace: "db.coll", Id: id},
+			},
+			{
+				"undefined",
+				mgobson.Undefined,
+				0x06,
+				mgobson.Undefined,
+				mgobson.Undefined,
+			},
+			{
+				"null",
+				nil,
+				0x0A,
+				nil,
+				nil,
+			},
+			{
+				"minkey",
+				mgobson.MinKey,
+				0xFF,
+				mgobson.MinKey,
+				mgobson.MinKey,
+			},
+			{
+				"maxkey",
+				mgobson.MaxKey,
+				0x7F,
+				mgobson.MaxKey,
+				mgobson.MaxKey,
+			},
+		}
+
+		for _, tc := range testCases {
+			b, err := mgobson.D{{"foo", tc.value}}.MarshalBSON()
+			require.NoError(t, err, tc.name)
+
+			var r mgobson.RawD
+			require.NoError(t, r.UnmarshalBSON(b), tc.name)
+			require.Equal(t, tc.kind, r[0].Value.Kind, tc.name)
+
+			var d mgobson.D
+			require.NoError(t, d.UnmarshalBSON(b), tc.name)
+			require.Equal(t, mgobson.D{{"foo", tc.d}}, d, tc.name)
+
+			b, err = mgobson.M{"foo": tc.value}.MarshalBSON()
+			require.NoError(t, err, tc.name)
+
+			var m mgobson.M
+			require.NoError(t, m.UnmarshalBSON(b), tc.name)
+			require.Equal(t, mgobson.M{"foo": tc.m}, m, tc.name)
+		}
+	})
+
+	t.Run("mgobson.MongoTimestamp", func(t *testing.T) {
+		ts := mgobson.MongoTimestamp(0x5a4af6a500000003)
+		b := []byte{
+			// length - 17
+			0x11, 0x0, 0x0, 0x0,
+
+			// type - timestamp
+			0x11,
+			// key - "ts"
+			0x74, 0x73, 0x0,
+			// value - increment 3, seconds 0x5a4af6a5
+			0x3, 0x0, 0x0, 0x0, 0xa5, 0xf6, 0x4a, 0x5a,
+
+			// null terminator
+			0x0,
+		}
+
+		actual, err := mgobson.D{{"ts", ts}}.MarshalBSON()
+		require.NoError(t, err)
+		require.Equal(t, b, actual)
+
+		actual, err = mgobson.M{"ts": ts}.MarshalBSON()
+		require.NoError(t, err)
+		require.Equal(t, b, actual)
+
+		var d mgobson.D
+		require.NoError(t, d.UnmarshalBSON(b))
+		require.Equal(t, mgobson.D{{"ts", ts}}, d)
+
+		var m mgobson.M
+		require.NoError(t, m.UnmarshalBSON(b))
+		require.Equal(t, mgobson.M{"ts": ts}, m)
+
+		var r mgobson.RawD
+		require.NoError(t, r.UnmarshalBSON(b))
+		require.Equal(t, mgobson.RawD{{"ts", mgobson.Raw{Kind: 0x11, Data: b[8:16]}}}, r)
+	})
+
+	t.Run("Now", func(t *testing.T) {
+		now := mgobson.Now()
+		require.Equal(t, 0, now.Nanosecond()%1e6)
+
+		times := []time.Time{
+			now,
+			time.Unix(-1, 5e8),
+			time.Time{},
+		}
+
+		for _, tm := range times {
+			b, err := mgobson.D{{"t", tm}}.MarshalBSON()
+			require.NoError(t, err)
+
+			var d mgobson.D
+			require.NoError(t, d.UnmarshalBSON(b))
+			require.True(t, d[0].Value.(time.Time) == tm, "%v != %v", d[0].Value, tm)
+
+			b, err = mgobson.M{"t": tm}.MarshalBSON()
+			require.NoError(t, err)
+
+			var m mgobson.M
+			require.NoError(t, m.UnmarshalBSON(b))
+			require.True(t, m["t"].(time.Time) == tm, "%v != %v", m["t"], tm)
+		}
+	})
+}
+
+func TestDJSON(t *testing.T) {
+	d := mgobson.D{
+		{"z", 1},
+		{"y", mgobson.D{{"b", "x"}, {"a", nil}}},
+		{"x", []interface{}{mgobson.D{{"d", true}, {"c", 1.5}}}},
+		{"w", mgobson.M{"e": mgobson.D{{"g", 2}, {"f", 3}}}},
+		{"v", mgobson.D{}},
+	}
+	expected := `{"z":1,"y":{"b":"x","a":null},"x":[{"d":true,"c":1.5}],"w":{"e":{"g":2,"f":3}},"v":{}}`
+
+	b, err := json.Marshal(d)
+	require.NoError(t, err)
+	require.Equal(t, expected, string(b))
+
+	var actual mgobson.D
+	require.NoError(t, json.Unmarshal(b, &actual))
+	require.Equal(t, mgobson.D{
+		{"z", 1.0},
+		{"y", mgobson.D{{"b", "x"}, {"a", nil}}},
+		{"x", []interface{}{mgobson.D{{"d", true}, {"c", 1.5}}}},
+		{"w", mgobson.D{{"e", mgobson.D{{"g", 2.0}, {"f", 3.0}}}}},
+		{"v", mgobson.D{}},
+	}, actual)
+
+	t.Run("struct field", func(t *testing.T) {
+		var s struct {
+			Doc  mgobson.D
+			Docs []mgobson.D
+		}
+		require.NoError(t, json.Unmarshal([]byte(`{"Doc":{"b":1,"a":2},"Docs":[{"d":3,"c":4},null]}`), &s))
+		require.Equal(t, mgobson.D{{"b", 1.0}, {"a", 2.0}}, s.Doc)
+		require.Equal(t, []mgobson.D{{{"d", 3.0}, {"c", 4.0}}, nil}, s.Docs)
+
+		b, err := json.Marshal(s)
+		require.NoError(t, err)
+		require.Equal(t, `{"Doc":{"b":1,"a":2},"Docs":[{"d":3,"c":4},null]}`, string(b))
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		for _, in := range []string{`[]`, `"a"`, `1`, `{"a":1`, `{"a":1} {}`, `{"a":}`} {
+			var d mgobson.D
+			require.Error(t, json.Unmarshal([]byte(in), &d), in)
+		}
+
+		_, err := json.Marshal(mgobson.D{{"a", make(chan int)}})
+		require.Error(t, err)
+	})
+}
+
+func TestErrors(t *testing.T) {
+	type item struct {
+		Price mgobson.ObjectId `bson:"price"`
+	}
+	type order struct {
+		Items []item `bson:"items"`
+	}
+
+	t.Run("marshal", func(t *testing.T) {
+		in := order{Items: make([]item, 4)}
+		for i := range in.Items {
+			in.Items[i].Price = mgobson.NewObjectId()
+		}
+		in.Items[3].Price = "short"
+
+		_, err := mgobson.Marshal(in)
+		require.IsType(t, &mgobson.MarshalError{}, err)
+		merr := err.(*mgobson.MarshalError)
+		require.Equal(t, "items.3.price", merr.Path)
+		require.Equal(t, reflect.TypeOf(mgobson.ObjectId("")), merr.Type)
+		require.Equal(t, byte(0x07), merr.Kind)
+		require.EqualError(t, err, `error marshaling "items.3.price" (Go type mgobson.ObjectId, BSON kind 0x07): ObjectIDs must be exactly 12 bytes long (got 5)`)
+
+		_, err = mgobson.MarshalWithMode(mgobson.M{"a": mgobson.A{mgobson.D{{"b", uint64(1 << 63)}}}}, mgobson.MgoEncodeMode)
+		require.Equal(t, "a.0.b", err.(*mgobson.MarshalError).Path)
+		require.Equal(t, byte(0x12), err.(*mgobson.MarshalError).Kind)
+
+		_, err = mgobson.Marshal(42)
+		require.EqualError(t, err, `error marshaling document (Go type int, BSON kind 0x03): Can't marshal int as a BSON document`)
+
+		getErr := errors.New("failed")
+		_, err = mgobson.M{"a": &getterType{err: getErr}}.MarshalBSON()
+		require.True(t, errors.Is(err, getErr))
+
+		_, err = mgobson.RawD{{"a", mgobson.Raw{Kind: 0x10, Data: []byte{1}}}}.MarshalBSONDocument()
+		require.IsType(t, &mgobson.MarshalError{}, err)
+	})
+
+	t.Run("unmarshal", func(t *testing.T) {
+		b, err := mgobson.D{{"a", mgobson.A{int32(1), mgobson.D{{"b", mgobson.A{"x", nil}}}}}}.MarshalBSON()
+		require.NoError(t, err)
+
+		var out struct {
+			A []struct {
+				B []setterType
+			}
+		}
+		err = mgobson.Unmarshal(b, &out)
+		require.IsType(t, &mgobson.UnmarshalError{}, err)
+		uerr := err.(*mgobson.UnmarshalError)
+		require.Equal(t, "a.1.b.1", uerr.Path)
+		require.Equal(t, reflect.TypeOf(setterType{}), uerr.Type)
+		require.Equal(t, byte(0x0A), uerr.Kind)
+		require.EqualError(t, err, `error unmarshaling "a.1.b.1" (Go type mgobson_test.setterType, BSON kind 0x0a): null is not allowed`)
+
+		var fixed struct {
+			A [1]interface{}
+		}
+		err = mgobson.Unmarshal(b, &fixed)
+		require.Equal(t, "a", err.(*mgobson.UnmarshalError).Path)
+		require.Equal(t, byte(0x04), err.(*mgobson.UnmarshalError).Kind)
+
+		err = mgobson.Unmarshal(b, nil)
+		require.IsType(t, &mgobson.UnmarshalError{}, err)
+
+		for _, doc := range []interface{}{&mgobson.M{}, &mgobson.D{}, &mgobson.RawD{}} {
+			err := doc.(bson.Unmarshaler).UnmarshalBSON([]byte{1, 2, 3})
+			require.IsType(t, &mgobson.UnmarshalError{}, err, "%T", doc)
+			require.Equal(t, "", err.(*mgobson.UnmarshalError).Path)
+		}
+	})
+
+	t.Run("DocsToArray", func(t *testing.T) {
+		a, err := mgobson.DocsToArray([]interface{}{mgobson.M{"a": int32(1)}, mgobson.D{{"b", int32(2)}}})
+		require.NoError(t, err)
+		require.Equal(t, 2, a.Len())
+
+		_, err = mgobson.DocsToArray([]interface{}{mgobson.M{}, mgobson.D{{"b", mgobson.ObjectId("short")}}})
+		require.Equal(t, "1.b", err.(*mgobson.MarshalError).Path)
+
+		_, err = mgobson.DocsToArray([]interface{}{42})
+		require.Equal(t, "0", err.(*mgobson.MarshalError).Path)
+	})
 }
@@ -0,0 +1,512 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+//
+// Based on gopkg.in/mgo.v2/bson by Gustavo Niemeyer
+// See THIRD-PARTY-NOTICES for original license terms.
+
+package mgobson
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Decimal128 holds decimal128 BSON values, stored in the IEEE 754-2008
+// binary integer decimal (BID) encoding.
+//
+// Arithmetic on Decimal128 values follows IEEE 754-2008 as well: results are
+// rounded to 34 significant digits using round-half-even, results too large
+// to be represented become infinite, and operations on NaN produce NaN.
+type Decimal128 struct {
+	h, l uint64
+}
+
+const (
+	decimalMaxDigits    = 34
+	decimalMinExponent  = -6176
+	decimalMaxExponent  = 6111
+	decimalExponentBias = 6176
+)
+
+var (
+	dNaN    = Decimal128{0x1F << 58, 0}
+	dPosInf = Decimal128{0x1E << 58, 0}
+	dNegInf = Decimal128{0x3E << 58, 0}
+
+	bigOne          = big.NewInt(1)
+	bigTen          = big.NewInt(10)
+	decimalMaxCoeff = new(big.Int).Sub(new(big.Int).Exp(bigTen, big.NewInt(decimalMaxDigits), nil), bigOne)
+)
+
+// decimalKind classifies a Decimal128 value.
+type decimalKind int
+
+const (
+	decimalFinite decimalKind = iota
+	decimalInf
+	decimalNaN
+)
+
+// decimalParts is the unpacked form of a Decimal128 used by the arithmetic
+// and formatting routines. The value is (-1)^neg * coeff * 10^exp.
+type decimalParts struct {
+	kind  decimalKind
+	neg   bool
+	coeff *big.Int
+	exp   int
+}
+
+func (d Decimal128) parts() decimalParts {
+	p := decimalParts{neg: d.h>>63 == 1}
+
+	switch d.h >> 58 & (1<<5 - 1) {
+	case 0x1F:
+		p.kind = decimalNaN
+		return p
+	case 0x1E:
+		p.kind = decimalInf
+		return p
+	}
+
+	p.coeff = new(big.Int)
+	if d.h>>61&3 == 3 {
+		// Bits: 1*sign 2*ignored 14*exponent 111*significand.
+		// The implicit 0b100 prefix makes every such significand larger
+		// than the maximum, so the spec treats them all as zero.
+		p.exp = int(d.h>>47&(1<<14-1)) - decimalExponentBias
+		return p
+	}
+
+	// Bits: 1*sign 14*exponent 113*significand
+	p.exp = int(d.h>>49&(1<<14-1)) - decimalExponentBias
+	p.coeff.SetUint64(d.h & (1<<49 - 1))
+	p.coeff.Lsh(p.coeff, 64)
+	p.coeff.Or(p.coeff, new(big.Int).SetUint64(d.l))
+	if p.coeff.Cmp(decimalMaxCoeff) > 0 {
+		p.coeff.SetInt64(0)
+	}
+	return p
+}
+
+// pack turns finite parts whose coefficient and exponent are already in
+// range into a Decimal128.
+func (p decimalParts) pack() Decimal128 {
+	var d Decimal128
+	words := new(big.Int).Set(p.coeff)
+	d.l = words.Uint64()
+	d.h = words.Rsh(words, 64).Uint64()
+	d.h |= uint64(p.exp+decimalExponentBias) & (1<<14 - 1) << 49
+	if p.neg {
+		d.h |= 1 << 63
+	}
+	return d
+}
+
+// decimalDigits returns the number of decimal digits in x, which must not be
+// negative. Zero has one digit.
+func decimalDigits(x *big.Int) int {
+	if x.Sign() == 0 {
+		return 1
+	}
+	return len(x.Text(10))
+}
+
+// pow10 returns 10^n as a new big.Int.
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(bigTen, big.NewInt(int64(n)), nil)
+}
+
+// shiftRoundHalfEven divides x by 10^n, rounding to nearest with ties going
+// to the even neighbour. It returns a new big.Int.
+func shiftRoundHalfEven(x *big.Int, n int) *big.Int {
+	if n <= 0 {
+		return new(big.Int).Set(x)
+	}
+	if n > decimalDigits(x) {
+		// x is less than a tenth of 10^n, so it rounds to zero. This saves
+		// computing 10^n for the large n that Round may be given.
+		return new(big.Int)
+	}
+	div := pow10(n)
+	q, r := new(big.Int).QuoRem(x, div, new(big.Int))
+	r.Lsh(r, 1)
+	switch c := r.Cmp(div); {
+	case c > 0, c == 0 && q.Bit(0) == 1:
+		q.Add(q, bigOne)
+	}
+	return q
+}
+
+// round brings a finite result back into the range of Decimal128, rounding
+// the coefficient to 34 digits and clamping the exponent as IEEE 754
+// requires.
+func (p decimalParts) round() Decimal128 {
+	coeff, exp := p.coeff, p.exp
+
+	// The digits beyond 34 and those below the minimum exponent are
+	// dropped in a single rounding, since rounding twice can turn a value
+	// just below a half-way point into a tie.
+	n := decimalDigits(coeff) - decimalMaxDigits
+	if m := decimalMinExponent - exp; m > n {
+		// Subnormal.
+		n = m
+	}
+	if n > 0 {
+		coeff = shiftRoundHalfEven(coeff, n)
+		exp += n
+		if coeff.Cmp(decimalMaxCoeff) > 0 {
+			// Rounding carried into a 35th digit, which divides exactly.
+			coeff = shiftRoundHalfEven(coeff, 1)
+			exp++
+		}
+	}
+
+	if exp > decimalMaxExponent {
+		if coeff.Sign() == 0 {
+			exp = decimalMaxExponent
+		} else {
+			// Clamped.
+			n := exp - decimalMaxExponent
+			if decimalDigits(coeff)+n > decimalMaxDigits {
+				if p.neg {
+					return dNegInf
+				}
+				return dPosInf
+			}
+			coeff = new(big.Int).Mul(coeff, pow10(n))
+			exp = decimalMaxExponent
+		}
+	}
+
+	return decimalParts{neg: p.neg, coeff: coeff, exp: exp}.pack()
+}
+
+func dErr(s string) (Decimal128, error) {
+	return dNaN, fmt.Errorf("cannot parse %q as a decimal128", s)
+}
+
+// ParseDecimal128 parses s as a decimal128 value. It accepts an optional sign
+// followed by a decimal number with an optional exponent, as well as "NaN",
+// "Inf" and "Infinity" in any case. Strings that cannot be represented exactly,
+// such as those with more than 34 significant digits, result in an error.
+func ParseDecimal128(s string) (Decimal128, error) {
+	orig := s
+	if s == "" {
+		return dErr(orig)
+	}
+	neg := s[0] == '-'
+	if neg || s[0] == '+' {
+		s = s[1:]
+	}
+
+	switch {
+	case strings.EqualFold(s, "nan"):
+		return dNaN, nil
+	case strings.EqualFold(s, "inf"), strings.EqualFold(s, "infinity"):
+		if neg {
+			return dNegInf, nil
+		}
+		return dPosInf, nil
+	}
+
+	mantissa, exponent := s, ""
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		mantissa, exponent = s[:i], s[i+1:]
+		if exponent == "" {
+			return dErr(orig)
+		}
+	}
+
+	var digits strings.Builder
+	dot := -1
+	for i := 0; i < len(mantissa); i++ {
+		c := mantissa[i]
+		switch {
+		case c >= '0' && c <= '9':
+			digits.WriteByte(c)
+		case c == '.' && dot < 0:
+			dot = digits.Len()
+		default:
+			return dErr(orig)
+		}
+	}
+	if digits.Len() == 0 {
+		return dErr(orig)
+	}
+
+	exp := 0
+	if exponent != "" {
+		if exponent[0] != '+' && exponent[0] != '-' && (exponent[0] < '0' || exponent[0] > '9') {
+			return dErr(orig)
+		}
+		n, err := strconv.ParseInt(exponent, 10, 32)
+		if err != nil {
+			return dErr(orig)
+		}
+		exp = int(n)
+	}
+	if dot >= 0 {
+		exp -= digits.Len() - dot
+	}
+
+	coeff, _ := new(big.Int).SetString(digits.String(), 10)
+
+	if coeff.Sign() == 0 {
+		// Zeros are clamped into range, which is exact.
+		if exp < decimalMinExponent {
+			exp = decimalMinExponent
+		}
+		if exp > decimalMaxExponent {
+			exp = decimalMaxExponent
+		}
+		return decimalParts{neg: neg, coeff: coeff, exp: exp}.pack(), nil
+	}
+
+	// Drop trailing zeros that do not fit, which is exact.
+	for decimalDigits(coeff) > decimalMaxDigits || exp < decimalMinExponent {
+		q, r := new(big.Int).QuoRem(coeff, bigTen, new(big.Int))
+		if r.Sign() != 0 {
+			return dErr(orig)
+		}
+		coeff = q
+		exp++
+	}
+
+	if exp > decimalMaxExponent {
+		// Clamped, which is exact while the digits still fit.
+		n := exp - decimalMaxExponent
+		if decimalDigits(coeff)+n > decimalMaxDigits {
+			return dErr(orig)
+		}
+		coeff.Mul(coeff, pow10(n))
+		exp = decimalMaxExponent
+	}
+
+	return decimalParts{neg: neg, coeff: coeff, exp: exp}.pack(), nil
+}
+
+// String returns a string representation of the decimal value, using the
+// scientific notation rules of the decimal128 specification.
+func (d Decimal128) String() string {
+	p := d.parts()
+
+	var sign string
+	if p.neg {
+		sign = "-"
+	}
+
+	switch p.kind {
+	case decimalNaN:
+		return "NaN"
+	case decimalInf:
+		return sign + "Infinity"
+	}
+
+	digits := p.coeff.Text(10)
+	adjusted := p.exp + len(digits) - 1
+
+	if p.exp > 0 || adjusted < -6 {
+		var b strings.Builder
+		b.WriteString(sign)
+		b.WriteByte(digits[0])
+		if len(digits) > 1 {
+			b.WriteByte('.')
+			b.WriteString(digits[1:])
+		}
+		b.WriteByte('E')
+		if adjusted >= 0 {
+			b.WriteByte('+')
+		}
+		b.WriteString(strconv.Itoa(adjusted))
+		return b.String()
+	}
+
+	if p.exp == 0 {
+		return sign + digits
+	}
+
+	point := len(digits) + p.exp
+	if point > 0 {
+		return sign + digits[:point] + "." + digits[point:]
+	}
+	return sign + "0." + strings.Repeat("0", -point) + digits
+}
+
+// IsNaN reports whether d is a NaN value.
+func (d Decimal128) IsNaN() bool {
+	return d.parts().kind == decimalNaN
+}
+
+// IsInf reports whether d is an infinity, according to sign. If sign > 0,
+// IsInf reports whether d is positive infinity. If sign < 0, IsInf reports
+// whether d is negative infinity. If sign == 0, IsInf reports whether d is
+// either infinity.
+func (d Decimal128) IsInf(sign int) bool {
+	p := d.parts()
+	return p.kind == decimalInf && (sign == 0 || sign > 0 && !p.neg || sign < 0 && p.neg)
+}
+
+// Neg returns d with its sign inverted.
+func (d Decimal128) Neg() Decimal128 {
+	if d.IsNaN() {
+		return d
+	}
+	d.h ^= 1 << 63
+	return d
+}
+
+// Cmp compares d and o and returns -1, 0 or +1 depending on whether d is
+// less than, equal to or greater than o. Values are compared numerically, so
+// 1.0 and 1.00 are equal, as are -0 and 0. Like MongoDB, Cmp considers NaN
+// equal to NaN and less than any other value.
+func (d Decimal128) Cmp(o Decimal128) int {
+	a, b := d.parts(), o.parts()
+
+	switch {
+	case a.kind == decimalNaN && b.kind == decimalNaN:
+		return 0
+	case a.kind == decimalNaN:
+		return -1
+	case b.kind == decimalNaN:
+		return 1
+	}
+
+	as, bs := a.sign(), b.sign()
+	if as != bs {
+		if as < bs {
+			return -1
+		}
+		return 1
+	}
+
+	switch {
+	case a.kind == decimalInf && b.kind == decimalInf:
+		return 0
+	case a.kind == decimalInf:
+		return as
+	case b.kind == decimalInf:
+		return -bs
+	}
+
+	ac, bc := alignCoefficients(a, b)
+	return as * ac.Cmp(bc)
+}
+
+// sign returns -1, 0 or +1 for finite and infinite parts. Zero has sign 0
+// regardless of its sign bit.
+func (p decimalParts) sign() int {
+	switch {
+	case p.kind == decimalFinite && p.coeff.Sign() == 0:
+		return 0
+	case p.neg:
+		return -1
+	default:
+		return 1
+	}
+}
+
+// alignCoefficients returns the coefficients of a and b scaled to the
+// smaller of both exponents.
+func alignCoefficients(a, b decimalParts) (*big.Int, *big.Int) {
+	ac, bc := a.coeff, b.coeff
+	switch {
+	case a.exp > b.exp:
+		ac = new(big.Int).Mul(ac, pow10(a.exp-b.exp))
+	case b.exp > a.exp:
+		bc = new(big.Int).Mul(bc, pow10(b.exp-a.exp))
+	}
+	return ac, bc
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Add returns the sum d+o.
+func (d Decimal128) Add(o Decimal128) Decimal128 {
+	a, b := d.parts(), o.parts()
+
+	switch {
+	case a.kind == decimalNaN || b.kind == decimalNaN:
+		return dNaN
+	case a.kind == decimalInf && b.kind == decimalInf:
+		if a.neg != b.neg {
+			return dNaN
+		}
+		return d
+	case a.kind == decimalInf:
+		return d
+	case b.kind == decimalInf:
+		return o
+	}
+
+	ac, bc := alignCoefficients(a, b)
+	if a.neg {
+		ac = new(big.Int).Neg(ac)
+	}
+	if b.neg {
+		bc = new(big.Int).Neg(bc)
+	}
+	sum := new(big.Int).Add(ac, bc)
+
+	// The sum of two zeros is negative only if both are negative, and an
+	// exact zero sum of non-zero values is positive.
+	neg := sum.Sign() < 0 || sum.Sign() == 0 && a.neg && b.neg
+	return decimalParts{neg: neg, coeff: sum.Abs(sum), exp: minInt(a.exp, b.exp)}.round()
+}
+
+// Sub returns the difference d-o.
+func (d Decimal128) Sub(o Decimal128) Decimal128 {
+	return d.Add(o.Neg())
+}
+
+// Mul returns the product d*o.
+func (d Decimal128) Mul(o Decimal128) Decimal128 {
+	a, b := d.parts(), o.parts()
+	neg := a.neg != b.neg
+
+	switch {
+	case a.kind == decimalNaN || b.kind == decimalNaN:
+		return dNaN
+	case a.kind == decimalInf || b.kind == decimalInf:
+		if a.sign() == 0 || b.sign() == 0 {
+			return dNaN
+		}
+		if neg {
+			return dNegInf
+		}
+		return dPosInf
+	}
+
+	product := new(big.Int).Mul(a.coeff, b.coeff)
+	return decimalParts{neg: neg, coeff: product, exp: a.exp + b.exp}.round()
+}
+
+// Round returns d rounded to the given number of digits after the decimal
+// point, using round-half-even as MongoDB's $round does. A negative scale
+// rounds to the left of the decimal point. Values that already have no more
+// than scale digits after the decimal point, as well as NaN and infinities,
+// are returned unchanged.
+func (d Decimal128) Round(scale int) Decimal128 {
+	p := d.parts()
+	if scale < -decimalMaxExponent-decimalMaxDigits-1 {
+		// Every finite value rounds to zero, whose exponent is clamped to
+		// the largest one. Limiting scale keeps -scale from overflowing.
+		scale = -decimalMaxExponent - decimalMaxDigits - 1
+	}
+	if p.kind != decimalFinite || p.exp >= -scale {
+		return d
+	}
+
+	p.coeff = shiftRoundHalfEven(p.coeff, -scale-p.exp)
+	p.exp = -scale
+	return p.round()
+}
@@ -0,0 +1,252 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+//
+// Based on gopkg.in/mgo.v2/bson by Gustavo Niemeyer
+// See THIRD-PARTY-NOTICES for original license terms.
+
+package mgobson_test
+
+import (
+	"testing"
+
+	"github.com/mongodb-labs/mgobson"
+	"github.com/stretchr/testify/require"
+)
+
+func mustParseDecimal(t *testing.T, s string) mgobson.Decimal128 {
+	d, err := mgobson.ParseDecimal128(s)
+	require.NoError(t, err, s)
+	return d
+}
+
+func TestDecimal128(t *testing.T) {
+	t.Run("Parse", func(t *testing.T) {
+		testCases := []struct {
+			in  string
+			out string
+		}{
+			{"0", "0"},
+			{"-0", "-0"},
+			{"1", "1"},
+			{"-1", "-1"},
+			{"0.1", "0.1"},
+			{"0.001234", "0.001234"},
+			{"123456789012", "123456789012"},
+			{"0.00000001234567890", "1.234567890E-8"},
+			{"1.000000000000000000000000000000000", "1.000000000000000000000000000000000"},
+			{"9.999999999999999999999999999999999E+6144", "9.999999999999999999999999999999999E+6144"},
+			{"1E-6176", "1E-6176"},
+			{"0E-6177", "0E-6176"},
+			{"0E+6112", "0E+6111"},
+			{"1E+6144", "1.000000000000000000000000000000000E+6144"},
+			{"1000000000000000000000000000000000000", "1.000000000000000000000000000000000E+36"},
+			{"1.050E+3", "1050"},
+			{"1.050E+4", "1.050E+4"},
+			{"1E3", "1E+3"},
+			{"-100E-10", "-1.00E-8"},
+			{".5", "0.5"},
+			{"5.", "5"},
+			{"+12.5", "12.5"},
+			{"NaN", "NaN"},
+			{"nan", "NaN"},
+			{"Infinity", "Infinity"},
+			{"-inf", "-Infinity"},
+		}
+
+		for _, tc := range testCases {
+			d, err := mgobson.ParseDecimal128(tc.in)
+			require.NoError(t, err, tc.in)
+			require.Equal(t, tc.out, d.String(), tc.in)
+		}
+
+		invalid := []string{
+			"",
+			"-",
+			".",
+			"E3",
+			"1E",
+			"1e+",
+			"1.2.3",
+			"1x",
+			"Infinit",
+			"12345678901234567890123456789012345",
+			"1E+6145",
+			"1E-6177",
+		}
+
+		for _, s := range invalid {
+			_, err := mgobson.ParseDecimal128(s)
+			require.Error(t, err, s)
+		}
+	})
+
+	t.Run("BSON", func(t *testing.T) {
+		b := []byte{
+			// length - 24
+			0x18, 0x0, 0x0, 0x0,
+
+			// type - decimal128
+			0x13,
+			// key - "d"
+			0x64, 0x0,
+			// value - 1.00
+			0x64, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0,
+			0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x3c, 0x30,
+
+			// null terminator
+			0x0,
+		}
+		d := mustParseDecimal(t, "1.00")
+
+		actual, err := mgobson.D{{"d", d}}.MarshalBSON()
+		require.NoError(t, err)
+		require.Equal(t, b, actual)
+	})
+
+	t.Run("RoundTrip", func(t *testing.T) {
+		for _, s := range []string{"1.00", "-0", "NaN", "-Infinity", "1E-6176", "12345.6789"} {
+			d := mustParseDecimal(t, s)
+
+			b, err := mgobson.D{{"d", d}}.MarshalBSON()
+			require.NoError(t, err, s)
+
+			var actualD mgobson.D
+			require.NoError(t, actualD.UnmarshalBSON(b), s)
+			require.Equal(t, mgobson.D{{"d", d}}, actualD, s)
+
+			var actualM mgobson.M
+			require.NoError(t, actualM.UnmarshalBSON(b), s)
+			require.Equal(t, mgobson.M{"d": d}, actualM, s)
+
+			var r mgobson.RawD
+			require.NoError(t, r.UnmarshalBSON(b), s)
+			require.Equal(t, byte(0x13), r[0].Value.Kind, s)
+
+			rb, err := r.MarshalBSON()
+			require.NoError(t, err, s)
+			require.Equal(t, b, rb, s)
+		}
+	})
+
+	t.Run("Cmp", func(t *testing.T) {
+		testCases := []struct {
+			a, b string
+			cmp  int
+		}{
+			{"1", "1.00", 0},
+			{"0", "-0", 0},
+			{"1.1", "1.09", 1},
+			{"-1.1", "-1.09", -1},
+			{"-1", "0", -1},
+			{"1E+10", "9999999999", 1},
+			{"Infinity", "9.999999999999999999999999999999999E+6144", 1},
+			{"-Infinity", "-9.999999999999999999999999999999999E+6144", -1},
+			{"Infinity", "Infinity", 0},
+			{"NaN", "-Infinity", -1},
+			{"NaN", "NaN", 0},
+			{"0", "NaN", 1},
+		}
+
+		for _, tc := range testCases {
+			a, b := mustParseDecimal(t, tc.a), mustParseDecimal(t, tc.b)
+			require.Equal(t, tc.cmp, a.Cmp(b), "%s <=> %s", tc.a, tc.b)
+			require.Equal(t, -tc.cmp, b.Cmp(a), "%s <=> %s", tc.b, tc.a)
+		}
+	})
+
+	t.Run("Arithmetic", func(t *testing.T) {
+		testCases := []struct {
+			op   string
+			a, b string
+			out  string
+		}{
+			{"+", "1.10", "2.205", "3.305"},
+			{"+", "0.1", "0.2", "0.3"},
+			{"+", "1", "-1", "0"},
+			{"+", "-0", "-0", "-0"},
+			{"+", "1E+2", "1", "101"},
+			{"+", "9999999999999999999999999999999999", "1", "1.000000000000000000000000000000000E+34"},
+			{"+", "1234567890123456789012345678901234", "0.5", "1234567890123456789012345678901234"},
+			{"+", "1234567890123456789012345678901235", "0.5", "1234567890123456789012345678901236"},
+			{"+", "9.999999999999999999999999999999999E+6144", "9.999999999999999999999999999999999E+6144", "Infinity"},
+			{"+", "Infinity", "-Infinity", "NaN"},
+			{"+", "Infinity", "1", "Infinity"},
+			{"+", "NaN", "1", "NaN"},
+			{"-", "3.305", "2.205", "1.100"},
+			{"-", "1", "1", "0"},
+			{"-", "-Infinity", "1", "-Infinity"},
+			{"*", "1.10", "3", "3.30"},
+			{"*", "-2", "0.5", "-1.0"},
+			{"*", "0", "-5", "-0"},
+			{"*", "0", "Infinity", "NaN"},
+			{"*", "-2", "Infinity", "-Infinity"},
+			{"*", "1E-6176", "0.1", "0E-6176"},
+			{"*", "1E-6176", "0.6", "1E-6176"},
+			{"*", "1000000000000000000000000000000159E-6100", "11E-78", "1.10000000000000000000000000000017E-6144"},
+			{"*", "1000000000000000000000000000000050E-6100", "11E-78", "1.10000000000000000000000000000006E-6144"},
+			{"*", "1E+6111", "10", "1.0E+6112"},
+			{"*", "1E+6144", "10", "Infinity"},
+		}
+
+		for _, tc := range testCases {
+			a, b := mustParseDecimal(t, tc.a), mustParseDecimal(t, tc.b)
+
+			var out mgobson.Decimal128
+			switch tc.op {
+			case "+":
+				out = a.Add(b)
+			case "-":
+				out = a.Sub(b)
+			case "*":
+				out = a.Mul(b)
+			}
+
+			require.Equal(t, tc.out, out.String(), "%s %s %s", tc.a, tc.op, tc.b)
+		}
+	})
+
+	t.Run("Round", func(t *testing.T) {
+		testCases := []struct {
+			in    string
+			scale int
+			out   string
+		}{
+			{"1.005", 2, "1.00"},
+			{"1.015", 2, "1.02"},
+			{"1.025", 2, "1.02"},
+			{"-1.035", 2, "-1.04"},
+			{"2.5", 0, "2"},
+			{"3.5", 0, "4"},
+			{"1.5", 2, "1.5"},
+			{"1250", -2, "1.2E+3"},
+			{"0.0004", 3, "0.000"},
+			{"-0.0004", 3, "-0.000"},
+			{"NaN", 2, "NaN"},
+			{"Infinity", 2, "Infinity"},
+			{"1.5", 1000000000, "1.5"},
+			{"1.5", -1000000000, "0E+6111"},
+			{"-9.999999999999999999999999999999999E+6144", -1000000000, "-0E+6111"},
+			{"1E-6176", -1 << 62, "0E+6111"},
+			{"1.5", -40, "0E+40"},
+		}
+
+		for _, tc := range testCases {
+			d := mustParseDecimal(t, tc.in)
+			require.Equal(t, tc.out, d.Round(tc.scale).String(), "%s to %d", tc.in, tc.scale)
+		}
+	})
+
+	t.Run("Predicates", func(t *testing.T) {
+		require.True(t, mustParseDecimal(t, "NaN").IsNaN())
+		require.False(t, mustParseDecimal(t, "1").IsNaN())
+		require.True(t, mustParseDecimal(t, "Infinity").IsInf(1))
+		require.True(t, mustParseDecimal(t, "Infinity").IsInf(0))
+		require.False(t, mustParseDecimal(t, "Infinity").IsInf(-1))
+		require.True(t, mustParseDecimal(t, "-Infinity").IsInf(-1))
+		require.Equal(t, "-1.5", mustParseDecimal(t, "1.5").Neg().String())
+		require.Equal(t, "NaN", mustParseDecimal(t, "NaN").Neg().String())
+	})
+}
@@ -0,0 +1,880 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+//
+// Based on gopkg.in/mgo.v2/bson by Gustavo Niemeyer
+// See THIRD-PARTY-NOTICES for original license terms.
+
+package mgobson
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"time"
+
+	"github.com/mongodb/mongo-go-driver/bson"
+)
+
+var (
+	typeM          = reflect.TypeOf(M{})
+	typeD          = reflect.TypeOf(D{})
+	typeRaw        = reflect.TypeOf(Raw{})
+	typeRawD       = reflect.TypeOf(RawD{})
+	typeDocElem    = reflect.TypeOf(DocElem{})
+	typeRawDocElem = reflect.TypeOf(RawDocElem{})
+	typeRawSlice   = reflect.TypeOf([]Raw{})
+	typeSetter     = reflect.TypeOf((*Setter)(nil)).Elem()
+	typeInterface  = reflect.TypeOf((*interface{})(nil)).Elem()
+
+	typeInterfaceSlice = reflect.TypeOf([]interface{}{})
+	typeJavaScript     = reflect.TypeOf(JavaScript{})
+)
+
+// DecodeMode selects the Go types that BSON values are decoded into when
+// the target is an interface{} value, including the values of M and D.
+type DecodeMode int
+
+const (
+	// DriverDecodeMode decodes values into the types used by the
+	// mongo-go-driver. Int32 and int64 values are decoded as int32 and
+	// int64, and binary values of the obsolete 0x02 subtype keep their
+	// subtype as a Binary value.
+	DriverDecodeMode DecodeMode = iota
+
+	// MgoDecodeMode decodes values into the types used by mgo, so that
+	// code written against gopkg.in/mgo.v2/bson keeps working. Int32
+	// values are decoded as int, int64 values as int64, and binary values
+	// of both the generic 0x00 and the obsolete 0x02 subtypes as []byte.
+	MgoDecodeMode
+)
+
+var defaultDecodeMode = DriverDecodeMode
+
+// SetDefaultDecodeMode changes the DecodeMode used by Unmarshal,
+// Raw.Unmarshal, M.UnmarshalBSON and D.UnmarshalBSON. It should be called
+// during initialization, before any data is decoded.
+func SetDefaultDecodeMode(mode DecodeMode) {
+	defaultDecodeMode = mode
+}
+
+// DecodeLimits bounds the resources used to decode a single value. A zero
+// field means that there is no limit. Data that exceeds a limit is rejected
+// with an *UnmarshalError before any of it is decoded.
+type DecodeLimits struct {
+	// MaxDepth is the maximum nesting depth of documents, counting the
+	// top-level document, its embedded documents and arrays, and
+	// JavaScript scopes. Without a limit on the depth, deeply nested
+	// data from an untrusted source may exhaust the stack.
+	MaxDepth int
+
+	// MaxSize is the maximum size in bytes of the data being decoded.
+	MaxSize int
+
+	// MaxElements is the maximum number of elements in the data being
+	// decoded, counting those of embedded documents and arrays.
+	MaxElements int
+}
+
+// defaultDecodeLimits allows the nesting depth that MongoDB allows by
+// default.
+var defaultDecodeLimits = DecodeLimits{MaxDepth: 200}
+
+// SetDecodeLimits changes the DecodeLimits used by Unmarshal, Raw.Unmarshal
+// and the UnmarshalBSON methods of M, D and RawD, in all modes. By default
+// only the nesting depth is limited, to 200 levels. It should be called
+// during initialization, before any data is decoded.
+func SetDecodeLimits(limits DecodeLimits) {
+	defaultDecodeLimits = limits
+}
+
+// decoder holds the state shared while decoding a single value.
+type decoder struct {
+	mode   DecodeMode
+	limits DecodeLimits
+
+	// alias leaves the data of binary values aliasing the input rather
+	// than copying it, as UnmarshalBSONInto does.
+	alias bool
+}
+
+func newDecoder(mode DecodeMode) *decoder {
+	return &decoder{mode: mode, limits: defaultDecodeLimits}
+}
+
+// check verifies that raw is well formed and within the decoder's limits,
+// so that it can be decoded without going out of bounds. It returns raw
+// without any bytes that follow its value. Errors are returned as an
+// *UnmarshalError whose path is relative to raw.
+func (d *decoder) check(raw Raw) (Raw, error) {
+	if d.limits.MaxSize > 0 && len(raw.Data) > d.limits.MaxSize {
+		return Raw{}, &UnmarshalError{Kind: raw.Kind, Err: fmt.Errorf("%d bytes of data exceed the maximum size of %d", len(raw.Data), d.limits.MaxSize)}
+	}
+
+	s := scanner{maxDepth: d.limits.MaxDepth, maxElements: d.limits.MaxElements}
+	n, err := s.value(raw.Kind, raw.Data)
+	if err != nil {
+		return Raw{}, &UnmarshalError{Path: err.path, Kind: err.kind, Err: err.err}
+	}
+
+	return Raw{Kind: raw.Kind, Data: raw.Data[:n]}, nil
+}
+
+// Unmarshal deserializes data from in into the out value. The out value
+// must be a map, a pointer to a struct, or a pointer to a bson.D value.
+// In the case of struct values, only exported fields will be deserialized.
+// The lowercased field name is used as the key for each exported field,
+// but this behavior may be changed using the respective field tag.
+//
+// The target field or element types of out may not necessarily match
+// the BSON values of the provided data. The following conversions are
+// made automatically:
+//
+//   - Numeric types are converted if at least the integer part of the
+//     value would be preserved correctly
+//   - Bools are converted to numeric types as 1 or 0
+//   - Numeric types are converted to bools as true if not 0 or false otherwise
+//   - Binary and string BSON data is converted to a string, array or byte slice
+//
+// If the value would not fit the type and cannot be converted, it's
+// silently skipped.
+//
+// Pointer values are initialized when necessary.
+//
+// Values stored into interface{} targets have the types selected by the
+// package default DecodeMode. See UnmarshalWithMode.
+//
+// Errors are returned as an *UnmarshalError, which holds the path of the
+// element that couldn't be unmarshaled.
+func Unmarshal(in []byte, out interface{}) error {
+	return UnmarshalWithMode(in, out, defaultDecodeMode)
+}
+
+// UnmarshalWithMode is like Unmarshal, but maps BSON values to Go types as
+// selected by mode instead of the package default.
+func UnmarshalWithMode(in []byte, out interface{}, mode DecodeMode) error {
+	return rootUnmarshalError(unmarshal(in, out, mode), 0x03, reflect.TypeOf(out))
+}
+
+func unmarshal(in []byte, out interface{}, mode DecodeMode) error {
+	if raw, ok := out.(*Raw); ok {
+		raw.Kind = 0x03
+		raw.Data = in
+		return nil
+	}
+
+	dec := newDecoder(mode)
+	v := reflect.ValueOf(out)
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return errors.New("Unmarshal needs a non-nil pointer")
+		}
+
+		raw, err := dec.check(Raw{Kind: 0x03, Data: in})
+		if err != nil {
+			return err
+		}
+
+		_, err = dec.setValue(raw, v.Elem())
+		return err
+	case reflect.Map:
+		raw, err := dec.check(Raw{Kind: 0x03, Data: in})
+		if err != nil {
+			return err
+		}
+
+		_, err = dec.setValue(raw, v)
+		return err
+	case reflect.Struct:
+		return errors.New("Unmarshal can't deal with struct values. Use a pointer.")
+	default:
+		return errors.New("Unmarshal needs a map or a pointer to a struct.")
+	}
+}
+
+// Unmarshal deserializes raw into the out value. The out value may be a
+// map or a pointer to any value that raw is compatible with, so that a
+// single element of a RawD may be decoded into a struct, an M or D, a
+// slice or a scalar. If the out value type is not compatible with raw,
+// a *TypeError is returned. Other errors are returned as an *UnmarshalError.
+func (raw Raw) Unmarshal(out interface{}) error {
+	return raw.UnmarshalWithMode(out, defaultDecodeMode)
+}
+
+// UnmarshalWithMode is like Unmarshal, but maps BSON values to Go types as
+// selected by mode instead of the package default.
+func (raw Raw) UnmarshalWithMode(out interface{}, mode DecodeMode) error {
+	v := reflect.ValueOf(out)
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return rootUnmarshalError(errors.New("Raw Unmarshal needs a map or a valid pointer."), raw.Kind, v.Type())
+		}
+		v = v.Elem()
+	case reflect.Map:
+	case reflect.Struct:
+		return rootUnmarshalError(errors.New("Raw Unmarshal can't deal with struct values. Use a pointer."), raw.Kind, v.Type())
+	default:
+		return rootUnmarshalError(errors.New("Raw Unmarshal needs a map or a valid pointer."), raw.Kind, reflect.TypeOf(out))
+	}
+
+	dec := newDecoder(mode)
+	checked, err := dec.check(raw)
+	if err != nil {
+		return rootUnmarshalError(err, raw.Kind, v.Type())
+	}
+
+	good, err := dec.setValue(checked, v)
+	if err != nil {
+		return rootUnmarshalError(err, raw.Kind, v.Type())
+	}
+	if !good {
+		return &TypeError{Type: v.Type(), Kind: raw.Kind}
+	}
+	return nil
+}
+
+// Document returns the elements of raw, which must hold an embedded
+// document, without decoding their values. It allows walking large
+// documents and decoding only the elements of interest through
+// Raw.Unmarshal. The Data of the elements are subslices of raw.Data.
+func (raw Raw) Document() (RawD, error) {
+	if raw.Kind != 0x03 {
+		return nil, &TypeError{Type: typeRawD, Kind: raw.Kind}
+	}
+
+	raw, err := newDecoder(defaultDecodeMode).check(raw)
+	if err != nil {
+		return nil, rootUnmarshalError(err, 0x03, typeRawD)
+	}
+
+	return splitDocument(raw.Data)
+}
+
+// Array returns the values of raw, which must hold an array, without
+// decoding them. Their Data are subslices of raw.Data.
+func (raw Raw) Array() ([]Raw, error) {
+	if raw.Kind != 0x04 {
+		return nil, &TypeError{Type: typeRawSlice, Kind: raw.Kind}
+	}
+
+	raw, err := newDecoder(defaultDecodeMode).check(raw)
+	if err != nil {
+		return nil, rootUnmarshalError(err, 0x04, typeRawSlice)
+	}
+
+	elems, err := splitDocument(raw.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]Raw, len(elems))
+	for i, elem := range elems {
+		values[i] = elem.Value
+	}
+	return values, nil
+}
+
+// driverValue wraps raw into a single element document, so that the value
+// can be read through the driver's accessors.
+func (raw Raw) driverValue() (*bson.Value, error) {
+	b := make([]byte, 4, 4+2+len(raw.Data)+1)
+	b = append(b, raw.Kind, 0)
+	b = append(b, raw.Data...)
+	b = append(b, 0)
+	binary.LittleEndian.PutUint32(b, uint32(len(b)))
+
+	elem, err := bson.Reader(b).ElementAt(0)
+	if err != nil {
+		return nil, err
+	}
+
+	return elem.Value(), nil
+}
+
+// interfaceFromRaw converts raw into the value that would be stored in an
+// interface{}. Embedded documents are decoded as docType, which must be
+// either M or D. Since raw may come from anywhere, such as a RawD built by
+// hand, it's checked first.
+func (d *decoder) interfaceFromRaw(raw Raw, docType reflect.Type) (interface{}, error) {
+	var s scanner
+	if err := s.exact(raw.Kind, raw.Data); err != nil {
+		return nil, &UnmarshalError{Path: err.path, Kind: err.kind, Err: err.err}
+	}
+
+	return d.interfaceFromData(nil, raw.Kind, raw.Data, docType)
+}
+
+// interfaceFromData converts the value of the given kind in data, which must
+// have been checked, into the value that would be stored in an interface{}.
+// Embedded documents are decoded as docType, which must be either M or D, at
+// every depth, including inside arrays and JavaScript scopes. Arrays are
+// decoded as []interface{}, and other values as selected by the decoder's
+// mode.
+//
+// prev is the value being replaced, if any. Documents and arrays are decoded
+// into its storage where possible, and prev itself is returned when the new
+// value is equal to it, which saves allocating a new interface value.
+func (d *decoder) interfaceFromData(prev interface{}, kind byte, data []byte, docType reflect.Type) (interface{}, error) {
+	switch kind {
+	case 0x03:
+		return d.decodeDocumentInto(prev, data, docType)
+	case 0x04:
+		return d.decodeArrayInto(prev, data, docType)
+	case 0x0F:
+		js, _ := prev.(JavaScript)
+		n := 4 + int(binary.LittleEndian.Uint32(data[4:]))
+		scope, err := d.decodeDocumentInto(js.Scope, data[4+n:], d.scopeType(docType))
+		if err != nil {
+			return nil, err
+		}
+		return JavaScript{Code: reuseString(js.Code, data[8:4+n-1]), Scope: scope}, nil
+	}
+
+	return d.scalarFromData(prev, kind, data)
+}
+
+// scalarFromData converts the value of the given kind in data, which must
+// have been checked and must not be a document, an array or a JavaScript
+// value with scope, as interfaceFromData does.
+func (d *decoder) scalarFromData(prev interface{}, kind byte, data []byte) (interface{}, error) {
+	switch kind {
+	case 0x01:
+		f := math.Float64frombits(binary.LittleEndian.Uint64(data))
+		if prev == f {
+			return prev, nil
+		}
+		return f, nil
+	case 0x02:
+		s, _ := prev.(string)
+		if s = reuseString(s, data[4:len(data)-1]); prev == s {
+			return prev, nil
+		}
+		return s, nil
+	case 0x05:
+		subtype, bin := data[4], data[5:len(data):len(data)]
+		if subtype == 0x02 && len(bin) >= 4 {
+			// The obsolete binary subtype repeats the length of the data.
+			bin = bin[4:]
+		}
+		if !d.alias {
+			bin = append([]byte{}, bin...)
+		}
+		if subtype == 0x00 || (subtype == 0x02 && d.mode == MgoDecodeMode) {
+			return bin, nil
+		}
+		return Binary{Kind: subtype, Data: bin}, nil
+	case 0x06:
+		return Undefined, nil
+	case 0x07:
+		id, _ := prev.(ObjectId)
+		if id = ObjectId(reuseString(string(id), data)); prev == id {
+			return prev, nil
+		}
+		return id, nil
+	case 0x08:
+		return data[0] == 1, nil
+	case 0x09:
+		ms := int64(binary.LittleEndian.Uint64(data))
+		if ms == zeroTimeMillis {
+			return time.Time{}, nil
+		}
+		t := time.Unix(ms/1000, ms%1000*1000000)
+		if prev == t {
+			return prev, nil
+		}
+		return t, nil
+	case 0x0A:
+		return nil, nil
+	case 0x0B:
+		i := bytes.IndexByte(data, 0)
+		re, _ := prev.(RegEx)
+		re = RegEx{Pattern: reuseString(re.Pattern, data[:i]), Options: reuseString(re.Options, data[i+1:len(data)-1])}
+		if prev == re {
+			return prev, nil
+		}
+		return re, nil
+	case 0x0C:
+		ptr, _ := prev.(DBPointer)
+		ns := data[4 : len(data)-13]
+		ptr = DBPointer{Namespace: reuseString(ptr.Namespace, ns), Id: ObjectId(reuseString(string(ptr.Id), data[len(data)-12:]))}
+		if prev == ptr {
+			return prev, nil
+		}
+		return ptr, nil
+	case 0x0D:
+		js, _ := prev.(JavaScript)
+		js = JavaScript{Code: reuseString(js.Code, data[4:len(data)-1])}
+		if prev == js {
+			return prev, nil
+		}
+		return js, nil
+	case 0x0E:
+		sym, _ := prev.(Symbol)
+		if sym = Symbol(reuseString(string(sym), data[4:len(data)-1])); prev == sym {
+			return prev, nil
+		}
+		return sym, nil
+	case 0x10:
+		i := int32(binary.LittleEndian.Uint32(data))
+		if d.mode == MgoDecodeMode {
+			if prev == int(i) {
+				return prev, nil
+			}
+			return int(i), nil
+		}
+		if prev == i {
+			return prev, nil
+		}
+		return i, nil
+	case 0x11:
+		ts := MongoTimestamp(binary.LittleEndian.Uint64(data))
+		if prev == ts {
+			return prev, nil
+		}
+		return ts, nil
+	case 0x12:
+		i := int64(binary.LittleEndian.Uint64(data))
+		if prev == i {
+			return prev, nil
+		}
+		return i, nil
+	case 0x13:
+		x := Decimal128{h: binary.LittleEndian.Uint64(data[8:]), l: binary.LittleEndian.Uint64(data)}
+		if prev == x {
+			return prev, nil
+		}
+		return x, nil
+	case 0xFF:
+		return MinKey, nil
+	case 0x7F:
+		return MaxKey, nil
+	}
+
+	return nil, fmt.Errorf("invalid BSON kind 0x%02x", kind)
+}
+
+// scopeType returns the type the scope of a JavaScript value is decoded as,
+// given the type of the documents around it. mgo always decodes scopes as M.
+func (d *decoder) scopeType(docType reflect.Type) reflect.Type {
+	if d.mode == MgoDecodeMode {
+		return typeM
+	}
+	return docType
+}
+
+// getSetter returns the Setter implemented by out or by a pointer to it,
+// allocating nil pointers as necessary. It returns nil if there is none.
+func getSetter(out reflect.Value) Setter {
+	outt := out.Type()
+
+	if outt.Kind() == reflect.Ptr && outt.Implements(typeSetter) {
+		if out.IsNil() {
+			out.Set(reflect.New(outt.Elem()))
+		}
+		return out.Interface().(Setter)
+	}
+
+	if reflect.PtrTo(outt).Implements(typeSetter) && out.CanAddr() {
+		return out.Addr().Interface().(Setter)
+	}
+
+	return nil
+}
+
+// setValue stores raw into out, which must be settable. It reports whether
+// the value was stored; values that cannot be converted into the type of
+// out are silently skipped, as are values whose Setter returns a
+// *TypeError.
+func (d *decoder) setValue(raw Raw, out reflect.Value) (bool, error) {
+	outt := out.Type()
+
+	if setter := getSetter(out); setter != nil {
+		err := setter.SetBSON(raw)
+		if err == ErrSetZero {
+			out.Set(reflect.Zero(outt))
+			return true, nil
+		}
+		if err == nil {
+			return true, nil
+		}
+		if _, ok := err.(*TypeError); ok {
+			return false, nil
+		}
+		return false, err
+	}
+
+	if outt == typeRaw {
+		out.Set(reflect.ValueOf(raw))
+		return true, nil
+	}
+
+	if raw.Kind == 0x0A || raw.Kind == 0x06 {
+		switch outt.Kind() {
+		case reflect.Interface, reflect.Ptr, reflect.Struct, reflect.Slice, reflect.Map:
+			out.Set(reflect.Zero(outt))
+			return true, nil
+		}
+		return false, nil
+	}
+
+	switch outt.Kind() {
+	case reflect.Ptr:
+		elem := out
+		if out.IsNil() {
+			elem = reflect.New(outt.Elem())
+		}
+
+		good, err := d.setValue(raw, elem.Elem())
+		if good {
+			out.Set(elem)
+		}
+		return good, err
+	case reflect.Interface:
+		if outt.NumMethod() > 0 {
+			break
+		}
+
+		in, err := d.interfaceFromRaw(raw, typeM)
+		if err != nil {
+			return false, err
+		}
+
+		if in == nil {
+			out.Set(reflect.Zero(outt))
+		} else {
+			out.Set(reflect.ValueOf(in))
+		}
+		return true, nil
+	}
+
+	switch raw.Kind {
+	case 0x03:
+		switch outt {
+		case typeM:
+			if !out.CanSet() || !out.IsNil() {
+				// An existing M, such as one passed to Unmarshal by
+				// value, is filled in place as mgo does.
+				return true, d.setMap(raw, out)
+			}
+
+			doc, err := d.decodeDocumentInto(nil, raw.Data, typeM)
+			if err != nil {
+				return false, err
+			}
+
+			out.Set(reflect.ValueOf(doc))
+			return true, nil
+		case typeD:
+			doc, err := d.decodeDocumentInto(nil, raw.Data, typeD)
+			if err != nil {
+				return false, err
+			}
+
+			out.Set(reflect.ValueOf(doc))
+			return true, nil
+		case typeRawD:
+			doc, err := splitDocument(raw.Data)
+			if err != nil {
+				return false, err
+			}
+
+			out.Set(reflect.ValueOf(doc))
+			return true, nil
+		}
+
+		switch outt.Kind() {
+		case reflect.Struct:
+			return true, d.setStruct(raw, out)
+		case reflect.Map:
+			if outt.Key().Kind() == reflect.String {
+				return true, d.setMap(raw, out)
+			}
+		}
+	case 0x04:
+		switch outt.Kind() {
+		case reflect.Slice:
+			return true, d.setSlice(raw, out)
+		case reflect.Array:
+			return true, d.setArray(raw, out)
+		}
+	case 0x05:
+		if outt.Kind() == reflect.Slice && outt.Elem().Kind() == reflect.Uint8 {
+			in, err := d.interfaceFromRaw(raw, typeM)
+			if err != nil {
+				return false, err
+			}
+
+			data, ok := in.([]byte)
+			if !ok {
+				data = in.(Binary).Data
+			}
+			out.SetBytes(data)
+			return true, nil
+		}
+	}
+
+	in, err := d.interfaceFromRaw(raw, typeM)
+	if err != nil {
+		return false, err
+	}
+
+	return setScalar(in, out), nil
+}
+
+func (d *decoder) setStruct(raw Raw, out reflect.Value) error {
+	elems, err := splitDocument(raw.Data)
+	if err != nil {
+		return err
+	}
+
+	sinfo, err := getStructInfo(out.Type())
+	if err != nil {
+		return err
+	}
+
+	out.Set(reflect.Zero(out.Type()))
+
+	var inlineMap reflect.Value
+	if sinfo.InlineMap != -1 {
+		inlineMap = out.Field(sinfo.InlineMap)
+	}
+
+	for _, elem := range elems {
+		if info, ok := sinfo.FieldsMap[elem.Name]; ok {
+			var field reflect.Value
+			if info.Inline == nil {
+				field = out.Field(info.Num)
+			} else {
+				field = out.FieldByIndex(info.Inline)
+			}
+
+			_, err := d.setValue(elem.Value, field)
+			if err != nil {
+				return elementUnmarshalError(err, elem.Name, elem.Value.Kind, field.Type())
+			}
+		} else if inlineMap.IsValid() {
+			if inlineMap.IsNil() {
+				inlineMap.Set(reflect.MakeMap(inlineMap.Type()))
+			}
+
+			e := reflect.New(inlineMap.Type().Elem()).Elem()
+			good, err := d.setValue(elem.Value, e)
+			if err != nil {
+				return elementUnmarshalError(err, elem.Name, elem.Value.Kind, e.Type())
+			}
+			if good {
+				inlineMap.SetMapIndex(reflect.ValueOf(elem.Name).Convert(inlineMap.Type().Key()), e)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (d *decoder) setMap(raw Raw, out reflect.Value) error {
+	elems, err := splitDocument(raw.Data)
+	if err != nil {
+		return err
+	}
+
+	outt := out.Type()
+	if out.IsNil() {
+		if !out.CanSet() {
+			return fmt.Errorf("Can't unmarshal into a nil %s", outt)
+		}
+		out.Set(reflect.MakeMap(outt))
+	} else if out.Len() > 0 {
+		for _, k := range out.MapKeys() {
+			out.SetMapIndex(k, reflect.Value{})
+		}
+	}
+
+	for _, elem := range elems {
+		e := reflect.New(outt.Elem()).Elem()
+		good, err := d.setValue(elem.Value, e)
+		if err != nil {
+			return elementUnmarshalError(err, elem.Name, elem.Value.Kind, e.Type())
+		}
+		if good {
+			out.SetMapIndex(reflect.ValueOf(elem.Name).Convert(outt.Key()), e)
+		}
+	}
+
+	return nil
+}
+
+func (d *decoder) setSlice(raw Raw, out reflect.Value) error {
+	elems, err := splitDocument(raw.Data)
+	if err != nil {
+		return err
+	}
+
+	outt := out.Type()
+	slice := reflect.MakeSlice(outt, 0, len(elems))
+
+	for _, elem := range elems {
+		e := reflect.New(outt.Elem()).Elem()
+		good, err := d.setValue(elem.Value, e)
+		if err != nil {
+			return elementUnmarshalError(err, elem.Name, elem.Value.Kind, e.Type())
+		}
+		if good {
+			slice = reflect.Append(slice, e)
+		}
+	}
+
+	out.Set(slice)
+	return nil
+}
+
+func (d *decoder) setArray(raw Raw, out reflect.Value) error {
+	elems, err := splitDocument(raw.Data)
+	if err != nil {
+		return err
+	}
+
+	if len(elems) != out.Len() {
+		return errors.New("length mismatch on array field")
+	}
+
+	for i, elem := range elems {
+		_, err := d.setValue(elem.Value, out.Index(i))
+		if err != nil {
+			return elementUnmarshalError(err, elem.Name, elem.Value.Kind, out.Index(i).Type())
+		}
+	}
+
+	return nil
+}
+
+// setScalar stores the decoded value in into out, converting between
+// compatible kinds. It reports whether the value could be stored.
+func setScalar(in interface{}, out reflect.Value) bool {
+	if in == nil {
+		return false
+	}
+
+	inv := reflect.ValueOf(in)
+	outt := out.Type()
+
+	if inv.Type() == outt {
+		out.Set(inv)
+		return true
+	}
+
+	switch outt.Kind() {
+	case reflect.String:
+		switch inv.Kind() {
+		case reflect.String:
+			out.SetString(inv.String())
+			return true
+		case reflect.Slice:
+			if b, ok := in.([]byte); ok {
+				out.SetString(string(b))
+				return true
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		if outt.Elem().Kind() == reflect.Uint8 && inv.Kind() == reflect.String {
+			b := []byte(inv.String())
+			if outt.Kind() == reflect.Slice {
+				out.Set(reflect.ValueOf(b).Convert(outt))
+				return true
+			}
+			if len(b) == out.Len() {
+				reflect.Copy(out, reflect.ValueOf(b))
+				return true
+			}
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		switch inv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			i = inv.Int()
+		case reflect.Float32, reflect.Float64:
+			i = int64(inv.Float())
+		case reflect.Bool:
+			if inv.Bool() {
+				i = 1
+			}
+		default:
+			return false
+		}
+		if out.OverflowInt(i) {
+			return false
+		}
+		out.SetInt(i)
+		return true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		var u uint64
+		switch inv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if inv.Int() < 0 {
+				return false
+			}
+			u = uint64(inv.Int())
+		case reflect.Float32, reflect.Float64:
+			if inv.Float() < 0 {
+				return false
+			}
+			u = uint64(inv.Float())
+		case reflect.Bool:
+			if inv.Bool() {
+				u = 1
+			}
+		default:
+			return false
+		}
+		if out.OverflowUint(u) {
+			return false
+		}
+		out.SetUint(u)
+		return true
+	case reflect.Float32, reflect.Float64:
+		switch inv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			out.SetFloat(float64(inv.Int()))
+		case reflect.Float32, reflect.Float64:
+			out.SetFloat(inv.Float())
+		case reflect.Bool:
+			if inv.Bool() {
+				out.SetFloat(1)
+			} else {
+				out.SetFloat(0)
+			}
+		default:
+			return false
+		}
+		return true
+	case reflect.Bool:
+		switch inv.Kind() {
+		case reflect.Bool:
+			out.SetBool(inv.Bool())
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			out.SetBool(inv.Int() != 0)
+		case reflect.Float32, reflect.Float64:
+			out.SetBool(inv.Float() != 0)
+		default:
+			return false
+		}
+		return true
+	}
+
+	if inv.Type().AssignableTo(outt) {
+		out.Set(inv)
+		return true
+	}
+	if inv.Kind() == outt.Kind() && inv.Type().ConvertibleTo(outt) {
+		out.Set(inv.Convert(outt))
+		return true
+	}
+
+	return false
+}
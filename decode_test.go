@@ -0,0 +1,467 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+//
+// Based on gopkg.in/mgo.v2/bson by Gustavo Niemeyer
+// See THIRD-PARTY-NOTICES for original license terms.
+
+package mgobson_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/mongodb-labs/mgobson"
+	"github.com/stretchr/testify/require"
+)
+
+type getterType struct {
+	value interface{}
+	err   error
+}
+
+func (g *getterType) GetBSON() (interface{}, error) {
+	return g.value, g.err
+}
+
+type setterType struct {
+	received *mgobson.Raw
+}
+
+func (s *setterType) SetBSON(raw mgobson.Raw) error {
+	s.received = &raw
+	switch raw.Kind {
+	case 0x08:
+		return mgobson.ErrSetZero
+	case 0x02:
+		return &mgobson.TypeError{Type: reflect.TypeOf(s), Kind: raw.Kind}
+	case 0x0A:
+		return errors.New("null is not allowed")
+	}
+	return nil
+}
+
+type setterValueType struct {
+	kind byte
+}
+
+func (s *setterValueType) SetBSON(raw mgobson.Raw) error {
+	s.kind = raw.Kind
+	return nil
+}
+
+func TestGetter(t *testing.T) {
+	g := &getterType{value: mgobson.D{{"x", int32(1)}}}
+
+	expected, err := mgobson.D{
+		{"a", mgobson.D{{"x", int32(1)}}},
+		{"b", mgobson.D{{"c", mgobson.D{{"x", int32(1)}}}}},
+		{"d", mgobson.JavaScript{Code: "x", Scope: mgobson.D{{"x", int32(1)}}}},
+		{"e", nil},
+	}.MarshalBSON()
+	require.NoError(t, err)
+
+	actual, err := mgobson.D{
+		{"a", g},
+		{"b", mgobson.M{"c": g}},
+		{"d", mgobson.JavaScript{Code: "x", Scope: g}},
+		{"e", (*getterType)(nil)},
+	}.MarshalBSON()
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+
+	chained := &getterType{value: &getterType{value: int32(5)}}
+	actual, err = mgobson.M{"a": chained}.MarshalBSON()
+	require.NoError(t, err)
+	expected, err = mgobson.M{"a": int32(5)}.MarshalBSON()
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+
+	getErr := errors.New("failed")
+	_, err = mgobson.D{{"a", mgobson.D{{"b", &getterType{err: getErr}}}}}.MarshalBSON()
+	require.Equal(t, &mgobson.MarshalError{Path: "a.b", Type: reflect.TypeOf(&getterType{}), Err: getErr}, err)
+}
+
+func TestSetter(t *testing.T) {
+	b, err := mgobson.D{
+		{"a", int32(1)},
+		{"b", true},
+		{"c", mgobson.D{{"x", int32(1)}}},
+	}.MarshalBSON()
+	require.NoError(t, err)
+
+	t.Run("struct", func(t *testing.T) {
+		var out struct {
+			A *setterType
+			B *setterType
+			C setterValueType
+		}
+		out.B = &setterType{}
+
+		require.NoError(t, mgobson.Unmarshal(b, &out))
+		require.Equal(t, byte(0x10), out.A.received.Kind)
+		require.Equal(t, []byte{1, 0, 0, 0}, out.A.received.Data)
+		require.Nil(t, out.B)
+		require.Equal(t, byte(0x03), out.C.kind)
+	})
+
+	t.Run("map", func(t *testing.T) {
+		b, err := mgobson.D{
+			{"a", int32(1)},
+			{"b", "skipped"},
+		}.MarshalBSON()
+		require.NoError(t, err)
+
+		out := make(map[string]*setterType)
+		require.NoError(t, mgobson.Unmarshal(b, out))
+		require.Len(t, out, 1)
+		require.Equal(t, byte(0x10), out["a"].received.Kind)
+	})
+
+	t.Run("slice", func(t *testing.T) {
+		b, err := mgobson.D{
+			{"a", []interface{}{int32(1), "skipped", int32(2)}},
+		}.MarshalBSON()
+		require.NoError(t, err)
+
+		var out struct {
+			A []setterType
+		}
+		require.NoError(t, mgobson.Unmarshal(b, &out))
+		require.Len(t, out.A, 2)
+	})
+
+	t.Run("error", func(t *testing.T) {
+		b, err := mgobson.D{{"a", nil}}.MarshalBSON()
+		require.NoError(t, err)
+
+		var out struct {
+			A *setterType
+		}
+		err = mgobson.Unmarshal(b, &out)
+		require.IsType(t, &mgobson.UnmarshalError{}, err)
+		require.Equal(t, "a", err.(*mgobson.UnmarshalError).Path)
+		require.EqualError(t, err.(*mgobson.UnmarshalError).Err, "null is not allowed")
+	})
+
+	t.Run("document", func(t *testing.T) {
+		var out setterValueType
+		require.NoError(t, mgobson.Unmarshal(b, &out))
+		require.Equal(t, byte(0x03), out.kind)
+	})
+
+	t.Run("M and D", func(t *testing.T) {
+		var m mgobson.M
+		require.NoError(t, mgobson.Unmarshal(b, &m))
+		require.Equal(t, mgobson.M{
+			"a": int32(1),
+			"b": true,
+			"c": mgobson.M{"x": int32(1)},
+		}, m)
+
+		var d mgobson.D
+		require.NoError(t, mgobson.Unmarshal(b, &d))
+		require.Equal(t, mgobson.D{
+			{"a", int32(1)},
+			{"b", true},
+			{"c", mgobson.D{{"x", int32(1)}}},
+		}, d)
+	})
+}
+
+func TestRawUnmarshal(t *testing.T) {
+	b, err := mgobson.D{
+		{"name", "n"},
+		{"base", mgobson.D{{"x", int32(1)}, {"why", int32(2)}}},
+		{"list", []interface{}{int32(1), "two", map[string]int32{"three": 3}}},
+		{"count", int64(7)},
+	}.MarshalBSON()
+	require.NoError(t, err)
+
+	var doc mgobson.Raw
+	require.NoError(t, mgobson.Unmarshal(b, &doc))
+
+	elems, err := doc.Document()
+	require.NoError(t, err)
+	require.Len(t, elems, 4)
+
+	var name string
+	require.NoError(t, elems[0].Value.Unmarshal(&name))
+	require.Equal(t, "n", name)
+
+	var base inlineBase
+	require.NoError(t, elems[1].Value.Unmarshal(&base))
+	require.Equal(t, inlineBase{X: 1, Y: 2}, base)
+
+	var m mgobson.M
+	require.NoError(t, elems[1].Value.Unmarshal(&m))
+	require.Equal(t, mgobson.M{"x": int32(1), "why": int32(2)}, m)
+
+	var d mgobson.D
+	require.NoError(t, elems[1].Value.Unmarshal(&d))
+	require.Equal(t, mgobson.D{{"x", int32(1)}, {"why", int32(2)}}, d)
+
+	mm := map[string]int{}
+	require.NoError(t, elems[1].Value.Unmarshal(mm))
+	require.Equal(t, map[string]int{"x": 1, "why": 2}, mm)
+
+	// An M passed by value is filled in place.
+	byValue := mgobson.M{"old": true}
+	require.NoError(t, elems[1].Value.Unmarshal(byValue))
+	require.Equal(t, mgobson.M{"x": int32(1), "why": int32(2)}, byValue)
+
+	byValue = mgobson.M{}
+	require.NoError(t, mgobson.Unmarshal(b, byValue))
+	require.Equal(t, mgobson.M{"x": int32(1), "why": int32(2)}, byValue["base"])
+	require.Equal(t, []interface{}{int32(1), "two", mgobson.M{"three": int32(3)}}, byValue["list"])
+
+	require.Error(t, mgobson.Unmarshal(b, mgobson.M(nil)))
+	require.Error(t, elems[1].Value.Unmarshal(mgobson.M(nil)))
+
+	var list []interface{}
+	require.NoError(t, elems[2].Value.Unmarshal(&list))
+	require.Len(t, list, 3)
+
+	values, err := elems[2].Value.Array()
+	require.NoError(t, err)
+	require.Len(t, values, 3)
+	require.Equal(t, byte(0x10), values[0].Kind)
+	var inner struct{ Three int }
+	require.NoError(t, values[2].Unmarshal(&inner))
+	require.Equal(t, 3, inner.Three)
+
+	var count int
+	require.NoError(t, elems[3].Value.Unmarshal(&count))
+	require.Equal(t, 7, count)
+
+	var wrong bool
+	err = elems[0].Value.Unmarshal(&wrong)
+	require.IsType(t, &mgobson.TypeError{}, err)
+
+	_, err = elems[0].Value.Document()
+	require.IsType(t, &mgobson.TypeError{}, err)
+	_, err = elems[1].Value.Array()
+	require.IsType(t, &mgobson.TypeError{}, err)
+
+	require.Error(t, elems[1].Value.Unmarshal(base))
+	require.Error(t, elems[1].Value.Unmarshal((*inlineBase)(nil)))
+}
+
+func TestRawDZeroCopy(t *testing.T) {
+	b, err := mgobson.D{{"a", "x"}, {"b", mgobson.D{{"c", int32(1)}}}, {"n", nil}}.MarshalBSON()
+	require.NoError(t, err)
+
+	var r mgobson.RawD
+	require.NoError(t, r.UnmarshalBSON(b))
+	require.Len(t, r, 3)
+
+	// The data of the elements is in b.
+	for _, elem := range r[:2] {
+		data := elem.Value.Data
+		require.True(t, bytes.Contains(b, data))
+		require.True(t, &data[0] == &b[bytes.Index(b, data)], elem.Name)
+	}
+
+	c := r.Copy()
+	require.Equal(t, r, c)
+	raw := r[0].Value.Copy()
+	require.Equal(t, r[0].Value, raw)
+
+	// Reusing b changes r, but not its copies.
+	expected, err := r.MarshalBSON()
+	require.NoError(t, err)
+	for i := range b {
+		b[i] = 0
+	}
+
+	actual, err := c.MarshalBSON()
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+	require.Equal(t, []byte{2, 0, 0, 0, 'x', 0}, raw.Data)
+	require.Equal(t, make([]byte, 6), r[0].Value.Data)
+
+	require.Nil(t, mgobson.RawD(nil).Copy())
+	require.Nil(t, mgobson.Raw{Kind: 0x0A}.Copy().Data)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		var r mgobson.RawD
+		_ = r.UnmarshalBSON(expected)
+		_ = r.Copy()
+	})
+	// The slice of elements, their names and the buffer of the copy.
+	require.True(t, allocs <= 8, "%v allocations", allocs)
+}
+
+func TestDecodeMode(t *testing.T) {
+	b, err := mgobson.D{
+		{"i32", int32(1)},
+		{"i64", int64(1 << 40)},
+		{"small64", int64(2)},
+		{"f", 1.5},
+		{"bin", mgobson.Binary{Kind: 0x02, Data: []byte{1, 2}}},
+		{"generic", []byte{3}},
+		{"udf", mgobson.Binary{Kind: 0x80, Data: []byte{4}}},
+		{"nested", mgobson.D{{"a", mgobson.A{int32(3)}}}},
+		{"scope", mgobson.JavaScript{Code: "f()", Scope: mgobson.D{{"a", int32(4)}}}},
+	}.MarshalBSON()
+	require.NoError(t, err)
+
+	driver := mgobson.M{
+		"i32":     int32(1),
+		"i64":     int64(1 << 40),
+		"small64": int64(2),
+		"f":       1.5,
+		"bin":     mgobson.Binary{Kind: 0x02, Data: []byte{1, 2}},
+		"generic": []byte{3},
+		"udf":     mgobson.Binary{Kind: 0x80, Data: []byte{4}},
+		"nested":  mgobson.M{"a": []interface{}{int32(3)}},
+		"scope":   mgobson.JavaScript{Code: "f()", Scope: mgobson.M{"a": int32(4)}},
+	}
+	mgo := mgobson.M{
+		"i32":     1,
+		"i64":     int64(1 << 40),
+		"small64": int64(2),
+		"f":       1.5,
+		"bin":     []byte{1, 2},
+		"generic": []byte{3},
+		"udf":     mgobson.Binary{Kind: 0x80, Data: []byte{4}},
+		"nested":  mgobson.M{"a": []interface{}{3}},
+		"scope":   mgobson.JavaScript{Code: "f()", Scope: mgobson.M{"a": 4}},
+	}
+
+	t.Run("per call", func(t *testing.T) {
+		var m mgobson.M
+		require.NoError(t, m.UnmarshalBSON(b))
+		require.Equal(t, driver, m)
+
+		require.NoError(t, m.UnmarshalBSONWithMode(b, mgobson.MgoDecodeMode))
+		require.Equal(t, mgo, m)
+
+		var d mgobson.D
+		require.NoError(t, d.UnmarshalBSONWithMode(b, mgobson.MgoDecodeMode))
+		require.Equal(t, 1, d[0].Value)
+		require.Equal(t, mgobson.D{{"a", []interface{}{3}}}, d[7].Value)
+		require.Equal(t, mgo["scope"], d[8].Value)
+
+		require.NoError(t, d.UnmarshalBSON(b))
+		require.Equal(t, mgobson.JavaScript{Code: "f()", Scope: mgobson.D{{"a", int32(4)}}}, d[8].Value)
+
+		var s struct {
+			I32    interface{}
+			Nested mgobson.M
+		}
+		require.NoError(t, mgobson.UnmarshalWithMode(b, &s, mgobson.MgoDecodeMode))
+		require.Equal(t, 1, s.I32)
+		require.Equal(t, mgo["nested"], s.Nested)
+
+		var raw mgobson.Raw
+		require.NoError(t, mgobson.Unmarshal(b, &raw))
+		elems, err := raw.Document()
+		require.NoError(t, err)
+
+		var i interface{}
+		require.NoError(t, elems[0].Value.UnmarshalWithMode(&i, mgobson.MgoDecodeMode))
+		require.Equal(t, 1, i)
+		require.NoError(t, elems[0].Value.Unmarshal(&i))
+		require.Equal(t, int32(1), i)
+	})
+
+	t.Run("package default", func(t *testing.T) {
+		mgobson.SetDefaultDecodeMode(mgobson.MgoDecodeMode)
+		defer mgobson.SetDefaultDecodeMode(mgobson.DriverDecodeMode)
+
+		var m mgobson.M
+		require.NoError(t, m.UnmarshalBSON(b))
+		require.Equal(t, mgo, m)
+
+		var i map[string]interface{}
+		require.NoError(t, mgobson.Unmarshal(b, &i))
+		require.Equal(t, 1, i["i32"])
+
+		require.NoError(t, m.UnmarshalBSONWithMode(b, mgobson.DriverDecodeMode))
+		require.Equal(t, driver, m)
+	})
+}
+
+func TestDecodeLimits(t *testing.T) {
+	nested := mgobson.D{{"c", int32(1)}}
+	for i := 0; i < 3; i++ {
+		nested = mgobson.D{{"c", nested}}
+	}
+	b, err := mgobson.D{{"a", int32(1)}, {"b", nested}}.MarshalBSON()
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name     string
+		limits   mgobson.DecodeLimits
+		expected *mgobson.UnmarshalError
+	}{
+		{"none", mgobson.DecodeLimits{}, nil},
+		{"depth", mgobson.DecodeLimits{MaxDepth: 5}, nil},
+		{"exceeded depth", mgobson.DecodeLimits{MaxDepth: 4}, &mgobson.UnmarshalError{
+			Path: "b.c.c.c",
+			Kind: 0x03,
+			Err:  errors.New("document is nested deeper than the maximum depth of 4"),
+		}},
+		{"size", mgobson.DecodeLimits{MaxSize: len(b)}, nil},
+		{"exceeded size", mgobson.DecodeLimits{MaxSize: len(b) - 1}, &mgobson.UnmarshalError{
+			Kind: 0x03,
+			Err:  fmt.Errorf("%d bytes of data exceed the maximum size of %d", len(b), len(b)-1),
+		}},
+		{"elements", mgobson.DecodeLimits{MaxElements: 6}, nil},
+		{"exceeded elements", mgobson.DecodeLimits{MaxElements: 5}, &mgobson.UnmarshalError{
+			Path: "b.c.c.c",
+			Kind: 0x03,
+			Err:  errors.New("document has more than the maximum of 5 elements"),
+		}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mgobson.SetDecodeLimits(tc.limits)
+			defer mgobson.SetDecodeLimits(mgobson.DecodeLimits{MaxDepth: 200})
+
+			var m mgobson.M
+			var d mgobson.D
+			var r mgobson.RawD
+			var i interface{}
+			errs := []error{
+				m.UnmarshalBSON(b),
+				d.UnmarshalBSONWithMode(b, mgobson.MgoDecodeMode),
+				r.UnmarshalBSON(b),
+				mgobson.Unmarshal(b, &i),
+				mgobson.Raw{Kind: 0x03, Data: b}.Unmarshal(&i),
+			}
+
+			for _, err := range errs {
+				if tc.expected == nil {
+					require.NoError(t, err)
+					continue
+				}
+
+				var uerr *mgobson.UnmarshalError
+				require.True(t, errors.As(err, &uerr), "%v", err)
+				require.Equal(t, tc.expected.Path, uerr.Path)
+				require.Equal(t, tc.expected.Kind, uerr.Kind)
+				require.EqualError(t, uerr.Err, tc.expected.Err.Error())
+			}
+		})
+	}
+
+	t.Run("default depth", func(t *testing.T) {
+		deep := mgobson.D{}
+		for i := 0; i < 200; i++ {
+			deep = mgobson.D{{"a", deep}}
+		}
+		b, err := deep.MarshalBSON()
+		require.NoError(t, err)
+
+		var d mgobson.D
+		require.Error(t, d.UnmarshalBSON(b))
+	})
+}
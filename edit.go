@@ -0,0 +1,285 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+//
+// Based on gopkg.in/mgo.v2/bson by Gustavo Niemeyer
+// See THIRD-PARTY-NOTICES for original license terms.
+
+package mgobson
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The editing methods of RawD change the element at path, whose keys are
+// taken as by Lookup: the first key names an element of r, and each
+// following key names an element of the embedded document, or the index of
+// an element of the array, that the previous keys led to. A path given as
+// a single key is taken as a dotted path and split by SplitPath, so
+// r.Delete("meta.tags.0") and r.Delete("meta", "tags", "0") are the same.
+// Keys given separately are taken literally, so that names containing dots
+// can be reached too.
+//
+// Only the documents along the path are re-encoded, with their lengths
+// recomputed. Every other element keeps its data as it was, and the data of
+// a changed element is a new slice, so the buffer that r was decoded from
+// is never written to. Elements of arrays are renumbered after each change,
+// so the names given to new array elements are ignored.
+//
+// ErrNotFound is returned if an element of the path doesn't exist. A path
+// that goes through a value that isn't a document or an array, or through
+// malformed data, is reported as an *UnmarshalError, and an invalid new name
+// or value as a *MarshalError. A path must have at least one key. On error
+// r is left unchanged.
+
+// SplitPath splits the dotted path into its keys, such as "meta.tags.0" into
+// "meta", "tags" and "0", to be passed to Lookup or to the editing methods of
+// RawD.
+func SplitPath(path string) []string {
+	return strings.Split(path, ".")
+}
+
+// Set sets the value of the element at path, appending a new element to
+// its document if there's none. In an array, only the index just past its
+// last element can be appended. A Kind of 0x00 is taken as an embedded
+// document, as when marshaling.
+func (r *RawD) Set(value Raw, path ...string) error {
+	path, err := editPath(path)
+	if err != nil {
+		return err
+	}
+	value, err = checkElement(path, path[len(path)-1], value)
+	if err != nil {
+		return err
+	}
+
+	key := path[len(path)-1]
+	return r.edit(path, func(d RawD, i int, array bool) (RawD, error) {
+		if i < 0 && array {
+			// Only the element just past the end of an array can be
+			// added, so that its index is the one given.
+			if n, err := strconv.Atoi(key); err != nil || n != len(d) || key != strconv.Itoa(n) {
+				return nil, &MarshalError{Path: strings.Join(path, "."), Type: typeRaw, Err: fmt.Errorf("can't set %q in an array of %d elements", key, len(d))}
+			}
+		}
+		if i < 0 {
+			return append(d, RawDocElem{Name: key, Value: value}), nil
+		}
+		d[i].Value = value
+		return d, nil
+	})
+}
+
+// Replace sets the value of the element at path, which must exist.
+func (r *RawD) Replace(value Raw, path ...string) error {
+	path, err := editPath(path)
+	if err != nil {
+		return err
+	}
+	value, err = checkElement(path, path[len(path)-1], value)
+	if err != nil {
+		return err
+	}
+
+	return r.edit(path, func(d RawD, i int, array bool) (RawD, error) {
+		if i < 0 {
+			return nil, ErrNotFound
+		}
+		d[i].Value = value
+		return d, nil
+	})
+}
+
+// Delete removes the element at path.
+func (r *RawD) Delete(path ...string) error {
+	path, err := editPath(path)
+	if err != nil {
+		return err
+	}
+	return r.edit(path, func(d RawD, i int, array bool) (RawD, error) {
+		if i < 0 {
+			return nil, ErrNotFound
+		}
+		return append(d[:i], d[i+1:]...), nil
+	})
+}
+
+// InsertBefore inserts an element with the given name and value just before
+// the element at path, in the same document. The document must not have an
+// element with that name already.
+func (r *RawD) InsertBefore(name string, value Raw, path ...string) error {
+	return r.insert(path, 0, name, value)
+}
+
+// InsertAfter inserts an element with the given name and value just after
+// the element at path, in the same document. The document must not have an
+// element with that name already.
+func (r *RawD) InsertAfter(name string, value Raw, path ...string) error {
+	return r.insert(path, 1, name, value)
+}
+
+func (r *RawD) insert(path []string, offset int, name string, value Raw) error {
+	path, err := editPath(path)
+	if err != nil {
+		return err
+	}
+	value, err = checkElement(path, name, value)
+	if err != nil {
+		return err
+	}
+
+	return r.edit(path, func(d RawD, i int, array bool) (RawD, error) {
+		if i < 0 {
+			return nil, ErrNotFound
+		}
+		if !array && d.index(name) >= 0 {
+			return nil, existsError(path, name)
+		}
+		d = append(d, RawDocElem{})
+		copy(d[i+offset+1:], d[i+offset:])
+		d[i+offset] = RawDocElem{Name: name, Value: value}
+		return d, nil
+	})
+}
+
+// Rename renames the element at path to name, keeping its value and its
+// position in its document. The document must not have an element with that
+// name already, and it must not be an array.
+func (r *RawD) Rename(name string, path ...string) error {
+	path, err := editPath(path)
+	if err != nil {
+		return err
+	}
+	if _, err = checkElement(path, name, Raw{Kind: 0x0A}); err != nil {
+		return err
+	}
+
+	return r.edit(path, func(d RawD, i int, array bool) (RawD, error) {
+		if i < 0 {
+			return nil, ErrNotFound
+		}
+		if array {
+			return nil, &MarshalError{Path: strings.Join(path, "."), Kind: d[i].Value.Kind, Err: fmt.Errorf("can't rename an array element")}
+		}
+		if d.index(name) >= 0 {
+			return nil, existsError(path, name)
+		}
+		d[i].Name = name
+		return d, nil
+	})
+}
+
+// edit applies change to the document that holds the element at keys.
+// change is given a copy of that document, which it may modify, the index
+// of the element or -1 if there's none, and whether the document is an
+// array.
+func (r *RawD) edit(keys []string, change func(d RawD, i int, array bool) (RawD, error)) error {
+	// The top-level elements are copied so that r is left unchanged on
+	// error.
+	d := make(RawD, len(*r), len(*r)+1)
+	copy(d, *r)
+
+	d, err := editDocument(d, false, keys, change)
+	if err != nil {
+		return err
+	}
+
+	*r = d
+	return nil
+}
+
+// editDocument applies change to the document that holds the element at
+// keys, which is d itself or a document embedded in it. Each document on
+// the way is re-encoded with its new content.
+func editDocument(d RawD, array bool, keys []string, change func(d RawD, i int, array bool) (RawD, error)) (RawD, error) {
+	i := d.index(keys[0])
+	if len(keys) == 1 {
+		d, err := change(d, i, array)
+		if err != nil {
+			return nil, err
+		}
+		if array {
+			for j := range d {
+				d[j].Name = strconv.Itoa(j)
+			}
+		}
+		return d, nil
+	}
+
+	if i < 0 {
+		return nil, ErrNotFound
+	}
+
+	elem := d[i].Value
+	if elem.Kind != 0x03 && elem.Kind != 0x04 {
+		return nil, &UnmarshalError{Path: keys[0], Kind: elem.Kind, Err: fmt.Errorf("can't edit %q in a value that isn't a document or an array", keys[1])}
+	}
+
+	inner, err := splitDocument(elem.Data)
+	if err == nil {
+		inner, err = editDocument(inner, elem.Kind == 0x04, keys[1:], change)
+	}
+	if _, ok := err.(*MarshalError); ok || err == ErrNotFound {
+		return nil, err
+	}
+	if err != nil {
+		return nil, elementUnmarshalError(err, keys[0], elem.Kind, typeRaw)
+	}
+
+	d[i].Value = Raw{Kind: elem.Kind, Data: inner.marshalBSON()}
+	return d, nil
+}
+
+// index returns the index of the first element of r with the given name, or
+// -1 if there's none.
+func (r RawD) index(name string) int {
+	for i, elem := range r {
+		if elem.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// checkElement checks that an element with the given name and value can be
+// added to the document that holds the element at keys, and returns value
+// with a Kind of 0x00 taken as an embedded document.
+func checkElement(keys []string, name string, value Raw) (Raw, error) {
+	path := joinPath(strings.Join(keys[:len(keys)-1], "."), name)
+	if strings.IndexByte(name, 0) >= 0 {
+		return Raw{}, &MarshalError{Path: path, Type: typeRaw, Err: fmt.Errorf("element name %q contains a NUL byte", name)}
+	}
+
+	if value.Kind == 0x00 {
+		value.Kind = 0x03
+	}
+
+	var s scanner
+	if err := s.exact(value.Kind, value.Data); err != nil {
+		return Raw{}, &MarshalError{Path: joinPath(path, err.path), Kind: err.kind, Err: err.err}
+	}
+	return value, nil
+}
+
+var errEmptyPath = errors.New("editing a RawD needs at least one key")
+
+// editPath returns the keys of path, splitting a single key as a dotted
+// path.
+func editPath(path []string) ([]string, error) {
+	switch len(path) {
+	case 0:
+		return nil, errEmptyPath
+	case 1:
+		return SplitPath(path[0]), nil
+	}
+	return path, nil
+}
+
+func existsError(keys []string, name string) error {
+	return &MarshalError{Path: joinPath(strings.Join(keys[:len(keys)-1], "."), name), Type: typeRaw, Err: fmt.Errorf("element %q already exists", name)}
+}
@@ -0,0 +1,266 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+//
+// Based on gopkg.in/mgo.v2/bson by Gustavo Niemeyer
+// See THIRD-PARTY-NOTICES for original license terms.
+
+package mgobson_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mongodb-labs/mgobson"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRawDEdit(t *testing.T) {
+	in := mgobson.D{
+		{"a", int32(1)},
+		{"b", mgobson.D{{"c", "x"}, {"d", mgobson.D{{"e", true}}}}},
+		{"f", mgobson.A{"g", "h"}},
+	}
+
+	one := mgobson.Raw{Kind: 0x10, Data: []byte{1, 0, 0, 0}}
+	two := mgobson.Raw{Kind: 0x10, Data: []byte{2, 0, 0, 0}}
+
+	testCases := []struct {
+		name     string
+		edit     func(r *mgobson.RawD) error
+		expected mgobson.D
+	}{
+		{
+			"set top level",
+			func(r *mgobson.RawD) error { return r.Set(two, "a") },
+			mgobson.D{{"a", int32(2)}, in[1], in[2]},
+		},
+		{
+			"set new top level",
+			func(r *mgobson.RawD) error { return r.Set(two, "z") },
+			mgobson.D{in[0], in[1], in[2], {"z", int32(2)}},
+		},
+		{
+			"set nested",
+			func(r *mgobson.RawD) error { return r.Set(one, "b", "d", "e") },
+			mgobson.D{in[0], {"b", mgobson.D{{"c", "x"}, {"d", mgobson.D{{"e", int32(1)}}}}}, in[2]},
+		},
+		{
+			"set new nested",
+			func(r *mgobson.RawD) error { return r.Set(one, "b", "d", "z") },
+			mgobson.D{in[0], {"b", mgobson.D{{"c", "x"}, {"d", mgobson.D{{"e", true}, {"z", int32(1)}}}}}, in[2]},
+		},
+		{
+			"set key with a dot",
+			func(r *mgobson.RawD) error { return r.Set(one, "b", "d.e") },
+			mgobson.D{in[0], {"b", mgobson.D{{"c", "x"}, {"d", mgobson.D{{"e", true}}}, {"d.e", int32(1)}}}, in[2]},
+		},
+		{
+			"set array element",
+			func(r *mgobson.RawD) error { return r.Set(one, "f", "1") },
+			mgobson.D{in[0], in[1], {"f", mgobson.A{"g", int32(1)}}},
+		},
+		{
+			"set appends to array",
+			func(r *mgobson.RawD) error { return r.Set(one, "f", "2") },
+			mgobson.D{in[0], in[1], {"f", mgobson.A{"g", "h", int32(1)}}},
+		},
+		{
+			"replace",
+			func(r *mgobson.RawD) error { return r.Replace(two, "b", "c") },
+			mgobson.D{in[0], {"b", mgobson.D{{"c", int32(2)}, {"d", mgobson.D{{"e", true}}}}}, in[2]},
+		},
+		{
+			"replace with document",
+			func(r *mgobson.RawD) error {
+				b, err := mgobson.D{{"y", int32(1)}}.MarshalBSON()
+				require.NoError(t, err)
+				return r.Replace(mgobson.Raw{Data: b}, "b", "d")
+			},
+			mgobson.D{in[0], {"b", mgobson.D{{"c", "x"}, {"d", mgobson.D{{"y", int32(1)}}}}}, in[2]},
+		},
+		{
+			"delete top level",
+			func(r *mgobson.RawD) error { return r.Delete("a") },
+			mgobson.D{in[1], in[2]},
+		},
+		{
+			"delete nested",
+			func(r *mgobson.RawD) error { return r.Delete("b", "d", "e") },
+			mgobson.D{in[0], {"b", mgobson.D{{"c", "x"}, {"d", mgobson.D{}}}}, in[2]},
+		},
+		{
+			"delete array element",
+			func(r *mgobson.RawD) error { return r.Delete("f", "0") },
+			mgobson.D{in[0], in[1], {"f", mgobson.A{"h"}}},
+		},
+		{
+			"insert before",
+			func(r *mgobson.RawD) error { return r.InsertBefore("z", one, "a") },
+			mgobson.D{{"z", int32(1)}, in[0], in[1], in[2]},
+		},
+		{
+			"insert after nested",
+			func(r *mgobson.RawD) error { return r.InsertAfter("z", one, "b", "c") },
+			mgobson.D{in[0], {"b", mgobson.D{{"c", "x"}, {"z", int32(1)}, {"d", mgobson.D{{"e", true}}}}}, in[2]},
+		},
+		{
+			"insert into array",
+			func(r *mgobson.RawD) error { return r.InsertBefore("", one, "f", "1") },
+			mgobson.D{in[0], in[1], {"f", mgobson.A{"g", int32(1), "h"}}},
+		},
+		{
+			"rename",
+			func(r *mgobson.RawD) error { return r.Rename("z", "b") },
+			mgobson.D{in[0], {"z", in[1].Value}, in[2]},
+		},
+		{
+			"rename nested",
+			func(r *mgobson.RawD) error { return r.Rename("z", "b", "d", "e") },
+			mgobson.D{in[0], {"b", mgobson.D{{"c", "x"}, {"d", mgobson.D{{"z", true}}}}}, in[2]},
+		},
+		{
+			"set dotted path",
+			func(r *mgobson.RawD) error { return r.Set(one, "b.d.e") },
+			mgobson.D{in[0], {"b", mgobson.D{{"c", "x"}, {"d", mgobson.D{{"e", int32(1)}}}}}, in[2]},
+		},
+		{
+			"delete dotted array element",
+			func(r *mgobson.RawD) error { return r.Delete("f.0") },
+			mgobson.D{in[0], in[1], {"f", mgobson.A{"h"}}},
+		},
+		{
+			"insert after dotted path",
+			func(r *mgobson.RawD) error { return r.InsertAfter("z", one, "b.c") },
+			mgobson.D{in[0], {"b", mgobson.D{{"c", "x"}, {"z", int32(1)}, {"d", mgobson.D{{"e", true}}}}}, in[2]},
+		},
+		{
+			"rename dotted path",
+			func(r *mgobson.RawD) error { return r.Rename("z", "b.d.e") },
+			mgobson.D{in[0], {"b", mgobson.D{{"c", "x"}, {"d", mgobson.D{{"z", true}}}}}, in[2]},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := in.MarshalBSON()
+			require.NoError(t, err)
+			original := append([]byte(nil), b...)
+
+			var r mgobson.RawD
+			require.NoError(t, r.UnmarshalBSON(b))
+			before := append(mgobson.RawD(nil), r...)
+
+			require.NoError(t, tc.edit(&r))
+
+			expected, err := tc.expected.MarshalBSON()
+			require.NoError(t, err)
+			actual, err := r.MarshalBSON()
+			require.NoError(t, err)
+			require.Equal(t, expected, actual)
+			require.Equal(t, original, b)
+
+			// Elements that weren't edited keep their data.
+			for _, elem := range r {
+				for _, old := range before {
+					if elem.Name == old.Name && elem.Value.Kind == old.Value.Kind && string(elem.Value.Data) == string(old.Value.Data) {
+						require.True(t, &elem.Value.Data[0] == &old.Value.Data[0], elem.Name)
+					}
+				}
+			}
+		})
+	}
+
+	t.Run("dotted paths", func(t *testing.T) {
+		doc := mgobson.D{{"meta", mgobson.D{{"tags", mgobson.A{"a", "b"}}}}}
+		b, err := doc.MarshalBSON()
+		require.NoError(t, err)
+
+		var dotted, split mgobson.RawD
+		require.NoError(t, dotted.UnmarshalBSON(b))
+		require.NoError(t, split.UnmarshalBSON(b))
+
+		require.Equal(t, []string{"meta", "tags", "0"}, mgobson.SplitPath("meta.tags.0"))
+		require.NoError(t, dotted.Replace(one, "meta.tags.0"))
+		require.NoError(t, split.Replace(one, mgobson.SplitPath("meta.tags.0")...))
+		require.Equal(t, split, dotted)
+
+		raw, err := dotted.Lookup(mgobson.SplitPath("meta.tags.0")...)
+		require.NoError(t, err)
+		require.Equal(t, one, raw)
+
+		require.Equal(t, mgobson.ErrNotFound, dotted.Delete("meta.tags.2"))
+
+		var merr *mgobson.MarshalError
+		err = dotted.Set(one, "meta.tags.3")
+		require.True(t, errors.As(err, &merr), "%v", err)
+		require.Equal(t, "meta.tags.3", merr.Path)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		b, err := in.MarshalBSON()
+		require.NoError(t, err)
+
+		var r mgobson.RawD
+		require.NoError(t, r.UnmarshalBSON(b))
+
+		notFound := []func() error{
+			func() error { return r.Replace(one, "z") },
+			func() error { return r.Delete("b", "z") },
+			func() error { return r.Set(one, "z", "y") },
+			func() error { return r.InsertAfter("y", one, "b", "d", "z") },
+			func() error { return r.Rename("y", "f", "2") },
+		}
+		for _, edit := range notFound {
+			require.Equal(t, mgobson.ErrNotFound, edit())
+		}
+
+		require.Error(t, r.Delete())
+		require.Error(t, r.Set(one))
+
+		var merr *mgobson.MarshalError
+		err = r.InsertBefore("d", one, "b", "c")
+		require.True(t, errors.As(err, &merr), "%v", err)
+		require.Equal(t, "b.d", merr.Path)
+
+		err = r.Rename("b", "a")
+		require.True(t, errors.As(err, &merr), "%v", err)
+		require.Equal(t, "b", merr.Path)
+
+		err = r.Rename("x", "f", "0")
+		require.True(t, errors.As(err, &merr), "%v", err)
+		require.Equal(t, "f.0", merr.Path)
+
+		for _, key := range []string{"3", "10", "foo", "-1", "02", "+2"} {
+			err = r.Set(one, "f", key)
+			require.True(t, errors.As(err, &merr), "%v", err)
+			require.Equal(t, "f."+key, merr.Path)
+		}
+
+		err = r.Set(one, "b", "a\x00")
+		require.True(t, errors.As(err, &merr), "%v", err)
+		require.Equal(t, "b.a\x00", merr.Path)
+
+		err = r.Set(mgobson.Raw{Kind: 0x10, Data: []byte{1}}, "b", "c")
+		require.True(t, errors.As(err, &merr), "%v", err)
+		require.Equal(t, "b.c", merr.Path)
+		require.Equal(t, byte(0x10), merr.Kind)
+
+		var uerr *mgobson.UnmarshalError
+		err = r.Set(one, "a", "b")
+		require.True(t, errors.As(err, &uerr), "%v", err)
+		require.Equal(t, "a", uerr.Path)
+
+		bad := mgobson.RawD{{"a", mgobson.Raw{Kind: 0x03, Data: []byte{9, 0, 0, 0, 0x10, 'b', 0, 1, 0}}}}
+		err = bad.Set(one, "a", "c")
+		require.True(t, errors.As(err, &uerr), "%v", err)
+		require.Equal(t, "a.b", uerr.Path)
+
+		// Failed edits leave r unchanged.
+		actual, err := r.MarshalBSON()
+		require.NoError(t, err)
+		require.Equal(t, b, actual)
+	})
+}
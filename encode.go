@@ -0,0 +1,235 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+//
+// Based on gopkg.in/mgo.v2/bson by Gustavo Niemeyer
+// See THIRD-PARTY-NOTICES for original license terms.
+
+package mgobson
+
+import (
+	"encoding/json"
+	"math"
+	"net/url"
+	"reflect"
+	"sort"
+	"time"
+)
+
+var (
+	typeTime       = reflect.TypeOf(time.Time{})
+	typeURL        = reflect.TypeOf(url.URL{})
+	typeJSONNumber = reflect.TypeOf(json.Number(""))
+
+	typeMongoTimestamp = reflect.TypeOf(MongoTimestamp(0))
+	typeOrderKey       = reflect.TypeOf(MinKey)
+)
+
+// EncodeMode selects the BSON types that Go values are encoded as.
+type EncodeMode int
+
+const (
+	// DriverEncodeMode encodes values using the rules of the
+	// mongo-go-driver for the types that mgobson doesn't handle itself.
+	DriverEncodeMode EncodeMode = iota
+
+	// MgoEncodeMode encodes values exactly as gopkg.in/mgo.v2/bson does,
+	// so that documents written by mgo and mgobson are byte-identical.
+	// Go int values, as well as the smaller signed and unsigned integer
+	// types, are encoded as int32 when they fit and as int64 otherwise.
+	// Int64 and uint64 values are always encoded as int64 unless the
+	// field has the minsize flag. A json.Number is encoded as an int64 or
+	// a double, and a url.URL as a string. Nil slices and maps are encoded
+	// as empty arrays, binaries and documents rather than as null.
+	MgoEncodeMode
+)
+
+var defaultEncodeMode = DriverEncodeMode
+
+// SetDefaultEncodeMode changes the EncodeMode used by Marshal and by the
+// MarshalBSON and MarshalBSONDocument methods of M and D. It should be
+// called during initialization, before any data is encoded.
+func SetDefaultEncodeMode(mode EncodeMode) {
+	defaultEncodeMode = mode
+}
+
+var sortMapKeys = false
+
+// SetSortMapKeys enables or disables sorting the keys of M values and of
+// any other maps, including inlined ones, when they are encoded. Go maps
+// are unordered, so by default the same map may produce different bytes
+// each time it's encoded; with sorting enabled the keys are written in
+// increasing byte order at every depth, and the output is reproducible.
+// It should be called during initialization, before any data is encoded.
+func SetSortMapKeys(enabled bool) {
+	sortMapKeys = enabled
+}
+
+var strictMarshal = false
+
+// SetStrictMarshal enables or disables validating Raw and RawD values when
+// they're marshaled, as RawD.Validate does. By default their data is copied
+// into the output as is, so that invalid data produces corrupt BSON which
+// only the server rejects; with validation enabled marshaling fails with a
+// *MarshalError instead. It should be called during initialization, before
+// any data is encoded.
+func SetStrictMarshal(enabled bool) {
+	strictMarshal = enabled
+}
+
+// encoder holds the state shared while encoding a single value.
+type encoder struct {
+	mode     EncodeMode
+	sortKeys bool
+}
+
+func newEncoder(mode EncodeMode) *encoder {
+	return &encoder{mode: mode, sortKeys: sortMapKeys}
+}
+
+// Marshal serializes the in value, which may be a map or a struct value.
+// In the case of struct values, only exported fields will be serialized,
+// and the order of serialized fields will match that of the struct itself.
+// The lowercased field name is used as the key for each exported field,
+// but this behavior may be changed using the respective field tag.
+// The tag may also contain flags to tweak the marshalling behavior for
+// the field. The tag formats accepted are:
+//
+//	"[<key>][,<flag1>[,<flag2>]]"
+//
+//	`(...) bson:"[<key>][,<flag1>[,<flag2>]]" (...)`
+//
+// The following flags are currently supported:
+//
+//	omitempty  Only include the field if it's not set to the zero
+//	           value for the type or to empty slices or maps.
+//
+//	minsize    Marshal an int64 value as an int32, if that's feasible
+//	           while preserving the numeric value.
+//
+//	inline     Inline the field, which must be a struct or a map,
+//	           causing all of its fields or keys to be processed as if
+//	           they were part of the outer struct. For maps, keys must
+//	           not conflict with the bson keys of other struct fields.
+//
+// Some examples:
+//
+//	type T struct {
+//	    A bool
+//	    B int    "myb"
+//	    C string "myc,omitempty"
+//	    D string `bson:",omitempty" json:"jsonkey"`
+//	    E int64  ",minsize"
+//	    F int64  "myf,omitempty,minsize"
+//	}
+//
+// Values are mapped to BSON types as selected by the package default
+// EncodeMode. See MarshalWithMode.
+//
+// Errors are returned as a *MarshalError, which holds the path of the
+// element that couldn't be marshaled.
+func Marshal(in interface{}) ([]byte, error) {
+	return MarshalWithMode(in, defaultEncodeMode)
+}
+
+// MarshalWithMode is like Marshal, but maps Go values to BSON types as
+// selected by mode instead of the package default.
+func MarshalWithMode(in interface{}, mode EncodeMode) ([]byte, error) {
+	b, err := newEncoder(mode).marshal(in)
+	return b, rootMarshalError(err, in)
+}
+
+// mapKeys returns the keys of the map v, which must have string keys, sorted
+// if the encoder sorts map keys.
+func (e *encoder) mapKeys(v reflect.Value) []reflect.Value {
+	keys := v.MapKeys()
+	if e.sortKeys {
+		sort.Slice(keys, func(i, j int) bool {
+			return keys[i].String() < keys[j].String()
+		})
+	}
+	return keys
+}
+
+// minSize returns the value of v as an int32 if v is an integer whose value
+// fits in one, and as is otherwise, as gopkg.in/mgo.v2/bson does for fields
+// with the minsize flag. Pointers and interfaces are followed and the values
+// of Getters are used in their place, while MongoTimestamp, MinKey and
+// MaxKey keep their own BSON types.
+func minSize(v reflect.Value) (interface{}, error) {
+	for {
+		switch v.Kind() {
+		case reflect.Invalid:
+			return nil, nil
+		case reflect.Ptr, reflect.Interface:
+			if v.IsNil() {
+				return nil, nil
+			}
+		}
+
+		if getter, ok := v.Interface().(Getter); ok {
+			getv, err := getter.GetBSON()
+			if err != nil {
+				return nil, err
+			}
+			v = reflect.ValueOf(getv)
+			continue
+		}
+
+		switch v.Kind() {
+		case reflect.Ptr, reflect.Interface:
+			v = v.Elem()
+			continue
+		case reflect.Int, reflect.Int64:
+			if v.Type() == typeMongoTimestamp || v.Type() == typeOrderKey {
+				break
+			}
+			if i := v.Int(); i >= math.MinInt32 && i <= math.MaxInt32 {
+				return int32(i), nil
+			}
+		case reflect.Uint, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			if u := v.Uint(); u <= math.MaxInt32 {
+				return int32(u), nil
+			}
+		}
+		return v.Interface(), nil
+	}
+}
+
+func isZero(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String:
+		return len(v.String()) == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	case reflect.Slice:
+		return v.Len() == 0
+	case reflect.Map:
+		return v.Len() == 0
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Struct:
+		vt := v.Type()
+		if vt == typeTime {
+			return v.Interface().(time.Time).IsZero()
+		}
+		for i := 0; i < v.NumField(); i++ {
+			if vt.Field(i).PkgPath != "" && !vt.Field(i).Anonymous {
+				continue // Private field
+			}
+			if !isZero(v.Field(i)) {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
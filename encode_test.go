@@ -0,0 +1,485 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+//
+// Based on gopkg.in/mgo.v2/bson by Gustavo Niemeyer
+// See THIRD-PARTY-NOTICES for original license terms.
+
+package mgobson_test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/mongodb-labs/mgobson"
+	"github.com/stretchr/testify/require"
+)
+
+type tagsType struct {
+	A      bool
+	B      int    `bson:"myb"`
+	C      string `bson:"myc,omitempty"`
+	D      string `bson:",omitempty" json:"jsonkey"`
+	E      int64  `bson:",minsize"`
+	F      int64  `bson:"myf,omitempty,minsize"`
+	Ignore string `bson:"-"`
+	hidden string
+}
+
+type inlineBase struct {
+	X int32
+	Y int32 `bson:"why"`
+}
+
+type inlineStructType struct {
+	Name string
+	Base inlineBase `bson:",inline"`
+}
+
+type inlineMapType struct {
+	A     int32
+	Extra mgobson.M `bson:",inline"`
+}
+
+type inlineMapTypedType struct {
+	A     int32
+	Extra map[string]string `bson:",inline"`
+}
+
+type roundTripType struct {
+	Id      mgobson.ObjectId `bson:"_id"`
+	Created time.Time        `bson:"created"`
+	Tags    []string         `bson:"tags,omitempty"`
+	Nested  *inlineBase      `bson:"nested,omitempty"`
+	Count   int64            `bson:"count,minsize"`
+}
+
+func TestMarshal(t *testing.T) {
+	testCases := []struct {
+		name     string
+		in       interface{}
+		expected mgobson.D
+	}{
+		{
+			"tags",
+			&tagsType{A: true, B: 2, E: 3, Ignore: "x", hidden: "y"},
+			mgobson.D{{"a", true}, {"myb", int64(2)}, {"e", int32(3)}},
+		},
+		{
+			"omitempty set",
+			tagsType{C: "c", D: "d", E: 1 << 40, F: 5},
+			mgobson.D{{"a", false}, {"myb", int64(0)}, {"myc", "c"}, {"d", "d"}, {"e", int64(1 << 40)}, {"myf", int32(5)}},
+		},
+		{
+			"inline struct",
+			inlineStructType{Name: "n", Base: inlineBase{X: 1, Y: 2}},
+			mgobson.D{{"name", "n"}, {"x", int32(1)}, {"why", int32(2)}},
+		},
+		{
+			"inline map",
+			inlineMapType{A: 1, Extra: mgobson.M{"b": "c"}},
+			mgobson.D{{"a", int32(1)}, {"b", "c"}},
+		},
+		{
+			"map",
+			map[string]int32{"a": 1},
+			mgobson.D{{"a", int32(1)}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			expected, err := tc.expected.MarshalBSON()
+			require.NoError(t, err)
+
+			actual, err := mgobson.Marshal(tc.in)
+			require.NoError(t, err)
+			require.Equal(t, expected, actual)
+		})
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		invalid := []interface{}{
+			nil,
+			(*tagsType)(nil),
+			42,
+			"string",
+			map[int]string{1: "a"},
+			inlineMapType{A: 1, Extra: mgobson.M{"a": "conflict"}},
+			struct {
+				A int `bson:"a"`
+				B int `bson:"a"`
+			}{},
+			struct {
+				A int `bson:",unknown"`
+			}{},
+			struct {
+				A int `bson:",inline"`
+			}{},
+			struct {
+				A map[int]string `bson:",inline"`
+			}{},
+		}
+
+		for _, in := range invalid {
+			_, err := mgobson.Marshal(in)
+			require.Error(t, err, "%#v", in)
+		}
+	})
+}
+
+func TestUnmarshalStruct(t *testing.T) {
+	t.Run("tags", func(t *testing.T) {
+		b, err := mgobson.D{{"a", true}, {"myb", int32(2)}, {"myc", "c"}, {"ignore", "x"}, {"unknown", 1}}.MarshalBSON()
+		require.NoError(t, err)
+
+		actual := tagsType{D: "stale"}
+		require.NoError(t, mgobson.Unmarshal(b, &actual))
+		require.Equal(t, tagsType{A: true, B: 2, C: "c"}, actual)
+	})
+
+	t.Run("inline struct", func(t *testing.T) {
+		b, err := mgobson.D{{"name", "n"}, {"x", int32(1)}, {"why", int32(2)}}.MarshalBSON()
+		require.NoError(t, err)
+
+		var actual inlineStructType
+		require.NoError(t, mgobson.Unmarshal(b, &actual))
+		require.Equal(t, inlineStructType{Name: "n", Base: inlineBase{X: 1, Y: 2}}, actual)
+	})
+
+	t.Run("inline map collects unknown fields", func(t *testing.T) {
+		b, err := mgobson.D{{"a", int32(1)}, {"b", "c"}, {"d", mgobson.D{{"e", int32(2)}}}}.MarshalBSON()
+		require.NoError(t, err)
+
+		var actual inlineMapType
+		require.NoError(t, mgobson.Unmarshal(b, &actual))
+		require.Equal(t, inlineMapType{A: 1, Extra: mgobson.M{"b": "c", "d": mgobson.M{"e": int32(2)}}}, actual)
+
+		var typed inlineMapTypedType
+		require.NoError(t, mgobson.Unmarshal(b, &typed))
+		require.Equal(t, inlineMapTypedType{A: 1, Extra: map[string]string{"b": "c"}}, typed)
+	})
+
+	t.Run("round trip", func(t *testing.T) {
+		in := roundTripType{
+			Id:      mgobson.ObjectIdHex("5a4af6a50000000000000001"),
+			Created: time.Date(2018, 1, 2, 3, 4, 5, 6e6, time.UTC),
+			Nested:  &inlineBase{X: 1},
+			Count:   7,
+		}
+
+		b, err := mgobson.Marshal(&in)
+		require.NoError(t, err)
+
+		var out roundTripType
+		require.NoError(t, mgobson.Unmarshal(b, &out))
+		require.True(t, in.Created.Equal(out.Created))
+		out.Created = in.Created
+		require.Equal(t, in, out)
+
+		var m mgobson.M
+		require.NoError(t, mgobson.Unmarshal(b, &m))
+		require.Equal(t, int32(7), m["count"])
+		require.NotContains(t, m, "tags")
+	})
+}
+
+func TestMarshalContainers(t *testing.T) {
+	g := &getterType{value: mgobson.D{{"g", int32(1)}}}
+
+	in := mgobson.D{
+		{"ds", []mgobson.D{{{"a", int32(1)}}, {{"b", int32(2)}}}},
+		{"ms", []mgobson.M{{"c": int32(3)}}},
+		{"raw", []mgobson.RawD{{{"d", mgobson.Raw{Kind: 0x08, Data: []byte{1}}}}}},
+		{"a", mgobson.A{int32(1), "two", mgobson.A{mgobson.D{{"e", g}}}}},
+		{"array", [2]interface{}{g, nil}},
+		{"map", map[string]mgobson.D{"f": {{"h", int32(4)}}}},
+		{"getters", []*getterType{g, nil}},
+		{"structs", []inlineBase{{X: 1, Y: 2}}},
+		{"bytes", []byte{1, 2}},
+		{"fixed", [2]byte{3, 4}},
+		{"empty", []mgobson.D{}},
+	}
+
+	b, err := mgobson.Marshal(in)
+	require.NoError(t, err)
+
+	var actual mgobson.D
+	require.NoError(t, actual.UnmarshalBSON(b))
+
+	expected := mgobson.D{
+		{"ds", []interface{}{mgobson.D{{"a", int32(1)}}, mgobson.D{{"b", int32(2)}}}},
+		{"ms", []interface{}{mgobson.D{{"c", int32(3)}}}},
+		{"raw", []interface{}{mgobson.D{{"d", true}}}},
+		{"a", []interface{}{int32(1), "two", []interface{}{mgobson.D{{"e", mgobson.D{{"g", int32(1)}}}}}}},
+		{"array", []interface{}{mgobson.D{{"g", int32(1)}}, nil}},
+		{"map", mgobson.D{{"f", mgobson.D{{"h", int32(4)}}}}},
+		{"getters", []interface{}{mgobson.D{{"g", int32(1)}}, nil}},
+		{"structs", []interface{}{mgobson.D{{"x", int32(1)}, {"why", int32(2)}}}},
+		{"bytes", []byte{1, 2}},
+		{"fixed", []byte{3, 4}},
+		{"empty", []interface{}{}},
+	}
+	require.Equal(t, expected, actual)
+
+	var m mgobson.M
+	require.NoError(t, m.UnmarshalBSON(b))
+	require.Equal(t, []interface{}{mgobson.M{"c": int32(3)}}, m["ms"])
+
+	_, err = mgobson.Marshal(mgobson.M{"a": mgobson.A{mgobson.ObjectId("short")}})
+	require.Error(t, err)
+}
+
+type encodeModeType struct {
+	Int       int
+	BigInt    int
+	Int8      int8
+	Int64     int64
+	MinInt64  int64 `bson:",minsize"`
+	Uint      uint
+	Uint32    uint32
+	BigUint32 uint32
+	Uint64    uint64
+	MinUint64 uint64 `bson:",minsize"`
+	Ints      []int
+	Map       map[string]uint16
+	Number    json.Number
+	Float     json.Number
+	URL       url.URL
+	Nil       interface{}
+}
+
+func TestEncodeMode(t *testing.T) {
+	u, err := url.Parse("http://example.com/a?b=c")
+	require.NoError(t, err)
+
+	in := encodeModeType{
+		Int:       1,
+		BigInt:    1 << 40,
+		Int8:      -2,
+		Int64:     3,
+		MinInt64:  4,
+		Uint:      5,
+		Uint32:    6,
+		BigUint32: 1 << 31,
+		Uint64:    7,
+		MinUint64: 8,
+		Ints:      []int{9, 1 << 40},
+		Map:       map[string]uint16{"a": 10},
+		Number:    "11",
+		Float:     "1.5",
+		URL:       *u,
+	}
+
+	// These are the bytes gopkg.in/mgo.v2/bson produces for the same value.
+	expected, err := mgobson.D{
+		{"int", int32(1)},
+		{"bigint", int64(1 << 40)},
+		{"int8", int32(-2)},
+		{"int64", int64(3)},
+		{"minint64", int32(4)},
+		{"uint", int32(5)},
+		{"uint32", int32(6)},
+		{"biguint32", int64(1 << 31)},
+		{"uint64", int64(7)},
+		{"minuint64", int32(8)},
+		{"ints", mgobson.A{int32(9), int64(1 << 40)}},
+		{"map", mgobson.D{{"a", int32(10)}}},
+		{"number", int64(11)},
+		{"float", 1.5},
+		{"url", "http://example.com/a?b=c"},
+		{"nil", nil},
+	}.MarshalBSON()
+	require.NoError(t, err)
+
+	actual, err := mgobson.MarshalWithMode(in, mgobson.MgoEncodeMode)
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+
+	actual, err = mgobson.M{"a": 1}.MarshalBSONWithMode(mgobson.MgoEncodeMode)
+	require.NoError(t, err)
+	expected, err = mgobson.M{"a": int32(1)}.MarshalBSON()
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+
+	actual, err = mgobson.D{{"a", mgobson.D{{"b", 1}}}}.MarshalBSONWithMode(mgobson.MgoEncodeMode)
+	require.NoError(t, err)
+	expected, err = mgobson.D{{"a", mgobson.D{{"b", int32(1)}}}}.MarshalBSON()
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+
+	_, err = mgobson.MarshalWithMode(mgobson.M{"a": uint64(1 << 63)}, mgobson.MgoEncodeMode)
+	require.Error(t, err)
+	_, err = mgobson.MarshalWithMode(mgobson.M{"a": make(chan int)}, mgobson.MgoEncodeMode)
+	require.Error(t, err)
+
+	t.Run("nil slices and maps", func(t *testing.T) {
+		in := mgobson.D{
+			{"ints", []int(nil)},
+			{"bytes", []byte(nil)},
+			{"map", map[string]int(nil)},
+		}
+
+		actual, err := in.MarshalBSONWithMode(mgobson.DriverEncodeMode)
+		require.NoError(t, err)
+		expected, err := mgobson.D{{"ints", nil}, {"bytes", nil}, {"map", nil}}.MarshalBSON()
+		require.NoError(t, err)
+		require.Equal(t, expected, actual)
+
+		actual, err = in.MarshalBSONWithMode(mgobson.MgoEncodeMode)
+		require.NoError(t, err)
+		expected, err = mgobson.D{
+			{"ints", mgobson.A{}},
+			{"bytes", []byte{}},
+			{"map", mgobson.D{}},
+		}.MarshalBSON()
+		require.NoError(t, err)
+		require.Equal(t, expected, actual)
+	})
+
+	t.Run("package default", func(t *testing.T) {
+		mgobson.SetDefaultEncodeMode(mgobson.MgoEncodeMode)
+		defer mgobson.SetDefaultEncodeMode(mgobson.DriverEncodeMode)
+
+		actual, err := mgobson.D{{"a", 1}}.MarshalBSON()
+		require.NoError(t, err)
+		expected, err := mgobson.D{{"a", int32(1)}}.MarshalBSONWithMode(mgobson.DriverEncodeMode)
+		require.NoError(t, err)
+		require.Equal(t, expected, actual)
+
+		actual, err = mgobson.D{{"a", 1}}.MarshalBSONWithMode(mgobson.DriverEncodeMode)
+		require.NoError(t, err)
+		expected, err = mgobson.D{{"a", int64(1)}}.MarshalBSON()
+		require.NoError(t, err)
+		require.Equal(t, expected, actual)
+	})
+}
+
+func TestMinSize(t *testing.T) {
+	i := int64(6)
+	tests := []struct {
+		name     string
+		in       interface{}
+		expected []byte
+	}{
+		{"int64", struct {
+			V int64 `bson:",minsize"`
+		}{1}, []byte{0x10, 'v', 0, 1, 0, 0, 0}},
+		{"big int64", struct {
+			V int64 `bson:",minsize"`
+		}{1 << 32}, []byte{0x12, 'v', 0, 0, 0, 0, 0, 1, 0, 0, 0}},
+		{"duration", struct {
+			V time.Duration `bson:",minsize"`
+		}{2}, []byte{0x10, 'v', 0, 2, 0, 0, 0}},
+		{"timestamp", struct {
+			V mgobson.MongoTimestamp `bson:",minsize"`
+		}{3}, []byte{0x11, 'v', 0, 3, 0, 0, 0, 0, 0, 0, 0}},
+		{"maxkey", struct {
+			V interface{} `bson:",minsize"`
+		}{mgobson.MaxKey}, []byte{0x7F, 'v', 0}},
+		{"minkey", struct {
+			V interface{} `bson:",minsize"`
+		}{mgobson.MinKey}, []byte{0xFF, 'v', 0}},
+		{"interface", struct {
+			V interface{} `bson:",minsize"`
+		}{int64(4)}, []byte{0x10, 'v', 0, 4, 0, 0, 0}},
+		{"pointer", struct {
+			V *int64 `bson:",minsize"`
+		}{&i}, []byte{0x10, 'v', 0, 6, 0, 0, 0}},
+		{"nil pointer", struct {
+			V *int64 `bson:",minsize"`
+		}{nil}, []byte{0x0A, 'v', 0}},
+		{"uintptr", struct {
+			V uintptr `bson:",minsize"`
+		}{7}, []byte{0x10, 'v', 0, 7, 0, 0, 0}},
+		{"big uintptr", struct {
+			V uintptr `bson:",minsize"`
+		}{1 << 32}, []byte{0x12, 'v', 0, 0, 0, 0, 0, 1, 0, 0, 0}},
+		{"uint64", struct {
+			V uint64 `bson:",minsize"`
+		}{8}, []byte{0x10, 'v', 0, 8, 0, 0, 0}},
+		{"getter", struct {
+			V *getterType `bson:",minsize"`
+		}{&getterType{value: int64(9)}}, []byte{0x10, 'v', 0, 9, 0, 0, 0}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			// These are the bytes gopkg.in/mgo.v2/bson produces for the same value.
+			expected := append([]byte{byte(len(tc.expected) + 5), 0, 0, 0}, tc.expected...)
+			expected = append(expected, 0)
+
+			actual, err := mgobson.MarshalWithMode(tc.in, mgobson.MgoEncodeMode)
+			require.NoError(t, err)
+			require.Equal(t, expected, actual)
+		})
+	}
+
+	_, err := mgobson.Marshal(struct {
+		V *getterType `bson:",minsize"`
+	}{&getterType{err: errors.New("failed")}})
+	require.Error(t, err)
+}
+
+func TestMarshalRaw(t *testing.T) {
+	actual, err := mgobson.D{
+		{"a", mgobson.Raw{Kind: 0x10, Data: []byte{1, 0, 0, 0}}},
+		{"b", mgobson.Raw{Kind: 0x0A}},
+	}.MarshalBSON()
+	require.NoError(t, err)
+
+	expected, err := mgobson.D{{"a", int32(1)}, {"b", nil}}.MarshalBSON()
+	require.NoError(t, err)
+	require.Equal(t, expected, actual)
+
+	_, err = mgobson.D{{"a", mgobson.Raw{Kind: 0x03}}}.MarshalBSON()
+	require.Error(t, err)
+}
+
+func TestSortMapKeys(t *testing.T) {
+	mgobson.SetSortMapKeys(true)
+	defer mgobson.SetSortMapKeys(false)
+
+	in := mgobson.M{
+		"c": int32(1),
+		"a": mgobson.M{"z": int32(2), "y": int32(3), "x": int32(4)},
+		"b": mgobson.A{map[string]int32{"q": 5, "p": 6}},
+		"d": inlineMapType{A: 7, Extra: mgobson.M{"f": int32(8), "e": int32(9)}},
+		"B": int32(10),
+	}
+
+	// Keys are sorted by their bytes, as sort.Strings does.
+	expected, err := mgobson.D{
+		{"B", int32(10)},
+		{"a", mgobson.D{{"x", int32(4)}, {"y", int32(3)}, {"z", int32(2)}}},
+		{"b", mgobson.A{mgobson.D{{"p", int32(6)}, {"q", int32(5)}}}},
+		{"c", int32(1)},
+		{"d", mgobson.D{{"a", int32(7)}, {"e", int32(9)}, {"f", int32(8)}}},
+	}.MarshalBSON()
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		actual, err := in.MarshalBSON()
+		require.NoError(t, err)
+		require.Equal(t, expected, actual)
+
+		actual, err = mgobson.Marshal(in)
+		require.NoError(t, err)
+		require.Equal(t, expected, actual)
+
+		actual, err = in.AppendBSON(nil)
+		require.NoError(t, err)
+		require.Equal(t, expected, actual)
+
+		doc, err := in.MarshalBSONDocument()
+		require.NoError(t, err)
+		actual, err = doc.MarshalBSON()
+		require.NoError(t, err)
+		require.Equal(t, expected, actual)
+	}
+}
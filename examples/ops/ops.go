@@ -82,7 +82,7 @@ func main() {
 		panic(err)
 	}
 
-	pipeline := mgobson.DocsToArray([]interface{}{
+	pipeline, err := mgobson.DocsToArray([]interface{}{
 		mgobson.M{
 			"$group": mgobson.M{
 				"_id": 1,
@@ -97,6 +97,9 @@ func main() {
 			}},
 		},
 	})
+	if err != nil {
+		panic(err)
+	}
 
 	cursor, err := ops.Aggregate(
 		context.Background(),
@@ -0,0 +1,1170 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+//
+// Based on gopkg.in/mgo.v2/bson by Gustavo Niemeyer
+// See THIRD-PARTY-NOTICES for original license terms.
+
+package mgobson
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// MarshalExtJSON serializes in, which may be any value accepted by Marshal,
+// into MongoDB Extended JSON v2. The canonical format preserves the type of
+// every BSON value, while the relaxed format writes numbers and most dates
+// as plain JSON values, which is easier to read but loses some type
+// information. Elements are written in the order of the BSON document, so
+// the key order of D and RawD values is kept.
+//
+// Relevant documentation:
+//
+//	https://github.com/mongodb/specifications/blob/master/source/extended-json.rst
+func MarshalExtJSON(in interface{}, canonical bool) ([]byte, error) {
+	b, err := Marshal(in)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkDocument(b); err != nil {
+		return nil, err
+	}
+
+	w := extJSONWriter{canonical: canonical}
+	return w.appendDocument(nil, b)
+}
+
+// UnmarshalExtJSON deserializes the MongoDB Extended JSON document in data
+// into out, which may be any value accepted by Unmarshal, such as a pointer
+// to an M, D, RawD or struct value. Both the canonical and the relaxed
+// formats of Extended JSON v2 are accepted, as well as the legacy forms
+// understood by mgo, such as {"$binary": "...", "$type": "..."} and
+// {"$date": 1500000000000}, and the mongo shell constructors ObjectId,
+// NumberInt, NumberLong, NumberDecimal, ISODate, Date, Timestamp, BinData,
+// MinKey, MaxKey and undefined. The order of keys is kept when decoding
+// into D or RawD.
+func UnmarshalExtJSON(data []byte, out interface{}) error {
+	p := extJSONParser{data: data}
+
+	v, err := p.parse()
+	if err != nil {
+		return err
+	}
+
+	doc, ok := v.(D)
+	if !ok {
+		return fmt.Errorf("Extended JSON must hold a document, not %T", v)
+	}
+
+	b, err := Marshal(doc)
+	if err != nil {
+		return err
+	}
+
+	return Unmarshal(b, out)
+}
+
+// SyntaxError describes malformed Extended JSON or mongo shell input, and
+// where in the input it was found. Line and Column are both 1-based, and Column counts
+// bytes.
+type SyntaxError struct {
+	Msg    string
+	Offset int
+	Line   int
+	Column int
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s at line %d, column %d", e.Msg, e.Line, e.Column)
+}
+
+// extJSONWriter appends the Extended JSON representation of BSON data, which
+// must have been checked with checkDocument.
+type extJSONWriter struct {
+	canonical bool
+}
+
+func (w *extJSONWriter) appendDocument(dst []byte, data []byte) ([]byte, error) {
+	elems, err := splitDocument(data)
+	if err != nil {
+		return nil, err
+	}
+
+	dst = append(dst, '{')
+	for i, elem := range elems {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+
+		dst = appendJSONString(dst, elem.Name)
+		dst = append(dst, ':')
+
+		dst, err = w.appendValue(dst, elem.Value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return append(dst, '}'), nil
+}
+
+func (w *extJSONWriter) appendArray(dst []byte, data []byte) ([]byte, error) {
+	elems, err := splitDocument(data)
+	if err != nil {
+		return nil, err
+	}
+
+	dst = append(dst, '[')
+	for i, elem := range elems {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+
+		dst, err = w.appendValue(dst, elem.Value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return append(dst, ']'), nil
+}
+
+func (w *extJSONWriter) appendValue(dst []byte, raw Raw) ([]byte, error) {
+	switch raw.Kind {
+	case 0x03:
+		return w.appendDocument(dst, raw.Data)
+	case 0x04:
+		return w.appendArray(dst, raw.Data)
+	case 0x09:
+		if len(raw.Data) != 8 {
+			return nil, fmt.Errorf("invalid BSON datetime of %d bytes", len(raw.Data))
+		}
+		return w.appendDateTime(dst, int64(binary.LittleEndian.Uint64(raw.Data))), nil
+	case 0x0F:
+		v, err := raw.driverValue()
+		if err != nil {
+			return nil, err
+		}
+
+		code, scope := v.ReaderJavaScriptWithScope()
+		dst = append(dst, `{"$code":`...)
+		dst = appendJSONString(dst, code)
+		dst = append(dst, `,"$scope":`...)
+		dst, err = w.appendDocument(dst, scope)
+		if err != nil {
+			return nil, err
+		}
+		return append(dst, '}'), nil
+	}
+
+	in, err := newDecoder(DriverDecodeMode).interfaceFromData(nil, raw.Kind, raw.Data, typeD)
+	if err != nil {
+		return nil, err
+	}
+
+	switch v := in.(type) {
+	case nil:
+		dst = append(dst, "null"...)
+	case bool:
+		dst = strconv.AppendBool(dst, v)
+	case string:
+		dst = appendJSONString(dst, v)
+	case int32:
+		if w.canonical {
+			dst = append(dst, `{"$numberInt":"`...)
+			dst = strconv.AppendInt(dst, int64(v), 10)
+			dst = append(dst, `"}`...)
+		} else {
+			dst = strconv.AppendInt(dst, int64(v), 10)
+		}
+	case int64:
+		if w.canonical {
+			dst = append(dst, `{"$numberLong":"`...)
+			dst = strconv.AppendInt(dst, v, 10)
+			dst = append(dst, `"}`...)
+		} else {
+			dst = strconv.AppendInt(dst, v, 10)
+		}
+	case float64:
+		if w.canonical || math.IsInf(v, 0) || math.IsNaN(v) {
+			dst = append(dst, `{"$numberDouble":"`...)
+			dst = append(dst, formatExtJSONDouble(v)...)
+			dst = append(dst, `"}`...)
+		} else {
+			dst = append(dst, formatExtJSONDouble(v)...)
+		}
+	case Decimal128:
+		dst = append(dst, `{"$numberDecimal":"`...)
+		dst = append(dst, v.String()...)
+		dst = append(dst, `"}`...)
+	case ObjectId:
+		dst = append(dst, `{"$oid":"`...)
+		dst = append(dst, v.Hex()...)
+		dst = append(dst, `"}`...)
+	case []byte:
+		dst = appendExtJSONBinary(dst, 0x00, v)
+	case Binary:
+		dst = appendExtJSONBinary(dst, v.Kind, v.Data)
+	case RegEx:
+		options := []byte(v.Options)
+		sort.Slice(options, func(i, j int) bool { return options[i] < options[j] })
+
+		dst = append(dst, `{"$regularExpression":{"pattern":`...)
+		dst = appendJSONString(dst, v.Pattern)
+		dst = append(dst, `,"options":`...)
+		dst = appendJSONString(dst, string(options))
+		dst = append(dst, `}}`...)
+	case DBPointer:
+		dst = append(dst, `{"$dbPointer":{"$ref":`...)
+		dst = appendJSONString(dst, v.Namespace)
+		dst = append(dst, `,"$id":{"$oid":"`...)
+		dst = append(dst, v.Id.Hex()...)
+		dst = append(dst, `"}}}`...)
+	case JavaScript:
+		dst = append(dst, `{"$code":`...)
+		dst = appendJSONString(dst, v.Code)
+		dst = append(dst, '}')
+	case Symbol:
+		dst = append(dst, `{"$symbol":`...)
+		dst = appendJSONString(dst, string(v))
+		dst = append(dst, '}')
+	case MongoTimestamp:
+		dst = append(dst, `{"$timestamp":{"t":`...)
+		dst = strconv.AppendUint(dst, uint64(v)>>32, 10)
+		dst = append(dst, `,"i":`...)
+		dst = strconv.AppendUint(dst, uint64(uint32(v)), 10)
+		dst = append(dst, `}}`...)
+	case undefined:
+		dst = append(dst, `{"$undefined":true}`...)
+	case orderKey:
+		if v == MinKey {
+			dst = append(dst, `{"$minKey":1}`...)
+		} else {
+			dst = append(dst, `{"$maxKey":1}`...)
+		}
+	default:
+		return nil, fmt.Errorf("Can't marshal BSON kind 0x%02x as Extended JSON", raw.Kind)
+	}
+
+	return dst, nil
+}
+
+func (w *extJSONWriter) appendDateTime(dst []byte, ms int64) []byte {
+	t := time.Unix(ms/1e3, ms%1e3*1e6).UTC()
+	if !w.canonical && t.Year() >= 1970 && t.Year() <= 9999 {
+		dst = append(dst, `{"$date":"`...)
+		dst = append(dst, t.Format(extJSONDateFormat)...)
+		return append(dst, `"}`...)
+	}
+
+	dst = append(dst, `{"$date":{"$numberLong":"`...)
+	dst = strconv.AppendInt(dst, ms, 10)
+	return append(dst, `"}}`...)
+}
+
+const extJSONDateFormat = "2006-01-02T15:04:05.999Z07:00"
+
+func appendExtJSONBinary(dst []byte, kind byte, data []byte) []byte {
+	dst = append(dst, `{"$binary":{"base64":"`...)
+	dst = append(dst, base64.StdEncoding.EncodeToString(data)...)
+	dst = append(dst, `","subType":"`...)
+	dst = append(dst, hex.EncodeToString([]byte{kind})...)
+	return append(dst, `"}}`...)
+}
+
+// formatExtJSONDouble formats f with as many digits as necessary to parse
+// it back exactly, making sure that integral values still look like
+// floating point numbers.
+func formatExtJSONDouble(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+
+	s := strconv.FormatFloat(f, 'G', -1, 64)
+	if !strings.ContainsAny(s, ".E") {
+		s += ".0"
+	}
+	return s
+}
+
+// appendJSONString appends s to dst as a quoted JSON string. Invalid UTF-8
+// is replaced with the Unicode replacement character.
+func appendJSONString(dst []byte, s string) []byte {
+	const hexDigits = "0123456789abcdef"
+
+	dst = append(dst, '"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			switch {
+			case c == '"' || c == '\\':
+				dst = append(dst, '\\', c)
+			case c == '\n':
+				dst = append(dst, '\\', 'n')
+			case c == '\r':
+				dst = append(dst, '\\', 'r')
+			case c == '\t':
+				dst = append(dst, '\\', 't')
+			case c < 0x20 || c == 0x7f:
+				dst = append(dst, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xf])
+			default:
+				dst = append(dst, c)
+			}
+			i++
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			dst = append(dst, "\ufffd"...)
+		} else {
+			dst = append(dst, s[i:i+size]...)
+		}
+		i += size
+	}
+	return append(dst, '"')
+}
+
+// extJSONParser parses Extended JSON into D documents, A arrays and the
+// mgobson types that represent the special BSON values. With shell set it
+// parses the syntax of the mongo shell instead, which also allows unquoted
+// keys, single-quoted strings, trailing commas and regular expression
+// literals, and which doesn't treat the Extended JSON type wrappers
+// specially.
+type extJSONParser struct {
+	data  []byte
+	pos   int
+	shell bool
+}
+
+func (p *extJSONParser) parse() (interface{}, error) {
+	v, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+
+	p.skipSpace()
+	if p.pos < len(p.data) {
+		return nil, p.errorf("invalid character %q after top-level value", p.data[p.pos])
+	}
+	return v, nil
+}
+
+// errorf returns a *SyntaxError for the current position.
+func (p *extJSONParser) errorf(format string, args ...interface{}) error {
+	return p.errorAt(p.pos, format, args...)
+}
+
+func (p *extJSONParser) errorAt(offset int, format string, args ...interface{}) error {
+	if offset > len(p.data) {
+		offset = len(p.data)
+	}
+
+	line, col := 1, 1
+	for _, c := range p.data[:offset] {
+		if c == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+
+	return &SyntaxError{
+		Msg:    fmt.Sprintf(format, args...),
+		Offset: offset,
+		Line:   line,
+		Column: col,
+	}
+}
+
+func (p *extJSONParser) skipSpace() {
+	for p.pos < len(p.data) {
+		switch p.data[p.pos] {
+		case ' ', '\t', '\n', '\r':
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+// expect consumes c, after any whitespace.
+func (p *extJSONParser) expect(c byte) error {
+	p.skipSpace()
+	if p.pos >= len(p.data) {
+		return p.errorf("unexpected end of input, expected %q", c)
+	}
+	if p.data[p.pos] != c {
+		return p.errorf("invalid character %q, expected %q", p.data[p.pos], c)
+	}
+	p.pos++
+	return nil
+}
+
+// peek returns the next character after any whitespace, or 0 at the end of
+// the input.
+func (p *extJSONParser) peek() byte {
+	p.skipSpace()
+	if p.pos >= len(p.data) {
+		return 0
+	}
+	return p.data[p.pos]
+}
+
+func (p *extJSONParser) parseValue() (interface{}, error) {
+	c := p.peek()
+	switch {
+	case c == '{':
+		return p.parseObject()
+	case c == '[':
+		return p.parseArray()
+	case c == '"' || p.shell && c == '\'':
+		return p.parseString()
+	case p.shell && c == '/':
+		return p.parseRegEx()
+	case c == '-' || c >= '0' && c <= '9':
+		return p.parseNumber()
+	case isIdentStart(c):
+		return p.parseIdent()
+	case c == 0:
+		return nil, p.errorf("unexpected end of input")
+	default:
+		return nil, p.errorf("invalid character %q looking for beginning of value", c)
+	}
+}
+
+func (p *extJSONParser) parseObject() (interface{}, error) {
+	start := p.pos
+	if err := p.expect('{'); err != nil {
+		return nil, err
+	}
+
+	doc := D{}
+	if p.peek() == '}' {
+		p.pos++
+		return doc, nil
+	}
+
+	for {
+		key, err := p.parseKey()
+		if err != nil {
+			return nil, err
+		}
+
+		if err := p.expect(':'); err != nil {
+			return nil, err
+		}
+
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		doc = append(doc, DocElem{key, value})
+
+		if p.peek() == ',' {
+			p.pos++
+			if !p.trailingComma('}') {
+				continue
+			}
+		}
+
+		switch p.peek() {
+		case '}':
+			p.pos++
+			if p.shell {
+				return doc, nil
+			}
+
+			v, err := extJSONWrapper(doc)
+			if err != nil {
+				return nil, p.errorAt(start, "%s", err)
+			}
+			return v, nil
+		case 0:
+			return nil, p.errorf("unexpected end of input in object")
+		default:
+			return nil, p.errorf("invalid character %q after object key:value pair", p.data[p.pos])
+		}
+	}
+}
+
+// parseKey parses an object key, which in the mongo shell syntax may also be
+// single-quoted or unquoted.
+func (p *extJSONParser) parseKey() (string, error) {
+	c := p.peek()
+	switch {
+	case c == '"' || p.shell && c == '\'':
+		return p.parseString()
+	case p.shell && isIdentChar(c):
+		return p.scanIdent(), nil
+	case c == 0:
+		return "", p.errorf("unexpected end of input, expected object key")
+	default:
+		return "", p.errorf("invalid character %q looking for beginning of object key string", c)
+	}
+}
+
+// trailingComma reports whether the comma that was just consumed is
+// followed by the close character, which the mongo shell syntax allows.
+func (p *extJSONParser) trailingComma(close byte) bool {
+	return p.shell && p.peek() == close
+}
+
+func (p *extJSONParser) parseArray() (interface{}, error) {
+	if err := p.expect('['); err != nil {
+		return nil, err
+	}
+
+	a := A{}
+	if p.peek() == ']' {
+		p.pos++
+		return a, nil
+	}
+
+	for {
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		a = append(a, value)
+
+		if p.peek() == ',' {
+			p.pos++
+			if !p.trailingComma(']') {
+				continue
+			}
+		}
+
+		switch p.peek() {
+		case ']':
+			p.pos++
+			return a, nil
+		case 0:
+			return nil, p.errorf("unexpected end of input in array")
+		default:
+			return nil, p.errorf("invalid character %q after array element", p.data[p.pos])
+		}
+	}
+}
+
+// parseString parses a double-quoted string, or a single-quoted one in the
+// mongo shell syntax.
+func (p *extJSONParser) parseString() (string, error) {
+	quote := p.peek()
+	if quote != '\'' || !p.shell {
+		quote = '"'
+	}
+	if err := p.expect(quote); err != nil {
+		return "", err
+	}
+
+	var b []byte
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		switch {
+		case c == quote:
+			p.pos++
+			return string(b), nil
+		case c == '\\':
+			p.pos++
+			if p.pos >= len(p.data) {
+				return "", p.errorf("unexpected end of input in string")
+			}
+
+			switch c := p.data[p.pos]; c {
+			case '"', '\\', '/':
+				b = append(b, c)
+			case '\'':
+				if !p.shell {
+					return "", p.errorf("invalid escape character %q in string", c)
+				}
+				b = append(b, c)
+			case 'b':
+				b = append(b, '\b')
+			case 'f':
+				b = append(b, '\f')
+			case 'n':
+				b = append(b, '\n')
+			case 'r':
+				b = append(b, '\r')
+			case 't':
+				b = append(b, '\t')
+			case 'u':
+				r, err := p.parseUnicodeEscape()
+				if err != nil {
+					return "", err
+				}
+				b = append(b, string(r)...)
+				continue
+			default:
+				return "", p.errorf("invalid escape character %q in string", c)
+			}
+			p.pos++
+		case c < 0x20:
+			return "", p.errorf("invalid control character %q in string", c)
+		default:
+			b = append(b, c)
+			p.pos++
+		}
+	}
+
+	return "", p.errorf("unexpected end of input in string")
+}
+
+// parseUnicodeEscape parses the \uXXXX escape at the current position, which
+// is just after the backslash, combining surrogate pairs. A surrogate that
+// isn't part of a pair is replaced by U+FFFD.
+func (p *extJSONParser) parseUnicodeEscape() (rune, error) {
+	r, err := p.parseHex4()
+	if err != nil {
+		return 0, err
+	}
+
+	if !utf16.IsSurrogate(r) {
+		return r, nil
+	}
+	if r >= 0xDC00 {
+		// A low surrogate without a high one before it.
+		return utf8.RuneError, nil
+	}
+
+	if p.pos+1 < len(p.data) && p.data[p.pos] == '\\' && p.data[p.pos+1] == 'u' {
+		start := p.pos
+		p.pos++
+		r2, err := p.parseHex4()
+		if err == nil && r2 >= 0xDC00 && r2 <= 0xDFFF {
+			return utf16.DecodeRune(r, r2), nil
+		}
+		// The next escape isn't a low surrogate, so it's parsed as a
+		// character of its own.
+		p.pos = start
+	}
+	return utf8.RuneError, nil
+}
+
+func (p *extJSONParser) parseHex4() (rune, error) {
+	// Skip the 'u'.
+	if p.pos+5 > len(p.data) {
+		return 0, p.errorf("invalid unicode escape in string")
+	}
+
+	v, err := strconv.ParseUint(string(p.data[p.pos+1:p.pos+5]), 16, 16)
+	if err != nil {
+		return 0, p.errorf("invalid unicode escape in string")
+	}
+
+	p.pos += 5
+	return rune(v), nil
+}
+
+// parseNumber parses a JSON number. Integers are returned as int32 when
+// they fit, and as int64 otherwise; numbers with a fraction or an exponent,
+// and integers too large for an int64, are returned as float64.
+func (p *extJSONParser) parseNumber() (interface{}, error) {
+	start := p.pos
+	if p.data[p.pos] == '-' {
+		p.pos++
+		if p.shell && p.pos < len(p.data) && p.data[p.pos] == 'I' {
+			if p.scanIdent() != "Infinity" {
+				return nil, p.errorAt(start, "invalid number")
+			}
+			return math.Inf(-1), nil
+		}
+	}
+
+	intStart := p.pos
+	digits := p.skipDigits()
+	if digits == 0 || digits > 1 && p.data[intStart] == '0' {
+		return nil, p.errorAt(start, "invalid number")
+	}
+
+	float := false
+	if p.pos < len(p.data) && p.data[p.pos] == '.' {
+		float = true
+		p.pos++
+		if p.skipDigits() == 0 {
+			return nil, p.errorf("invalid number")
+		}
+	}
+	if p.pos < len(p.data) && (p.data[p.pos] == 'e' || p.data[p.pos] == 'E') {
+		float = true
+		p.pos++
+		if p.pos < len(p.data) && (p.data[p.pos] == '+' || p.data[p.pos] == '-') {
+			p.pos++
+		}
+		if p.skipDigits() == 0 {
+			return nil, p.errorf("invalid number")
+		}
+	}
+
+	s := string(p.data[start:p.pos])
+	if !float {
+		if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+			if i >= math.MinInt32 && i <= math.MaxInt32 {
+				return int32(i), nil
+			}
+			return i, nil
+		}
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return nil, p.errorAt(start, "invalid number %s", s)
+	}
+	return f, nil
+}
+
+func (p *extJSONParser) skipDigits() int {
+	start := p.pos
+	for p.pos < len(p.data) && p.data[p.pos] >= '0' && p.data[p.pos] <= '9' {
+		p.pos++
+	}
+	return p.pos - start
+}
+
+func isIdentStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == '$'
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || c >= '0' && c <= '9'
+}
+
+func (p *extJSONParser) scanIdent() string {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.data) && isIdentChar(p.data[p.pos]) {
+		p.pos++
+	}
+	return string(p.data[start:p.pos])
+}
+
+// parseIdent parses the literals true, false and null, and the mongo shell
+// constructors that mgo accepted in JSON.
+func (p *extJSONParser) parseIdent() (interface{}, error) {
+	start := p.pos
+	name := p.scanIdent()
+
+	switch name {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	case "undefined":
+		return Undefined, nil
+	case "MinKey", "MaxKey":
+		if p.peek() == '(' {
+			if _, err := p.parseArgs(); err != nil {
+				return nil, err
+			}
+		}
+		if name == "MinKey" {
+			return MinKey, nil
+		}
+		return MaxKey, nil
+	case "Infinity", "NaN":
+		if p.shell {
+			if name == "NaN" {
+				return math.NaN(), nil
+			}
+			return math.Inf(1), nil
+		}
+	case "new":
+		start = p.pos
+		name = p.scanIdent()
+		if name != "Date" && name != "ISODate" && !p.shell {
+			return nil, p.errorAt(start, "invalid constructor %q after new", name)
+		}
+	}
+
+	if p.peek() != '(' {
+		return nil, p.errorAt(start, "invalid literal %q", name)
+	}
+
+	args, err := p.parseArgs()
+	if err != nil {
+		return nil, err
+	}
+
+	var v interface{}
+	if p.shell {
+		v, err = shellConstructor(name, args)
+	} else {
+		v, err = extJSONConstructor(name, args)
+	}
+	if err != nil {
+		return nil, p.errorAt(start, "%s", err)
+	}
+	return v, nil
+}
+
+// parseArgs parses a parenthesized list of comma separated values.
+func (p *extJSONParser) parseArgs() ([]interface{}, error) {
+	if err := p.expect('('); err != nil {
+		return nil, err
+	}
+
+	var args []interface{}
+	if p.peek() == ')' {
+		p.pos++
+		return args, nil
+	}
+
+	for {
+		arg, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+
+		if p.peek() == ',' {
+			p.pos++
+			if !p.trailingComma(')') {
+				continue
+			}
+		}
+
+		switch p.peek() {
+		case ')':
+			p.pos++
+			return args, nil
+		case 0:
+			return nil, p.errorf("unexpected end of input in arguments")
+		default:
+			return nil, p.errorf("invalid character %q after argument", p.data[p.pos])
+		}
+	}
+}
+
+// extJSONConstructor returns the value built by the mongo shell constructor
+// name when called with args.
+func extJSONConstructor(name string, args []interface{}) (interface{}, error) {
+	switch name {
+	case "ObjectId":
+		if len(args) == 1 {
+			if s, ok := args[0].(string); ok && IsObjectIdHex(s) {
+				return ObjectIdHex(s), nil
+			}
+		}
+		return nil, fmt.Errorf("ObjectId needs a hex string with 24 digits")
+	case "NumberInt":
+		if len(args) == 1 {
+			if i, ok := extJSONInt(args[0], 32); ok {
+				return int32(i), nil
+			}
+		}
+		return nil, fmt.Errorf("NumberInt needs a 32-bit integer")
+	case "NumberLong":
+		if len(args) == 1 {
+			if i, ok := extJSONInt(args[0], 64); ok {
+				return i, nil
+			}
+		}
+		return nil, fmt.Errorf("NumberLong needs a 64-bit integer")
+	case "NumberDecimal":
+		if len(args) == 1 {
+			var s string
+			switch v := args[0].(type) {
+			case string:
+				s = v
+			case int32, int64:
+				s = fmt.Sprint(v)
+			}
+			if d, err := ParseDecimal128(s); err == nil && s != "" {
+				return d, nil
+			}
+		}
+		return nil, fmt.Errorf("NumberDecimal needs a decimal string")
+	case "ISODate", "Date":
+		if len(args) == 1 {
+			switch v := args[0].(type) {
+			case string:
+				return parseExtJSONDate(v)
+			default:
+				if ms, ok := extJSONInt(v, 64); ok {
+					return extJSONTime(ms), nil
+				}
+				if f, ok := v.(float64); ok {
+					return extJSONTime(int64(f)), nil
+				}
+			}
+		}
+		return nil, fmt.Errorf("%s needs a date string or milliseconds since the epoch", name)
+	case "Timestamp":
+		if len(args) == 2 {
+			t, ok1 := extJSONInt(args[0], 64)
+			i, ok2 := extJSONInt(args[1], 64)
+			if ok1 && ok2 && t >= 0 && t <= math.MaxUint32 && i >= 0 && i <= math.MaxUint32 {
+				return MongoTimestamp(t<<32 | i), nil
+			}
+		}
+		return nil, fmt.Errorf("Timestamp needs two 32-bit unsigned integers")
+	case "BinData":
+		if len(args) == 2 {
+			kind, ok := extJSONInt(args[0], 64)
+			s, ok2 := args[1].(string)
+			if ok && ok2 && kind >= 0 && kind <= 0xff {
+				return extJSONBinary(byte(kind), s)
+			}
+		}
+		return nil, fmt.Errorf("BinData needs a subtype and a base64 string")
+	default:
+		return nil, fmt.Errorf("unknown constructor %q", name)
+	}
+}
+
+// extJSONWrapper converts doc into the value it represents if it's one of
+// the Extended JSON type wrappers, such as {"$oid": "..."}, and returns doc
+// unchanged otherwise.
+func extJSONWrapper(doc D) (interface{}, error) {
+	if len(doc) == 0 || len(doc) > 2 || !strings.HasPrefix(doc[0].Name, "$") {
+		return doc, nil
+	}
+
+	if len(doc) == 2 {
+		first, second := doc[0], doc[1]
+		if second.Name < first.Name {
+			first, second = second, first
+		}
+
+		switch {
+		case first.Name == "$code" && second.Name == "$scope":
+			code, ok := first.Value.(string)
+			scope, ok2 := second.Value.(D)
+			if !ok || !ok2 {
+				return nil, fmt.Errorf("invalid $code with $scope")
+			}
+			return JavaScript{Code: code, Scope: scope}, nil
+		case first.Name == "$binary" && second.Name == "$type":
+			data, ok := first.Value.(string)
+			kind, ok2 := second.Value.(string)
+			if !ok || !ok2 {
+				return doc, nil
+			}
+			k, err := strconv.ParseUint(kind, 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid $type %q for $binary", kind)
+			}
+			return extJSONBinary(byte(k), data)
+		case first.Name == "$options" && second.Name == "$regex":
+			pattern, ok := second.Value.(string)
+			options, ok2 := first.Value.(string)
+			if !ok || !ok2 {
+				return doc, nil
+			}
+			return RegEx{Pattern: pattern, Options: options}, nil
+		}
+		return doc, nil
+	}
+
+	value := doc[0].Value
+	switch doc[0].Name {
+	case "$oid":
+		if s, ok := value.(string); ok && IsObjectIdHex(s) {
+			return ObjectIdHex(s), nil
+		}
+		return nil, fmt.Errorf("invalid $oid")
+	case "$symbol":
+		if s, ok := value.(string); ok {
+			return Symbol(s), nil
+		}
+		return nil, fmt.Errorf("invalid $symbol")
+	case "$numberInt":
+		if s, ok := value.(string); ok {
+			if i, err := strconv.ParseInt(s, 10, 32); err == nil {
+				return int32(i), nil
+			}
+		}
+		return nil, fmt.Errorf("invalid $numberInt")
+	case "$numberLong":
+		if s, ok := value.(string); ok {
+			if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+				return i, nil
+			}
+		}
+		return nil, fmt.Errorf("invalid $numberLong")
+	case "$numberDouble":
+		if s, ok := value.(string); ok {
+			switch s {
+			case "Infinity":
+				return math.Inf(1), nil
+			case "-Infinity":
+				return math.Inf(-1), nil
+			case "NaN":
+				return math.NaN(), nil
+			}
+			if f, err := strconv.ParseFloat(s, 64); err == nil {
+				return f, nil
+			}
+		}
+		return nil, fmt.Errorf("invalid $numberDouble")
+	case "$numberDecimal":
+		if s, ok := value.(string); ok {
+			if d, err := ParseDecimal128(s); err == nil {
+				return d, nil
+			}
+		}
+		return nil, fmt.Errorf("invalid $numberDecimal")
+	case "$binary":
+		if sub, ok := value.(D); ok && len(sub) == 2 {
+			m := extJSONFields(sub)
+			data, ok := m["base64"].(string)
+			kind, ok2 := m["subType"].(string)
+			if ok && ok2 {
+				if k, err := strconv.ParseUint(kind, 16, 8); err == nil && len(kind) <= 2 {
+					return extJSONBinary(byte(k), data)
+				}
+			}
+		}
+		return nil, fmt.Errorf("invalid $binary")
+	case "$code":
+		if s, ok := value.(string); ok {
+			return JavaScript{Code: s}, nil
+		}
+		return nil, fmt.Errorf("invalid $code")
+	case "$timestamp":
+		if sub, ok := value.(D); ok && len(sub) == 2 {
+			m := extJSONFields(sub)
+			t, ok := extJSONInt(m["t"], 64)
+			i, ok2 := extJSONInt(m["i"], 64)
+			if ok && ok2 && t >= 0 && t <= math.MaxUint32 && i >= 0 && i <= math.MaxUint32 {
+				return MongoTimestamp(t<<32 | i), nil
+			}
+		}
+		return nil, fmt.Errorf("invalid $timestamp")
+	case "$regularExpression":
+		if sub, ok := value.(D); ok && len(sub) == 2 {
+			m := extJSONFields(sub)
+			pattern, ok := m["pattern"].(string)
+			options, ok2 := m["options"].(string)
+			if ok && ok2 {
+				return RegEx{Pattern: pattern, Options: options}, nil
+			}
+		}
+		return nil, fmt.Errorf("invalid $regularExpression")
+	case "$dbPointer":
+		if sub, ok := value.(D); ok && len(sub) == 2 {
+			m := extJSONFields(sub)
+			ns, ok := m["$ref"].(string)
+			id, ok2 := m["$id"].(ObjectId)
+			if ok && ok2 {
+				return DBPointer{Namespace: ns, Id: id}, nil
+			}
+		}
+		return nil, fmt.Errorf("invalid $dbPointer")
+	case "$date":
+		switch v := value.(type) {
+		case string:
+			return parseExtJSONDate(v)
+		case int32:
+			return extJSONTime(int64(v)), nil
+		case int64:
+			return extJSONTime(v), nil
+		case float64:
+			return extJSONTime(int64(v)), nil
+		}
+		return nil, fmt.Errorf("invalid $date")
+	case "$minKey":
+		if i, ok := value.(int32); ok && i == 1 {
+			return MinKey, nil
+		}
+		return nil, fmt.Errorf("invalid $minKey")
+	case "$maxKey":
+		if i, ok := value.(int32); ok && i == 1 {
+			return MaxKey, nil
+		}
+		return nil, fmt.Errorf("invalid $maxKey")
+	case "$undefined":
+		if b, ok := value.(bool); ok && b {
+			return Undefined, nil
+		}
+		return nil, fmt.Errorf("invalid $undefined")
+	}
+
+	return doc, nil
+}
+
+// extJSONFields returns the elements of doc by name.
+func extJSONFields(doc D) map[string]interface{} {
+	m := make(map[string]interface{}, len(doc))
+	for _, elem := range doc {
+		m[elem.Name] = elem.Value
+	}
+	return m
+}
+
+// extJSONInt returns v as an int64 if it's an integer, or a string holding
+// one, that fits in the given number of bits.
+func extJSONInt(v interface{}, bits int) (int64, bool) {
+	var i int64
+	switch v := v.(type) {
+	case int32:
+		i = int64(v)
+	case int64:
+		i = v
+	case string:
+		var err error
+		i, err = strconv.ParseInt(v, 10, bits)
+		return i, err == nil
+	default:
+		return 0, false
+	}
+
+	if bits == 32 && (i < math.MinInt32 || i > math.MaxInt32) {
+		return 0, false
+	}
+	return i, true
+}
+
+func extJSONTime(ms int64) time.Time {
+	if ms == zeroTimeMillis {
+		return time.Time{}
+	}
+	return time.Unix(ms/1e3, ms%1e3*1e6).UTC()
+}
+
+var extJSONDateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999Z0700",
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02",
+}
+
+func parseExtJSONDate(s string) (time.Time, error) {
+	for _, layout := range extJSONDateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q", s)
+}
+
+func extJSONBinary(kind byte, s string) (interface{}, error) {
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64 data in binary value: %v", err)
+	}
+	if kind == 0x00 {
+		return data, nil
+	}
+	return Binary{Kind: kind, Data: data}, nil
+}
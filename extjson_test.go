@@ -0,0 +1,241 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+//
+// Based on gopkg.in/mgo.v2/bson by Gustavo Niemeyer
+// See THIRD-PARTY-NOTICES for original license terms.
+
+package mgobson_test
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/mongodb-labs/mgobson"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtJSON(t *testing.T) {
+	oid := mgobson.ObjectIdHex("5a4af6a50000000000000001")
+	dec, err := mgobson.ParseDecimal128("1.50")
+	require.NoError(t, err)
+	date := time.Date(2018, 1, 2, 3, 4, 5, 6e6, time.UTC)
+
+	testCases := []struct {
+		name      string
+		value     interface{}
+		canonical string
+		relaxed   string
+	}{
+		{"string", "a\"b\n\x01é", `"a\"b\n\u0001é"`, `"a\"b\n\u0001é"`},
+		{"int32", int32(-5), `{"$numberInt":"-5"}`, `-5`},
+		{"int64", int64(1 << 40), `{"$numberLong":"1099511627776"}`, `1099511627776`},
+		{"double", 1.0, `{"$numberDouble":"1.0"}`, `1.0`},
+		{"double fraction", -2.5, `{"$numberDouble":"-2.5"}`, `-2.5`},
+		{"double exponent", 1e100, `{"$numberDouble":"1E+100"}`, `1E+100`},
+		{"double infinity", math.Inf(-1), `{"$numberDouble":"-Infinity"}`, `{"$numberDouble":"-Infinity"}`},
+		{"decimal", dec, `{"$numberDecimal":"1.50"}`, `{"$numberDecimal":"1.50"}`},
+		{"bool", true, `true`, `true`},
+		{"null", nil, `null`, `null`},
+		{"objectid", oid, `{"$oid":"5a4af6a50000000000000001"}`, `{"$oid":"5a4af6a50000000000000001"}`},
+		{"binary", []byte{1, 2, 3}, `{"$binary":{"base64":"AQID","subType":"00"}}`, `{"$binary":{"base64":"AQID","subType":"00"}}`},
+		{"binary subtype", mgobson.Binary{Kind: 0x80, Data: []byte{1}}, `{"$binary":{"base64":"AQ==","subType":"80"}}`, `{"$binary":{"base64":"AQ==","subType":"80"}}`},
+		{"date", date, `{"$date":{"$numberLong":"1514862245006"}}`, `{"$date":"2018-01-02T03:04:05.006Z"}`},
+		{"date before epoch", time.Date(1969, 12, 31, 23, 59, 59, 0, time.UTC), `{"$date":{"$numberLong":"-1000"}}`, `{"$date":{"$numberLong":"-1000"}}`},
+		{"regex", mgobson.RegEx{Pattern: "a/b", Options: "ix"}, `{"$regularExpression":{"pattern":"a/b","options":"ix"}}`, `{"$regularExpression":{"pattern":"a/b","options":"ix"}}`},
+		{"dbpointer", mgobson.DBPointer{Namespace: "db.c", Id: oid}, `{"$dbPointer":{"$ref":"db.c","$id":{"$oid":"5a4af6a50000000000000001"}}}`, `{"$dbPointer":{"$ref":"db.c","$id":{"$oid":"5a4af6a50000000000000001"}}}`},
+		{"code", mgobson.JavaScript{Code: "f()"}, `{"$code":"f()"}`, `{"$code":"f()"}`},
+		{"code with scope", mgobson.JavaScript{Code: "f()", Scope: mgobson.D{{"z", int32(1)}, {"a", int32(2)}}}, `{"$code":"f()","$scope":{"z":{"$numberInt":"1"},"a":{"$numberInt":"2"}}}`, `{"$code":"f()","$scope":{"z":1,"a":2}}`},
+		{"symbol", mgobson.Symbol("s"), `{"$symbol":"s"}`, `{"$symbol":"s"}`},
+		{"timestamp", mgobson.MongoTimestamp(5<<32 | 6), `{"$timestamp":{"t":5,"i":6}}`, `{"$timestamp":{"t":5,"i":6}}`},
+		{"undefined", mgobson.Undefined, `{"$undefined":true}`, `{"$undefined":true}`},
+		{"minkey", mgobson.MinKey, `{"$minKey":1}`, `{"$minKey":1}`},
+		{"maxkey", mgobson.MaxKey, `{"$maxKey":1}`, `{"$maxKey":1}`},
+		{"document", mgobson.D{{"b", int32(1)}, {"a", mgobson.A{"x", int32(2)}}}, `{"b":{"$numberInt":"1"},"a":["x",{"$numberInt":"2"}]}`, `{"b":1,"a":["x",2]}`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			in := mgobson.D{{"v", tc.value}}
+
+			canonical, err := mgobson.MarshalExtJSON(in, true)
+			require.NoError(t, err)
+			require.Equal(t, `{"v":`+tc.canonical+`}`, string(canonical))
+
+			relaxed, err := mgobson.MarshalExtJSON(in, false)
+			require.NoError(t, err)
+			require.Equal(t, `{"v":`+tc.relaxed+`}`, string(relaxed))
+
+			expected, err := in.MarshalBSON()
+			require.NoError(t, err)
+
+			var raw mgobson.RawD
+			require.NoError(t, mgobson.UnmarshalExtJSON(canonical, &raw))
+			actual, err := raw.MarshalBSON()
+			require.NoError(t, err)
+			require.Equal(t, expected, actual)
+		})
+	}
+
+	t.Run("order", func(t *testing.T) {
+		in := `{"z":1,"y":{"b":2,"a":3},"x":[{"d":4,"c":5}]}`
+
+		var d mgobson.D
+		require.NoError(t, mgobson.UnmarshalExtJSON([]byte(in), &d))
+		require.Equal(t, mgobson.D{
+			{"z", int32(1)},
+			{"y", mgobson.D{{"b", int32(2)}, {"a", int32(3)}}},
+			{"x", []interface{}{mgobson.D{{"d", int32(4)}, {"c", int32(5)}}}},
+		}, d)
+
+		out, err := mgobson.MarshalExtJSON(d, false)
+		require.NoError(t, err)
+		require.Equal(t, in, string(out))
+
+		var raw mgobson.RawD
+		require.NoError(t, mgobson.UnmarshalExtJSON([]byte(in), &raw))
+		out, err = mgobson.MarshalExtJSON(raw, false)
+		require.NoError(t, err)
+		require.Equal(t, in, string(out))
+	})
+
+	t.Run("relaxed numbers", func(t *testing.T) {
+		var m mgobson.M
+		require.NoError(t, mgobson.UnmarshalExtJSON([]byte(`{"a":1,"b":4294967296,"c":1.5,"d":1e2,"e":-0.0,"f":99999999999999999999}`), &m))
+		require.Equal(t, mgobson.M{
+			"a": int32(1),
+			"b": int64(4294967296),
+			"c": 1.5,
+			"d": 100.0,
+			"e": math.Copysign(0, -1),
+			"f": 1e20,
+		}, m)
+	})
+
+	t.Run("legacy", func(t *testing.T) {
+		in := `{
+			"oid": ObjectId("5a4af6a50000000000000001"),
+			"oid2": {"$oid": "5a4af6a50000000000000001"},
+			"bin": {"$binary": "AQID", "$type": "80"},
+			"bin2": BinData(0, "AQID"),
+			"date": {"$date": 1514862245006},
+			"date2": ISODate("2018-01-02T03:04:05.006Z"),
+			"date3": new Date(1514862245006),
+			"regex": {"$regex": "^a", "$options": "i"},
+			"long": NumberLong(5),
+			"long2": NumberLong("6"),
+			"int": NumberInt(7),
+			"dec": NumberDecimal("1.50"),
+			"ts": Timestamp(5, 6),
+			"keys": [MinKey, MaxKey(), undefined],
+			"query": {"$gt": 1, "$type": "string"}
+		}`
+
+		var d mgobson.D
+		require.NoError(t, mgobson.UnmarshalExtJSON([]byte(in), &d))
+		require.Equal(t, mgobson.D{
+			{"oid", oid},
+			{"oid2", oid},
+			{"bin", mgobson.Binary{Kind: 0x80, Data: []byte{1, 2, 3}}},
+			{"bin2", []byte{1, 2, 3}},
+			{"date", date},
+			{"date2", date},
+			{"date3", date},
+			{"regex", mgobson.RegEx{Pattern: "^a", Options: "i"}},
+			{"long", int64(5)},
+			{"long2", int64(6)},
+			{"int", int32(7)},
+			{"dec", dec},
+			{"ts", mgobson.MongoTimestamp(5<<32 | 6)},
+			{"keys", []interface{}{mgobson.MinKey, mgobson.MaxKey, mgobson.Undefined}},
+			{"query", mgobson.D{{"$gt", int32(1)}, {"$type", "string"}}},
+		}, normalizeTimes(d))
+	})
+
+	t.Run("struct", func(t *testing.T) {
+		var s roundTripType
+		require.NoError(t, mgobson.UnmarshalExtJSON([]byte(`{"_id":{"$oid":"5a4af6a50000000000000001"},"created":{"$date":"2018-01-02T03:04:05.006Z"},"count":{"$numberLong":"7"}}`), &s))
+		require.Equal(t, oid, s.Id)
+		require.True(t, date.Equal(s.Created))
+		require.Equal(t, int64(7), s.Count)
+
+		out, err := mgobson.MarshalExtJSON(&s, false)
+		require.NoError(t, err)
+		require.Equal(t, `{"_id":{"$oid":"5a4af6a50000000000000001"},"created":{"$date":"2018-01-02T03:04:05.006Z"},"count":7}`, string(out))
+	})
+
+	t.Run("surrogates", func(t *testing.T) {
+		testCases := []struct {
+			in       string
+			expected string
+		}{
+			{`"\ud83d\ude00"`, "\U0001F600"},
+			{`"\ud800\u0041"`, "\uFFFDA"},
+			{`"\ud800\ud83d\ude00"`, "\uFFFD\U0001F600"},
+			{`"\ud800x"`, "\uFFFDx"},
+			{`"\ud800"`, "\uFFFD"},
+			{`"\udc00"`, "\uFFFD"},
+			{`"\udc00\u0041"`, "\uFFFDA"},
+			{`"\ude00\ud83d\ude00"`, "\uFFFD\U0001F600"},
+		}
+
+		for _, tc := range testCases {
+			var d mgobson.D
+			require.NoError(t, mgobson.UnmarshalExtJSON([]byte(`{"a":`+tc.in+`}`), &d), tc.in)
+			require.Equal(t, mgobson.D{{"a", tc.expected}}, d, tc.in)
+		}
+
+		var d mgobson.D
+		require.Error(t, mgobson.UnmarshalExtJSON([]byte(`{"a":"\ud800\u00"}`), &d))
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		invalid := []string{
+			``,
+			`[]`,
+			`"a"`,
+			`{"a":1`,
+			`{"a":1,}`,
+			`{a:1}`,
+			`{"a":tru}`,
+			`{"a":"\x"}`,
+			`{"a":01}`,
+			`{"a":1} x`,
+			`{"a":{"$oid":"xyz"}}`,
+			`{"a":{"$numberInt":"3000000000"}}`,
+			`{"a":{"$binary":{"base64":"!","subType":"00"}}}`,
+			`{"a":{"$date":true}}`,
+			`{"a":ObjectId(1)}`,
+			`{"a":Foo(1)}`,
+			`{"a":{"$oid":"5a4af6a50000000000000001"}`,
+		}
+
+		for _, in := range invalid {
+			var d mgobson.D
+			require.Error(t, mgobson.UnmarshalExtJSON([]byte(in), &d), in)
+		}
+
+		var d mgobson.D
+		err := mgobson.UnmarshalExtJSON([]byte("{\n  \"a\": 1,\n  \"b\": ?\n}"), &d)
+		require.Equal(t, &mgobson.SyntaxError{
+			Msg:    `invalid character '?' looking for beginning of value`,
+			Offset: 19,
+			Line:   3,
+			Column: 8,
+		}, err)
+	})
+}
+
+// normalizeTimes converts the time.Time values of d to UTC, so that they can
+// be compared with require.Equal.
+func normalizeTimes(d mgobson.D) mgobson.D {
+	for i, elem := range d {
+		if t, ok := elem.Value.(time.Time); ok {
+			d[i].Value = t.UTC()
+		}
+	}
+	return d
+}
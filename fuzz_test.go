@@ -0,0 +1,191 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+//
+// Based on gopkg.in/mgo.v2/bson by Gustavo Niemeyer
+// See THIRD-PARTY-NOTICES for original license terms.
+
+package mgobson_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/mongodb-labs/mgobson"
+	"github.com/stretchr/testify/require"
+)
+
+type fuzzType struct {
+	Id     mgobson.ObjectId `bson:"_id"`
+	Name   string
+	Count  int64
+	Nested *inlineBase
+	Tags   []string
+	Extra  mgobson.M `bson:",inline"`
+}
+
+// fuzzSeeds returns valid documents covering every BSON kind, for the fuzz
+// tests to mutate.
+func fuzzSeeds(t testing.TB) [][]byte {
+	dec, err := mgobson.ParseDecimal128("1.50")
+	require.NoError(t, err)
+
+	docs := []mgobson.D{
+		{},
+		{{"name", "n"}, {"count", int64(7)}, {"nested", mgobson.D{{"x", int32(1)}}}, {"tags", mgobson.A{"a", "b"}}},
+		{
+			{"double", 1.5},
+			{"string", "s"},
+			{"document", mgobson.D{{"a", mgobson.D{{"b", mgobson.A{mgobson.D{}}}}}}},
+			{"binary", mgobson.Binary{Kind: 0x02, Data: []byte{1, 2}}},
+			{"undefined", mgobson.Undefined},
+			{"objectid", mgobson.ObjectIdHex("5a4af6a50000000000000001")},
+			{"bool", true},
+			{"date", time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)},
+			{"null", nil},
+			{"regex", mgobson.RegEx{Pattern: "^a", Options: "i"}},
+			{"dbpointer", mgobson.DBPointer{Namespace: "db.c", Id: mgobson.ObjectIdHex("5a4af6a50000000000000001")}},
+			{"code", mgobson.JavaScript{Code: "f()"}},
+			{"symbol", mgobson.Symbol("s")},
+			{"scope", mgobson.JavaScript{Code: "f()", Scope: mgobson.D{{"a", int32(1)}}}},
+			{"int32", int32(1)},
+			{"timestamp", mgobson.MongoTimestamp(1)},
+			{"int64", int64(1)},
+			{"decimal", dec},
+			{"minkey", mgobson.MinKey},
+			{"maxkey", mgobson.MaxKey},
+		},
+		{{"nan", math.NaN()}, {"nested", mgobson.D{{"a", mgobson.A{math.NaN()}}}}},
+	}
+
+	var seeds [][]byte
+	for _, doc := range docs {
+		b, err := doc.MarshalBSON()
+		require.NoError(t, err)
+		seeds = append(seeds, b)
+	}
+	return seeds
+}
+
+// unmarshalAll decodes b in every way this package supports. Errors are
+// expected for most inputs, panics never are.
+func unmarshalAll(b []byte) {
+	var m mgobson.M
+	_ = m.UnmarshalBSON(b)
+	_ = m.UnmarshalBSONWithMode(b, mgobson.MgoDecodeMode)
+
+	var d mgobson.D
+	_ = d.UnmarshalBSON(b)
+	_ = d.UnmarshalBSONWithMode(b, mgobson.MgoDecodeMode)
+
+	// Decoding into storage that holds a previous document reuses it.
+	into := mgobson.D{{"document", mgobson.D{{"a", mgobson.M{}}}}, {"string", mgobson.A{"s"}}}
+	_ = into.UnmarshalBSONInto(b)
+	_ = into.UnmarshalBSONIntoWithMode(b, mgobson.MgoDecodeMode)
+	intoM := mgobson.M{"a": int32(1)}
+	_ = intoM.UnmarshalBSONInto(b)
+	var intoR mgobson.RawD
+	_ = intoR.UnmarshalBSONInto(b)
+
+	var s fuzzType
+	_ = mgobson.Unmarshal(b, &s)
+
+	var i interface{}
+	_ = mgobson.Unmarshal(b, &i)
+
+	raw := mgobson.Raw{Kind: 0x03, Data: b}
+	_ = raw.Unmarshal(&i)
+	if elems, err := raw.Document(); err == nil {
+		for _, elem := range elems {
+			_ = elem.Value.Unmarshal(&i)
+			_, _ = elem.Value.Array()
+			_ = elem.Value.Validate()
+		}
+	}
+
+	_, _ = mgobson.Lookup(b, "document", "a", "b", "0")
+	_, _ = mgobson.Lookup(b, "scope", "a")
+}
+
+func FuzzUnmarshal(f *testing.F) {
+	for _, seed := range fuzzSeeds(f) {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		unmarshalAll(b)
+
+		var r mgobson.RawD
+		if err := r.UnmarshalBSON(b); err != nil {
+			return
+		}
+
+		// The elements of a RawD are re-encoded as they were decoded.
+		n := int(binary.LittleEndian.Uint32(b))
+		actual, err := r.MarshalBSON()
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(b[:n], actual))
+
+		// Decoding into reused storage gives the same values. They're
+		// compared by their encoding, since a NaN isn't equal to itself.
+		var expected, into mgobson.D
+		require.NoError(t, expected.UnmarshalBSON(b))
+		require.NoError(t, into.UnmarshalBSONInto(b))
+		require.NoError(t, into.UnmarshalBSONInto(b))
+		eb, eerr := expected.MarshalBSON()
+		ib, ierr := into.MarshalBSON()
+		require.Equal(t, eerr, ierr)
+		require.True(t, bytes.Equal(eb, ib))
+	})
+}
+
+func TestUnmarshalMalformed(t *testing.T) {
+	// Every prefix of a valid document and every single byte change must
+	// be decoded without panicking.
+	for _, seed := range fuzzSeeds(t) {
+		for i := 0; i < len(seed); i++ {
+			unmarshalAll(seed[:i])
+
+			for _, c := range []byte{0x00, 0x01, 0x7F, 0x80, 0xFF} {
+				b := append([]byte(nil), seed...)
+				b[i] = c
+				unmarshalAll(b)
+			}
+		}
+	}
+
+	invalid := [][]byte{
+		nil,
+		{5, 0, 0, 0},
+		{5, 0, 0, 0, 1},
+		{4, 0, 0, 0, 0},
+		{0xFF, 0xFF, 0xFF, 0x7F, 0},
+		{0xFF, 0xFF, 0xFF, 0xFF, 0},
+		{8, 0, 0, 0, 0x0A, 'a', 'b', 0},
+		{7, 0, 0, 0, 0x0A, 'a', 0},
+		{9, 0, 0, 0, 0x10, 'a', 0, 1, 0},
+		{13, 0, 0, 0, 0x02, 'a', 0, 0xFF, 0xFF, 0xFF, 0x7F, 0, 0},
+		{13, 0, 0, 0, 0x02, 'a', 0, 0, 0, 0, 0, 0, 0},
+		{13, 0, 0, 0, 0x03, 'a', 0, 5, 0, 0, 0, 1, 0},
+		{9, 0, 0, 0, 0x42, 'a', 0, 0, 0},
+	}
+
+	for _, b := range invalid {
+		var m mgobson.M
+		require.Error(t, m.UnmarshalBSON(b), "%v", b)
+		var d mgobson.D
+		require.Error(t, d.UnmarshalBSON(b), "%v", b)
+		var r mgobson.RawD
+		require.Error(t, r.UnmarshalBSON(b), "%v", b)
+		require.Error(t, m.UnmarshalBSONInto(b), "%v", b)
+		require.Error(t, d.UnmarshalBSONInto(b), "%v", b)
+		require.Error(t, r.UnmarshalBSONInto(b), "%v", b)
+		var i interface{}
+		require.Error(t, mgobson.Unmarshal(b, &i), "%v", b)
+	}
+}
@@ -0,0 +1,363 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+//
+// Based on gopkg.in/mgo.v2/bson by Gustavo Niemeyer
+// See THIRD-PARTY-NOTICES for original license terms.
+
+package mgobson
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// UnmarshalBSONInto is like UnmarshalBSON, but reuses the storage that d
+// already holds, so that decoding a stream of documents into the same D
+// allocates little once d has grown to their size:
+//
+//	var doc mgobson.D
+//	for _, b := range batch {
+//	    if err := doc.UnmarshalBSONInto(b); err != nil {
+//	        return err
+//	    }
+//	    ...
+//	}
+//
+// The slice of d is reused up to its capacity. When the previous value of
+// the element at the same position is a D or a []interface{}, an
+// embedded document or array is decoded into its storage in the same way,
+// at every depth. Element names and values equal to the ones they replace
+// are kept rather than allocated again, so that decoding documents of the
+// same shape, such as the results of a query, allocates mostly for the
+// values that differ.
+//
+// Unlike UnmarshalBSON, the data of binary values isn't copied: a []byte
+// value and the Data of a Binary value alias b, so b must not be modified
+// or reused while they are in use. All other values, including strings,
+// are copied out of b.
+//
+// Since its storage is overwritten, any part of d, such as an embedded D,
+// that was kept from a previous call must not be used after d is decoded
+// into again. If parts of d share storage, as when the same D is the value
+// of two elements, embedded documents and arrays are decoded into new
+// storage instead. If an error is returned, the contents of d are
+// undefined.
+func (d *D) UnmarshalBSONInto(b []byte) error {
+	return d.UnmarshalBSONIntoWithMode(b, defaultDecodeMode)
+}
+
+// UnmarshalBSONIntoWithMode is like UnmarshalBSONInto, but maps BSON values
+// to Go types as selected by mode instead of the package default.
+func (d *D) UnmarshalBSONIntoWithMode(b []byte, mode DecodeMode) error {
+	dec := newDecoder(mode)
+	dec.alias = true
+	raw, err := dec.check(Raw{Kind: 0x03, Data: b})
+	if err != nil {
+		return rootUnmarshalError(err, 0x03, typeD)
+	}
+
+	old := *d
+	if sharesStorage(d) {
+		// Decoding into one part would overwrite the values decoded
+		// into the others.
+		for i := range old {
+			old[i].Value = nil
+		}
+	}
+
+	newD, err := dec.decodeDInto(old, raw.Data)
+	if err != nil {
+		return rootUnmarshalError(err, 0x03, typeD)
+	}
+
+	*d = newD
+	return nil
+}
+
+// UnmarshalBSONInto is like UnmarshalBSON, but reuses the storage that m
+// already holds, as D.UnmarshalBSONInto does. The map is cleared and refilled,
+// keeping the space it has grown to, and embedded documents are decoded
+// into new values. Binary values alias b, as with D.UnmarshalBSONInto. If an
+// error is returned, the contents of m are undefined.
+func (m *M) UnmarshalBSONInto(b []byte) error {
+	return m.UnmarshalBSONIntoWithMode(b, defaultDecodeMode)
+}
+
+// UnmarshalBSONIntoWithMode is like UnmarshalBSONInto, but maps BSON values
+// to Go types as selected by mode instead of the package default.
+func (m *M) UnmarshalBSONIntoWithMode(b []byte, mode DecodeMode) error {
+	dec := newDecoder(mode)
+	dec.alias = true
+	raw, err := dec.check(Raw{Kind: 0x03, Data: b})
+	if err != nil {
+		return rootUnmarshalError(err, 0x03, typeM)
+	}
+
+	newM, err := dec.decodeMInto(*m, raw.Data)
+	if err != nil {
+		return rootUnmarshalError(err, 0x03, typeM)
+	}
+
+	*m = newM
+	return nil
+}
+
+// UnmarshalBSONInto is like UnmarshalBSON, but reuses the slice of r up to
+// its capacity. As with UnmarshalBSON, the Data of each element aliases b,
+// and element names equal to the ones they replace are kept.
+func (r *RawD) UnmarshalBSONInto(b []byte) error {
+	raw, err := newDecoder(defaultDecodeMode).check(Raw{Kind: 0x03, Data: b})
+	if err != nil {
+		return rootUnmarshalError(err, 0x03, typeRawD)
+	}
+
+	old := *r
+	newR := old[:0]
+
+	err = eachElement(raw.Data, func(kind byte, name, data []byte) error {
+		var prev string
+		if len(newR) < len(old) {
+			prev = old[len(newR)].Name
+		}
+		newR = append(newR, RawDocElem{Name: reuseString(prev, name), Value: Raw{Kind: kind, Data: data}})
+		return nil
+	})
+	if err != nil {
+		return rootUnmarshalError(err, 0x03, typeRawD)
+	}
+
+	if newR == nil {
+		newR = RawD{}
+	}
+	clearRawD(old, len(newR))
+
+	*r = newR
+	return nil
+}
+
+// decodeDInto decodes the document b into the storage of d.
+func (dec *decoder) decodeDInto(d D, b []byte) (D, error) {
+	newD := d[:0]
+
+	err := eachElement(b, func(kind byte, name, data []byte) error {
+		var prev DocElem
+		if len(newD) < len(d) {
+			prev = d[len(newD)]
+		}
+
+		key := reuseString(prev.Name, name)
+		value, err := dec.interfaceFromData(prev.Value, kind, data, typeD)
+		if err != nil {
+			return elementUnmarshalError(err, key, kind, typeInterface)
+		}
+
+		newD = append(newD, DocElem{Name: key, Value: value})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if newD == nil {
+		newD = D{}
+	}
+
+	// The elements past the end of the new document would otherwise keep
+	// their values alive.
+	for i := len(newD); i < len(d); i++ {
+		d[i] = DocElem{}
+	}
+
+	return newD, nil
+}
+
+// decodeMInto decodes the document b into m, which is cleared first.
+func (dec *decoder) decodeMInto(m M, b []byte) (M, error) {
+	if m == nil {
+		m = make(M)
+	}
+	for k := range m {
+		delete(m, k)
+	}
+
+	err := eachElement(b, func(kind byte, name, data []byte) error {
+		value, err := dec.interfaceFromData(nil, kind, data, typeM)
+		if err != nil {
+			return elementUnmarshalError(err, string(name), kind, typeInterface)
+		}
+
+		m[string(name)] = value
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// decodeArrayInto decodes the array b into the storage of prev if it's a
+// []interface{}, decoding any embedded documents as docType.
+func (dec *decoder) decodeArrayInto(prev interface{}, b []byte, docType reflect.Type) (interface{}, error) {
+	a, _ := prev.([]interface{})
+	newA := a[:0]
+
+	err := eachElement(b, func(kind byte, name, data []byte) error {
+		var old interface{}
+		if len(newA) < len(a) {
+			old = a[len(newA)]
+		}
+
+		value, err := dec.interfaceFromData(old, kind, data, docType)
+		if err != nil {
+			return elementUnmarshalError(err, string(name), kind, typeInterface)
+		}
+
+		newA = append(newA, value)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if newA == nil {
+		newA = []interface{}{}
+	}
+	for i := len(newA); i < len(a); i++ {
+		a[i] = nil
+	}
+
+	// Returning prev when newA is the same slice saves allocating another
+	// interface value for it.
+	if cap(a) > 0 && len(a) == len(newA) && &a[:1][0] == &newA[:1][0] {
+		return prev, nil
+	}
+	return newA, nil
+}
+
+// decodeDocumentInto decodes the document b as docType, into the storage of
+// prev if it's a value of that type.
+func (dec *decoder) decodeDocumentInto(prev interface{}, b []byte, docType reflect.Type) (interface{}, error) {
+	if docType == typeM {
+		m, _ := prev.(M)
+		return dec.decodeMInto(m, b)
+	}
+
+	d, _ := prev.(D)
+	newD, err := dec.decodeDInto(d, b)
+	if err != nil {
+		return nil, err
+	}
+	// Returning prev when newD is the same slice saves allocating another
+	// interface value for it.
+	if p, ok := prev.(D); ok && cap(p) > 0 && len(p) == len(newD) && &p[:1][0] == &newD[:1][0] {
+		return prev, nil
+	}
+	return newD, nil
+}
+
+// storageSpan is the range of addresses of the backing array of a slice, up
+// to its capacity, or the address of a map.
+type storageSpan struct {
+	start, end uintptr
+}
+
+type storageSpans []storageSpan
+
+func (s storageSpans) Len() int           { return len(s) }
+func (s storageSpans) Less(i, j int) bool { return s[i].start < s[j].start }
+func (s storageSpans) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+var storageSpansPool = sync.Pool{
+	New: func() interface{} {
+		return new(storageSpans)
+	},
+}
+
+// sharesStorage reports whether *d or any of the embedded documents, arrays
+// and JavaScript scopes it holds share storage, so that decoding into one
+// of them would overwrite another.
+func sharesStorage(d *D) bool {
+	spans := storageSpansPool.Get().(*storageSpans)
+	defer func() {
+		*spans = (*spans)[:0]
+		storageSpansPool.Put(spans)
+	}()
+
+	*spans = appendStorageSpans((*spans)[:0], reflect.ValueOf(d).Elem())
+	if len(*spans) < 2 {
+		return false
+	}
+
+	sort.Sort(spans)
+	end := (*spans)[0].end
+	for _, span := range (*spans)[1:] {
+		if span.start < end {
+			return true
+		}
+		if span.end > end {
+			end = span.end
+		}
+	}
+	return false
+}
+
+// appendStorageSpans appends the spans of the storage that decoding into v
+// may reuse: that of v itself if it's a D, a []interface{} or an M, and that
+// of the values it holds.
+func appendStorageSpans(spans storageSpans, v reflect.Value) storageSpans {
+	if v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return spans
+	}
+
+	switch v.Type() {
+	case typeD:
+		if v.Cap() == 0 {
+			return spans
+		}
+		start := v.Pointer()
+		spans = append(spans, storageSpan{start, start + uintptr(v.Cap())*typeDocElem.Size()})
+		for i := 0; i < v.Len(); i++ {
+			spans = appendStorageSpans(spans, v.Index(i).Field(1))
+		}
+	case typeInterfaceSlice:
+		if v.Cap() == 0 {
+			return spans
+		}
+		start := v.Pointer()
+		spans = append(spans, storageSpan{start, start + uintptr(v.Cap())*typeInterface.Size()})
+		for i := 0; i < v.Len(); i++ {
+			spans = appendStorageSpans(spans, v.Index(i))
+		}
+	case typeM:
+		if !v.IsNil() {
+			spans = append(spans, storageSpan{v.Pointer(), v.Pointer() + 1})
+		}
+	case typeJavaScript:
+		spans = appendStorageSpans(spans, v.Field(1))
+	}
+	return spans
+}
+
+// reuseString returns prev if it holds the same bytes as b, and a new string
+// otherwise.
+func reuseString(prev string, b []byte) string {
+	if prev == string(b) {
+		return prev
+	}
+	return string(b)
+}
+
+// clearRawD drops the references held by the elements of r from index n on.
+func clearRawD(r RawD, n int) {
+	for i := n; i < len(r); i++ {
+		r[i] = RawDocElem{}
+	}
+}
@@ -0,0 +1,259 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+//
+// Based on gopkg.in/mgo.v2/bson by Gustavo Niemeyer
+// See THIRD-PARTY-NOTICES for original license terms.
+
+package mgobson_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mongodb-labs/mgobson"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnmarshalBSONInto(t *testing.T) {
+	b, err := appendTestDocument(t).MarshalBSON()
+	require.NoError(t, err)
+	other, err := mgobson.D{
+		{"nil", "not nil"},
+		{"bool", mgobson.D{{"a", int32(1)}, {"b", mgobson.A{int32(2)}}}},
+		{"extra1", 1.5},
+		{"extra2", 1.5},
+		{"m", mgobson.A{int32(1), "two", mgobson.D{{"three", int32(3)}}}},
+		{"d", mgobson.D{{"b", mgobson.A{int32(1), "two", nil, "four"}}, {"c", int32(5)}}},
+	}.MarshalBSON()
+	require.NoError(t, err)
+
+	for _, mode := range []mgobson.DecodeMode{mgobson.DriverDecodeMode, mgobson.MgoDecodeMode} {
+		var expectedD mgobson.D
+		require.NoError(t, expectedD.UnmarshalBSONWithMode(b, mode))
+		var expectedM mgobson.M
+		require.NoError(t, expectedM.UnmarshalBSONWithMode(b, mode))
+		var expectedOther mgobson.D
+		require.NoError(t, expectedOther.UnmarshalBSONWithMode(other, mode))
+
+		// The values are the same as those of UnmarshalBSON, whatever
+		// the storage held before.
+		var d mgobson.D
+		var m mgobson.M
+		for _, in := range [][]byte{b, b, other, b, other, other} {
+			require.NoError(t, d.UnmarshalBSONIntoWithMode(in, mode))
+			require.NoError(t, m.UnmarshalBSONIntoWithMode(in, mode))
+			if &in[0] == &b[0] {
+				require.Equal(t, expectedD, d, "mode %d", mode)
+				require.Equal(t, expectedM, m, "mode %d", mode)
+			} else {
+				require.Equal(t, expectedOther, d, "mode %d", mode)
+			}
+		}
+	}
+
+	t.Run("empty", func(t *testing.T) {
+		empty, err := mgobson.D{}.MarshalBSON()
+		require.NoError(t, err)
+
+		var d mgobson.D
+		require.NoError(t, d.UnmarshalBSONInto(empty))
+		require.Equal(t, mgobson.D{}, d)
+
+		d = mgobson.D{{"a", mgobson.D{{"b", int32(1)}}}}
+		require.NoError(t, d.UnmarshalBSONInto(empty))
+		require.Equal(t, mgobson.D{}, d)
+
+		var m mgobson.M
+		require.NoError(t, m.UnmarshalBSONInto(empty))
+		require.Equal(t, mgobson.M{}, m)
+
+		var r mgobson.RawD
+		require.NoError(t, r.UnmarshalBSONInto(empty))
+		require.Equal(t, mgobson.RawD{}, r)
+	})
+
+	t.Run("reuse", func(t *testing.T) {
+		b1, err := mgobson.D{{"a", "x"}, {"b", mgobson.D{{"c", int32(1)}}}, {"d", mgobson.A{"e"}}, {"f", true}}.MarshalBSON()
+		require.NoError(t, err)
+		b2, err := mgobson.D{{"a", "y"}, {"b", mgobson.D{{"c", int32(2)}}}, {"d", mgobson.A{"g"}}}.MarshalBSON()
+		require.NoError(t, err)
+
+		var d mgobson.D
+		require.NoError(t, d.UnmarshalBSONInto(b1))
+		first := d
+		nested := d[1].Value.(mgobson.D)
+		array := d[2].Value.([]interface{})
+
+		require.NoError(t, d.UnmarshalBSONInto(b2))
+		require.Equal(t, mgobson.D{{"a", "y"}, {"b", mgobson.D{{"c", int32(2)}}}, {"d", []interface{}{"g"}}}, d)
+		require.True(t, &first[0] == &d[0])
+		require.True(t, &nested[0] == &d[1].Value.(mgobson.D)[0])
+		require.True(t, &array[0] == &d[2].Value.([]interface{})[0])
+
+		// The element past the end of the shorter document is cleared.
+		require.Equal(t, mgobson.DocElem{}, first[3])
+
+		m := mgobson.M{"old": int32(1)}
+		require.NoError(t, m.UnmarshalBSONInto(b2))
+		require.Equal(t, mgobson.M{"a": "y", "b": mgobson.M{"c": int32(2)}, "d": []interface{}{"g"}}, m)
+
+		var r mgobson.RawD
+		require.NoError(t, r.UnmarshalBSONInto(b1))
+		rawFirst := r
+		require.NoError(t, r.UnmarshalBSONInto(b2))
+		require.True(t, &rawFirst[0] == &r[0])
+		require.True(t, &b2[len(b2)-2] == &r[2].Value.Data[len(r[2].Value.Data)-1])
+
+		var expected mgobson.RawD
+		require.NoError(t, expected.UnmarshalBSON(b2))
+		require.Equal(t, expected, r)
+	})
+
+	t.Run("aliasing", func(t *testing.T) {
+		b, err := mgobson.D{
+			{"bytes", []byte{1, 2}},
+			{"binary", mgobson.Binary{Kind: 0x80, Data: []byte{3}}},
+			{"string", "s"},
+		}.MarshalBSON()
+		require.NoError(t, err)
+
+		var d mgobson.D
+		require.NoError(t, d.UnmarshalBSONInto(b))
+		bytes := d[0].Value.([]byte)
+		binary := d[1].Value.(mgobson.Binary)
+
+		// UnmarshalBSON copies binary data instead.
+		var copied mgobson.D
+		require.NoError(t, copied.UnmarshalBSON(b))
+
+		// Binary data aliases b, and can't be appended to over it.
+		for i := range b {
+			b[i] = 0xFF
+		}
+		require.Equal(t, []byte{0xFF, 0xFF}, bytes)
+		require.Equal(t, []byte{0xFF}, binary.Data)
+		require.Equal(t, "s", d[2].Value)
+		require.Equal(t, len(bytes), cap(bytes))
+		require.Equal(t, []byte{1, 2}, copied[0].Value)
+		require.Equal(t, mgobson.Binary{Kind: 0x80, Data: []byte{3}}, copied[1].Value)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		b, err := mgobson.D{{"a", int32(1)}}.MarshalBSON()
+		require.NoError(t, err)
+
+		d := mgobson.D{{"old", int32(1)}}
+		err = d.UnmarshalBSONInto(b[:len(b)-1])
+		var uerr *mgobson.UnmarshalError
+		require.True(t, errors.As(err, &uerr), "%v", err)
+
+		m := mgobson.M{"old": int32(1)}
+		require.Error(t, m.UnmarshalBSONInto(b[:len(b)-1]))
+
+		mgobson.SetDecodeLimits(mgobson.DecodeLimits{MaxDepth: 1})
+		defer mgobson.SetDecodeLimits(mgobson.DecodeLimits{MaxDepth: 200})
+		nested, err := mgobson.D{{"a", mgobson.D{{"b", mgobson.D{}}}}}.MarshalBSON()
+		require.NoError(t, err)
+		require.Error(t, d.UnmarshalBSONInto(nested))
+
+		// The contents are undefined after an error, but the storage can
+		// still be decoded into.
+		require.NoError(t, d.UnmarshalBSONInto(b))
+		require.Equal(t, mgobson.D{{"a", int32(1)}}, d)
+		require.NoError(t, m.UnmarshalBSONInto(b))
+		require.Equal(t, mgobson.M{"a": int32(1)}, m)
+	})
+
+	t.Run("shared storage", func(t *testing.T) {
+		b, err := mgobson.D{
+			{"a", mgobson.D{{"v", int32(1)}, {"w", int32(2)}}},
+			{"b", mgobson.D{{"v", int32(3)}}},
+			{"c", mgobson.A{int32(4)}},
+			{"d", mgobson.A{int32(5)}},
+			{"e", mgobson.JavaScript{Code: "f", Scope: mgobson.D{{"v", int32(6)}}}},
+			{"f", mgobson.JavaScript{Code: "g", Scope: mgobson.D{{"v", int32(7)}}}},
+		}.MarshalBSON()
+		require.NoError(t, err)
+
+		var expected mgobson.D
+		require.NoError(t, expected.UnmarshalBSONWithMode(b, mgobson.MgoDecodeMode))
+
+		x := mgobson.D{{"v", int32(0)}, {"w", int32(0)}}
+		a := []interface{}{int32(0)}
+		scope := mgobson.M{"v": int32(0)}
+		js := mgobson.JavaScript{Code: "f", Scope: scope}
+		for _, d := range []mgobson.D{
+			{{"a", x}, {"b", x}},
+			{{"a", x[:1]}, {"b", x[1:]}},
+			{{"a", x}, {"b", mgobson.D{}}, {"c", a}, {"d", a}},
+			{{"a", nil}, {"b", nil}, {"c", nil}, {"d", nil}, {"e", js}, {"f", js}},
+		} {
+			require.NoError(t, d.UnmarshalBSONIntoWithMode(b, mgobson.MgoDecodeMode))
+			require.Equal(t, expected, d)
+		}
+	})
+
+	t.Run("allocations", func(t *testing.T) {
+		b, err := mgobson.D{
+			{"_id", mgobson.ObjectIdHex("5a4af6a50000000000000001")},
+			{"name", "a name"},
+			{"count", int64(1000)},
+			{"tags", mgobson.A{"a", "b"}},
+			{"nested", mgobson.D{{"x", 1.5}, {"data", []byte{1, 2, 3}}}},
+		}.MarshalBSON()
+		require.NoError(t, err)
+
+		var d mgobson.D
+		require.NoError(t, d.UnmarshalBSONInto(b))
+
+		// Only the []byte value is allocated again.
+		allocs := testing.AllocsPerRun(100, func() {
+			_ = d.UnmarshalBSONInto(b)
+		})
+		require.LessOrEqual(t, allocs, 2.0)
+	})
+}
+
+func BenchmarkUnmarshal(b *testing.B) {
+	raw, err := appendTestDocument(b).MarshalBSON()
+	require.NoError(b, err)
+
+	b.Run("D/UnmarshalBSON", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var d mgobson.D
+			_ = d.UnmarshalBSON(raw)
+		}
+	})
+	b.Run("D/UnmarshalBSONInto", func(b *testing.B) {
+		b.ReportAllocs()
+		var d mgobson.D
+		for i := 0; i < b.N; i++ {
+			_ = d.UnmarshalBSONInto(raw)
+		}
+	})
+	b.Run("M/UnmarshalBSON", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var m mgobson.M
+			_ = m.UnmarshalBSON(raw)
+		}
+	})
+	b.Run("M/UnmarshalBSONInto", func(b *testing.B) {
+		b.ReportAllocs()
+		var m mgobson.M
+		for i := 0; i < b.N; i++ {
+			_ = m.UnmarshalBSONInto(raw)
+		}
+	})
+	b.Run("RawD/UnmarshalBSONInto", func(b *testing.B) {
+		b.ReportAllocs()
+		var r mgobson.RawD
+		for i := 0; i < b.N; i++ {
+			_ = r.UnmarshalBSONInto(raw)
+		}
+	})
+}
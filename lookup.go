@@ -0,0 +1,111 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+//
+// Based on gopkg.in/mgo.v2/bson by Gustavo Niemeyer
+// See THIRD-PARTY-NOTICES for original license terms.
+
+package mgobson
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrNotFound is returned by Lookup when there's no element at the given
+// path.
+var ErrNotFound = errors.New("element not found")
+
+// Lookup returns the value at path in the BSON document doc, without decoding
+// any other part of it. The first key of path names an element of doc, and
+// each following key names an element of the embedded document, or the
+// index of an element of the array, that the previous keys led to. Keys are
+// taken literally, so a dotted path such as "tenant.id" must be split into
+// its keys first:
+//
+//	raw, err := mgobson.Lookup(doc, mgobson.SplitPath("tenant.id")...)
+//
+// The Data of the returned Raw is a subslice of doc, not a copy. ErrNotFound
+// is returned if an element of the path doesn't exist. Other errors, such as
+// a path that goes through a value that isn't a document or an array, or
+// malformed data along the path, are returned as an *UnmarshalError. Only
+// the elements that are walked to find the value are checked.
+func Lookup(doc []byte, path ...string) (Raw, error) {
+	if len(path) == 0 {
+		return Raw{}, errors.New("Lookup needs at least one key")
+	}
+
+	return lookup(Raw{Kind: 0x03, Data: doc}, path, 0)
+}
+
+// Lookup returns the value at path in r, as the Lookup function does for a
+// BSON document. The first key names an element of r. The Data of the
+// returned Raw is a subslice of the Data of that element.
+func (r RawD) Lookup(path ...string) (Raw, error) {
+	if len(path) == 0 {
+		return Raw{}, errors.New("Lookup needs at least one key")
+	}
+
+	for _, elem := range r {
+		if elem.Name == path[0] {
+			return lookup(elem.Value, path, 1)
+		}
+	}
+	return Raw{}, ErrNotFound
+}
+
+// lookup returns the value at path[i:] in raw, which is the value at
+// path[:i].
+func lookup(raw Raw, path []string, i int) (Raw, error) {
+	for ; i < len(path); i++ {
+		if raw.Kind != 0x03 && raw.Kind != 0x04 {
+			return Raw{}, lookupError(path[:i], raw.Kind, fmt.Errorf("can't look up %q in a value that isn't a document or an array", path[i]))
+		}
+
+		n, err := valueLength(raw.Kind, raw.Data)
+		if err == nil && raw.Data[n-1] != 0 {
+			err = errors.New("document isn't terminated by a NUL byte")
+		}
+		if err != nil {
+			return Raw{}, lookupError(path[:i], raw.Kind, err)
+		}
+
+		found := false
+		elems := raw.Data[4 : n-1]
+		for len(elems) > 0 {
+			kind := elems[0]
+			j := bytes.IndexByte(elems[1:], 0)
+			if j < 0 {
+				return Raw{}, lookupError(path[:i], raw.Kind, errors.New("element name isn't terminated by a NUL byte"))
+			}
+			name := elems[1 : 1+j]
+			elems = elems[2+j:]
+
+			m, err := valueLength(kind, elems)
+			if err != nil {
+				return Raw{}, lookupError(append(path[:i:i], string(name)), kind, err)
+			}
+
+			if string(name) == path[i] {
+				raw = Raw{Kind: kind, Data: elems[:m:m]}
+				found = true
+				break
+			}
+			elems = elems[m:]
+		}
+
+		if !found {
+			return Raw{}, ErrNotFound
+		}
+	}
+
+	return raw, nil
+}
+
+func lookupError(path []string, kind byte, err error) error {
+	return &UnmarshalError{Path: strings.Join(path, "."), Kind: kind, Err: err}
+}
@@ -0,0 +1,125 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+//
+// Based on gopkg.in/mgo.v2/bson by Gustavo Niemeyer
+// See THIRD-PARTY-NOTICES for original license terms.
+
+package mgobson_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/mongodb-labs/mgobson"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookup(t *testing.T) {
+	doc, err := mgobson.D{
+		{"tenant", mgobson.D{{"name", "t"}, {"id", int32(7)}}},
+		{"meta", mgobson.D{{"version", int64(2)}, {"tags", mgobson.A{"a", mgobson.D{{"b", true}}}}}},
+		{"a.b", "dotted"},
+	}.MarshalBSON()
+	require.NoError(t, err)
+
+	var r mgobson.RawD
+	require.NoError(t, r.UnmarshalBSON(doc))
+
+	testCases := []struct {
+		name     string
+		path     []string
+		expected interface{}
+	}{
+		{"top level", []string{"a.b"}, "dotted"},
+		{"document", []string{"tenant"}, mgobson.M{"name": "t", "id": int32(7)}},
+		{"nested", []string{"tenant", "id"}, int32(7)},
+		{"nested later element", []string{"meta", "version"}, int64(2)},
+		{"array index", []string{"meta", "tags", "0"}, "a"},
+		{"through array", []string{"meta", "tags", "1", "b"}, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, lookup := range []func(...string) (mgobson.Raw, error){
+				func(path ...string) (mgobson.Raw, error) { return mgobson.Lookup(doc, path...) },
+				r.Lookup,
+			} {
+				raw, err := lookup(tc.path...)
+				require.NoError(t, err)
+
+				var actual interface{}
+				require.NoError(t, raw.Unmarshal(&actual))
+				require.Equal(t, tc.expected, actual)
+			}
+		})
+	}
+
+	t.Run("aliases input", func(t *testing.T) {
+		raw, err := mgobson.Lookup(doc, "tenant", "id")
+		require.NoError(t, err)
+		raw.Data[0] = 8
+
+		raw, err = mgobson.Lookup(doc, "tenant", "id")
+		require.NoError(t, err)
+		require.Equal(t, []byte{8, 0, 0, 0}, raw.Data)
+		raw.Data[0] = 7
+
+		// Appending to the data doesn't overwrite the rest of the input.
+		before := append([]byte(nil), doc...)
+		for _, path := range [][]string{{"tenant", "id"}, {"meta", "tags", "0"}} {
+			raw, err = mgobson.Lookup(doc, path...)
+			require.NoError(t, err)
+			_ = append(raw.Data, 0xFF)
+			require.Equal(t, before, doc)
+
+			raw, err = r.Lookup(path...)
+			require.NoError(t, err)
+			_ = append(raw.Data, 0xFF)
+			require.Equal(t, before, doc)
+		}
+	})
+
+	t.Run("allocations", func(t *testing.T) {
+		allocs := testing.AllocsPerRun(100, func() {
+			_, _ = mgobson.Lookup(doc, "meta", "tags", "1", "b")
+		})
+		require.Zero(t, allocs)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		for _, path := range [][]string{{"missing"}, {"tenant", "missing"}, {"meta", "tags", "2"}, {"a", "b"}} {
+			_, err := mgobson.Lookup(doc, path...)
+			require.Equal(t, mgobson.ErrNotFound, err, "%v", path)
+			_, err = r.Lookup(path...)
+			require.Equal(t, mgobson.ErrNotFound, err, "%v", path)
+		}
+
+		_, err := mgobson.Lookup(doc)
+		require.Error(t, err)
+		_, err = r.Lookup()
+		require.Error(t, err)
+
+		_, err = mgobson.Lookup(doc, "tenant", "id", "x")
+		var uerr *mgobson.UnmarshalError
+		require.True(t, errors.As(err, &uerr))
+		require.Equal(t, "tenant.id", uerr.Path)
+		require.Equal(t, byte(0x10), uerr.Kind)
+
+		_, err = r.Lookup("a.b", "x")
+		require.True(t, errors.As(err, &uerr))
+		require.Equal(t, "a.b", uerr.Path)
+
+		// The length of the string is beyond the end of the document.
+		_, err = mgobson.Lookup([]byte{13, 0, 0, 0, 0x02, 'a', 0, 0xFF, 0, 0, 0, 0, 0}, "a")
+		require.True(t, errors.As(err, &uerr))
+		require.Equal(t, "a", uerr.Path)
+		require.Equal(t, byte(0x02), uerr.Kind)
+
+		_, err = mgobson.Lookup([]byte{1, 2, 3}, "a")
+		require.True(t, errors.As(err, &uerr))
+		require.Equal(t, "", uerr.Path)
+	})
+}
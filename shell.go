@@ -0,0 +1,485 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+//
+// Based on gopkg.in/mgo.v2/bson by Gustavo Niemeyer
+// See THIRD-PARTY-NOTICES for original license terms.
+
+package mgobson
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	_ fmt.Stringer  = (M)(nil)
+	_ fmt.Stringer  = (D)(nil)
+	_ fmt.Stringer  = (RawD)(nil)
+	_ fmt.Formatter = (M)(nil)
+	_ fmt.Formatter = (D)(nil)
+	_ fmt.Formatter = (RawD)(nil)
+)
+
+// ParseShell parses s, a document written in the syntax of the mongo shell,
+// such as
+//
+//	{ a: { $gt: ISODate("2020-01-01") }, _id: ObjectId("5a4af6a50000000000000001") }
+//
+// Keys may be unquoted, strings may use single quotes, and arrays, documents
+// and argument lists may have a trailing comma. Regular expression literals
+// and the shell's constructors ObjectId, NumberInt, NumberLong,
+// NumberDecimal, ISODate, Date, Timestamp, BinData, HexData, UUID, Code,
+// DBPointer, MinKey and MaxKey are supported, with or without new, as well
+// as undefined, Infinity and NaN. Integers are returned as int32 when they
+// fit and as int64 otherwise, and other numbers as float64. Unlike
+// UnmarshalExtJSON, documents such as {$date: 1} are not converted into
+// special values. The order of keys is kept. Syntax errors are returned as a
+// *SyntaxError, which has the line and column where the error was found.
+func ParseShell(s string) (D, error) {
+	p := extJSONParser{data: []byte(s), shell: true}
+
+	v, err := p.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	doc, ok := v.(D)
+	if !ok {
+		return nil, p.errorAt(0, "mongo shell input must hold a document, not %T", v)
+	}
+	return doc, nil
+}
+
+// parseRegEx parses a regular expression literal such as /^a\/b/i. The
+// escaped forward slashes of the pattern are unescaped, and the rest of it
+// is kept as written.
+func (p *extJSONParser) parseRegEx() (interface{}, error) {
+	start := p.pos
+	p.pos++
+
+	var pattern []byte
+	inClass := false
+	for p.pos < len(p.data) {
+		switch c := p.data[p.pos]; {
+		case c == '\\' && p.pos+1 < len(p.data):
+			p.pos++
+			if p.data[p.pos] != '/' {
+				pattern = append(pattern, c)
+			}
+		case c == '[':
+			inClass = true
+		case c == ']':
+			inClass = false
+		case c == '\n':
+			return nil, p.errorf("invalid newline in regular expression")
+		case c == '/' && !inClass:
+			if p.pos == start+1 {
+				return nil, p.errorAt(start, "invalid empty regular expression")
+			}
+
+			p.pos++
+			optionsStart := p.pos
+			for p.pos < len(p.data) && isIdentChar(p.data[p.pos]) {
+				p.pos++
+			}
+
+			return RegEx{Pattern: string(pattern), Options: string(p.data[optionsStart:p.pos])}, nil
+		}
+		pattern = append(pattern, p.data[p.pos])
+		p.pos++
+	}
+
+	return nil, p.errorf("unexpected end of input in regular expression")
+}
+
+// shellConstructor returns the value built by the mongo shell constructor
+// name when called with args, handling the constructors that Extended JSON
+// doesn't accept before those that it does.
+func shellConstructor(name string, args []interface{}) (interface{}, error) {
+	switch name {
+	case "Code":
+		if len(args) == 1 || len(args) == 2 {
+			code, ok := args[0].(string)
+			if len(args) == 1 && ok {
+				return JavaScript{Code: code}, nil
+			}
+			if scope, ok2 := args[len(args)-1].(D); ok && ok2 {
+				return JavaScript{Code: code, Scope: scope}, nil
+			}
+		}
+		return nil, fmt.Errorf("Code needs a string and optionally a scope document")
+	case "DBPointer":
+		if len(args) == 2 {
+			ns, ok := args[0].(string)
+			id, ok2 := args[1].(ObjectId)
+			if ok && ok2 {
+				return DBPointer{Namespace: ns, Id: id}, nil
+			}
+		}
+		return nil, fmt.Errorf("DBPointer needs a namespace string and an ObjectId")
+	case "HexData":
+		if len(args) == 2 {
+			kind, ok := extJSONInt(args[0], 64)
+			s, ok2 := args[1].(string)
+			if ok && ok2 && kind >= 0 && kind <= 0xff {
+				if data, err := hex.DecodeString(s); err == nil {
+					return shellBinary(byte(kind), data), nil
+				}
+			}
+		}
+		return nil, fmt.Errorf("HexData needs a subtype and a hex string")
+	case "UUID":
+		if len(args) == 1 {
+			if s, ok := args[0].(string); ok {
+				data, err := hex.DecodeString(strings.Replace(s, "-", "", -1))
+				if err == nil && len(data) == 16 {
+					return Binary{Kind: 0x04, Data: data}, nil
+				}
+			}
+		}
+		return nil, fmt.Errorf("UUID needs a string with 32 hex digits")
+	}
+
+	return extJSONConstructor(name, args)
+}
+
+func shellBinary(kind byte, data []byte) interface{} {
+	if kind == 0x00 {
+		return data
+	}
+	return Binary{Kind: kind, Data: data}
+}
+
+// String returns m in the syntax of the mongo shell, on a single line, as in
+//
+//	{ "_id" : ObjectId("5a4af6a50000000000000001"), "n" : NumberLong(1) }
+//
+// The keys of m are written in increasing order. Go int values that fit in
+// an int32 are written as such, as MgoEncodeMode encodes them, so that
+// documents decoded in MgoDecodeMode print as they were stored.
+func (m M) String() string {
+	return shellString(m.shellBSON, "")
+}
+
+// Format implements fmt.Formatter. The %v and %s verbs print m as String
+// does, and %+v prints it on multiple lines, indented with tabs as the mongo
+// shell does. %#v prints m in Go syntax.
+func (m M) Format(f fmt.State, verb rune) {
+	formatShell(f, verb, "mgobson.M", map[string]interface{}(m), m.shellBSON)
+}
+
+// shellEncoder returns the encoder that M and D are marshaled with to be
+// printed. It uses MgoEncodeMode, which keeps the width of the integers that
+// MgoDecodeMode decodes as Go int.
+func shellEncoder() *encoder {
+	return &encoder{mode: MgoEncodeMode, sortKeys: true}
+}
+
+func (m M) shellBSON() ([]byte, error) {
+	return shellEncoder().appendDocument(nil, m)
+}
+
+// String returns d in the syntax of the mongo shell, on a single line, as in
+//
+//	{ "_id" : ObjectId("5a4af6a50000000000000001"), "n" : NumberLong(1) }
+//
+// The elements of d are written in order. The keys of maps within d are
+// written in increasing order, and Go int values as in M.String.
+func (d D) String() string {
+	return shellString(d.shellBSON, "")
+}
+
+// Format implements fmt.Formatter. The %v and %s verbs print d as String
+// does, and %+v prints it on multiple lines, indented with tabs as the mongo
+// shell does. %#v prints d in Go syntax.
+func (d D) Format(f fmt.State, verb rune) {
+	formatShell(f, verb, "mgobson.D", []DocElem(d), d.shellBSON)
+}
+
+func (d D) shellBSON() ([]byte, error) {
+	return shellEncoder().appendDocument(nil, d)
+}
+
+// String returns r in the syntax of the mongo shell, on a single line, as in
+//
+//	{ "_id" : ObjectId("5a4af6a50000000000000001"), "n" : NumberLong(1) }
+func (r RawD) String() string {
+	return shellString(r.MarshalBSON, "")
+}
+
+// Format implements fmt.Formatter. The %v and %s verbs print r as String
+// does, and %+v prints it on multiple lines, indented with tabs as the mongo
+// shell does. %#v prints r in Go syntax.
+func (r RawD) Format(f fmt.State, verb rune) {
+	formatShell(f, verb, "mgobson.RawD", []RawDocElem(r), r.MarshalBSON)
+}
+
+// shellString formats the BSON document returned by marshal in the syntax
+// of the mongo shell, or describes the error if it couldn't be produced.
+func shellString(marshal func() ([]byte, error), indent string) string {
+	b, err := marshal()
+	if err == nil {
+		err = checkDocument(b)
+	}
+	if err == nil {
+		w := shellWriter{indent: indent}
+		b, err = w.appendDocument(nil, b, 0)
+	}
+	if err != nil {
+		return fmt.Sprintf("%%!(BADBSON=%s)", err)
+	}
+	return string(b)
+}
+
+func formatShell(f fmt.State, verb rune, typeName string, value interface{}, marshal func() ([]byte, error)) {
+	switch {
+	case verb == 'v' && f.Flag('#'):
+		// value has the underlying type of the document, which fmt prints
+		// in Go syntax as it has no Format method. Only its type name is
+		// replaced.
+		fmt.Fprint(f, typeName+strings.TrimPrefix(fmt.Sprintf("%#v", value), fmt.Sprintf("%T", value)))
+	case verb == 's' || verb == 'v' && !f.Flag('+'):
+		fmt.Fprint(f, shellString(marshal, ""))
+	case verb == 'v':
+		fmt.Fprint(f, shellString(marshal, "\t"))
+	default:
+		fmt.Fprintf(f, "%%!%c(%s=%s)", verb, typeName, shellString(marshal, ""))
+	}
+}
+
+// shellWriter appends the mongo shell representation of BSON data, which
+// must have been checked with checkDocument. If indent is empty everything
+// is written on a single line, otherwise every element is written on its own
+// line, indented by indent once per level of nesting.
+type shellWriter struct {
+	indent string
+}
+
+func (w *shellWriter) appendDocument(dst []byte, data []byte, depth int) ([]byte, error) {
+	return w.appendElements(dst, data, depth, '{', '}', true)
+}
+
+func (w *shellWriter) appendArray(dst []byte, data []byte, depth int) ([]byte, error) {
+	return w.appendElements(dst, data, depth, '[', ']', false)
+}
+
+func (w *shellWriter) appendElements(dst []byte, data []byte, depth int, open, close byte, keys bool) ([]byte, error) {
+	elems, err := splitDocument(data)
+	if err != nil {
+		return nil, err
+	}
+
+	dst = append(dst, open)
+	if len(elems) == 0 {
+		return append(dst, ' ', close), nil
+	}
+
+	for i, elem := range elems {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		dst = w.appendNewline(dst, depth+1)
+
+		if keys {
+			dst = appendJSONString(dst, elem.Name)
+			dst = append(dst, " : "...)
+		}
+
+		dst, err = w.appendValue(dst, elem.Value, depth+1)
+		if err != nil {
+			return nil, err
+		}
+	}
+	dst = w.appendNewline(dst, depth)
+
+	return append(dst, close), nil
+}
+
+// appendNewline starts a new line at the given depth, or appends a single
+// space on the single-line form.
+func (w *shellWriter) appendNewline(dst []byte, depth int) []byte {
+	if w.indent == "" {
+		return append(dst, ' ')
+	}
+
+	dst = append(dst, '\n')
+	for i := 0; i < depth; i++ {
+		dst = append(dst, w.indent...)
+	}
+	return dst
+}
+
+func (w *shellWriter) appendValue(dst []byte, raw Raw, depth int) ([]byte, error) {
+	switch raw.Kind {
+	case 0x03:
+		return w.appendDocument(dst, raw.Data, depth)
+	case 0x04:
+		return w.appendArray(dst, raw.Data, depth)
+	case 0x09:
+		if len(raw.Data) != 8 {
+			return nil, fmt.Errorf("invalid BSON datetime of %d bytes", len(raw.Data))
+		}
+		return appendShellDate(dst, int64(binary.LittleEndian.Uint64(raw.Data))), nil
+	case 0x0F:
+		v, err := raw.driverValue()
+		if err != nil {
+			return nil, err
+		}
+
+		code, scope := v.ReaderJavaScriptWithScope()
+		dst = append(dst, "Code("...)
+		dst = appendJSONString(dst, code)
+		dst = append(dst, ", "...)
+		dst, err = w.appendDocument(dst, scope, depth)
+		if err != nil {
+			return nil, err
+		}
+		return append(dst, ')'), nil
+	}
+
+	in, err := newDecoder(DriverDecodeMode).interfaceFromData(nil, raw.Kind, raw.Data, typeD)
+	if err != nil {
+		return nil, err
+	}
+
+	switch v := in.(type) {
+	case nil:
+		dst = append(dst, "null"...)
+	case bool:
+		dst = strconv.AppendBool(dst, v)
+	case string:
+		dst = appendJSONString(dst, v)
+	case int32:
+		dst = strconv.AppendInt(dst, int64(v), 10)
+	case int64:
+		// The shell quotes the values that a JavaScript number can't
+		// represent exactly.
+		dst = append(dst, "NumberLong("...)
+		if v > 1<<53 || v < -1<<53 {
+			dst = append(dst, '"')
+			dst = strconv.AppendInt(dst, v, 10)
+			dst = append(dst, '"')
+		} else {
+			dst = strconv.AppendInt(dst, v, 10)
+		}
+		dst = append(dst, ')')
+	case float64:
+		switch {
+		case math.IsInf(v, 1):
+			dst = append(dst, "Infinity"...)
+		case math.IsInf(v, -1):
+			dst = append(dst, "-Infinity"...)
+		case math.IsNaN(v):
+			dst = append(dst, "NaN"...)
+		default:
+			dst = strconv.AppendFloat(dst, v, 'g', -1, 64)
+		}
+	case Decimal128:
+		dst = append(dst, `NumberDecimal("`...)
+		dst = append(dst, v.String()...)
+		dst = append(dst, `")`...)
+	case ObjectId:
+		dst = append(dst, `ObjectId("`...)
+		dst = append(dst, v.Hex()...)
+		dst = append(dst, `")`...)
+	case []byte:
+		dst = appendShellBinary(dst, 0x00, v)
+	case Binary:
+		dst = appendShellBinary(dst, v.Kind, v.Data)
+	case RegEx:
+		dst = append(dst, '/')
+		dst = append(dst, escapeRegExSlashes(v.Pattern)...)
+		dst = append(dst, '/')
+		dst = append(dst, v.Options...)
+	case DBPointer:
+		dst = append(dst, "DBPointer("...)
+		dst = appendJSONString(dst, v.Namespace)
+		dst = append(dst, `, ObjectId("`...)
+		dst = append(dst, v.Id.Hex()...)
+		dst = append(dst, `"))`...)
+	case JavaScript:
+		dst = append(dst, "Code("...)
+		dst = appendJSONString(dst, v.Code)
+		dst = append(dst, ')')
+	case Symbol:
+		dst = appendJSONString(dst, string(v))
+	case MongoTimestamp:
+		dst = append(dst, "Timestamp("...)
+		dst = strconv.AppendUint(dst, uint64(v)>>32, 10)
+		dst = append(dst, ", "...)
+		dst = strconv.AppendUint(dst, uint64(uint32(v)), 10)
+		dst = append(dst, ')')
+	case undefined:
+		dst = append(dst, "undefined"...)
+	case orderKey:
+		if v == MinKey {
+			dst = append(dst, "MinKey"...)
+		} else {
+			dst = append(dst, "MaxKey"...)
+		}
+	default:
+		return nil, fmt.Errorf("Can't format BSON kind 0x%02x in mongo shell syntax", raw.Kind)
+	}
+
+	return dst, nil
+}
+
+// appendShellDate appends the date ms milliseconds after the Unix epoch as
+// an ISODate, or as a Date with the milliseconds if its year has more than
+// four digits or is before year 1.
+func appendShellDate(dst []byte, ms int64) []byte {
+	t := time.Unix(ms/1e3, ms%1e3*1e6).UTC()
+	if t.Year() < 1 || t.Year() > 9999 {
+		dst = append(dst, "new Date("...)
+		dst = strconv.AppendInt(dst, ms, 10)
+		return append(dst, ')')
+	}
+
+	dst = append(dst, `ISODate("`...)
+	dst = append(dst, t.Format(extJSONDateFormat)...)
+	return append(dst, `")`...)
+}
+
+func appendShellBinary(dst []byte, kind byte, data []byte) []byte {
+	dst = append(dst, "BinData("...)
+	dst = strconv.AppendUint(dst, uint64(kind), 10)
+	dst = append(dst, `, "`...)
+	dst = append(dst, base64.StdEncoding.EncodeToString(data)...)
+	return append(dst, `")`...)
+}
+
+// escapeRegExSlashes escapes the forward slashes of pattern that would end
+// a regular expression literal, which are those outside of a character class
+// that aren't escaped yet.
+func escapeRegExSlashes(pattern string) string {
+	if !strings.Contains(pattern, "/") {
+		return pattern
+	}
+
+	var b strings.Builder
+	inClass := false
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '\\' && i+1 < len(pattern):
+			b.WriteByte(c)
+			i++
+		case c == '[':
+			inClass = true
+		case c == ']':
+			inClass = false
+		case c == '/' && !inClass:
+			b.WriteByte('\\')
+		}
+		b.WriteByte(pattern[i])
+	}
+	return b.String()
+}
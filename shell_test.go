@@ -0,0 +1,254 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+//
+// Based on gopkg.in/mgo.v2/bson by Gustavo Niemeyer
+// See THIRD-PARTY-NOTICES for original license terms.
+
+package mgobson_test
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/mongodb-labs/mgobson"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShellString(t *testing.T) {
+	oid := mgobson.ObjectIdHex("5a4af6a50000000000000001")
+	dec, err := mgobson.ParseDecimal128("1.50")
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name     string
+		value    interface{}
+		expected string
+	}{
+		{"string", "a\"b\n", `"a\"b\n"`},
+		{"int32", int32(-5), `-5`},
+		{"int64", int64(7), `NumberLong(7)`},
+		{"large int64", int64(1 << 60), `NumberLong("1152921504606846976")`},
+		{"double", 1.5, `1.5`},
+		{"integral double", 2.0, `2`},
+		{"infinity", math.Inf(-1), `-Infinity`},
+		{"decimal", dec, `NumberDecimal("1.50")`},
+		{"bool", false, `false`},
+		{"null", nil, `null`},
+		{"objectid", oid, `ObjectId("5a4af6a50000000000000001")`},
+		{"binary", []byte{1, 2, 3}, `BinData(0, "AQID")`},
+		{"binary subtype", mgobson.Binary{Kind: 0x80, Data: []byte{1}}, `BinData(128, "AQ==")`},
+		{"date", time.Date(2018, 1, 2, 3, 4, 5, 6e6, time.UTC), `ISODate("2018-01-02T03:04:05.006Z")`},
+		{"date before epoch", time.Date(1969, 12, 31, 23, 59, 59, 0, time.UTC), `ISODate("1969-12-31T23:59:59Z")`},
+		{"regex", mgobson.RegEx{Pattern: `a/b\/c[/]`, Options: "i"}, `/a\/b\/c[/]/i`},
+		{"dbpointer", mgobson.DBPointer{Namespace: "db.c", Id: oid}, `DBPointer("db.c", ObjectId("5a4af6a50000000000000001"))`},
+		{"code", mgobson.JavaScript{Code: "f()"}, `Code("f()")`},
+		{"code with scope", mgobson.JavaScript{Code: "f()", Scope: mgobson.D{{"a", int32(1)}}}, `Code("f()", { "a" : 1 })`},
+		{"symbol", mgobson.Symbol("s"), `"s"`},
+		{"timestamp", mgobson.MongoTimestamp(5<<32 | 6), `Timestamp(5, 6)`},
+		{"undefined", mgobson.Undefined, `undefined`},
+		{"minkey", mgobson.MinKey, `MinKey`},
+		{"maxkey", mgobson.MaxKey, `MaxKey`},
+		{"document", mgobson.D{{"b", int32(1)}, {"a", mgobson.D{{"y", int32(2)}, {"x", int32(3)}}}}, `{ "b" : 1, "a" : { "y" : 2, "x" : 3 } }`},
+		{"array", mgobson.A{int32(1), "two", mgobson.A{}}, `[ 1, "two", [ ] ]`},
+		{"empty document", mgobson.D{}, `{ }`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			expected := `{ "v" : ` + tc.expected + ` }`
+
+			require.Equal(t, expected, mgobson.D{{"v", tc.value}}.String())
+			require.Equal(t, expected, mgobson.M{"v": tc.value}.String())
+
+			b, err := mgobson.D{{"v", tc.value}}.MarshalBSON()
+			require.NoError(t, err)
+
+			var raw mgobson.RawD
+			require.NoError(t, raw.UnmarshalBSON(b))
+			require.Equal(t, expected, raw.String())
+		})
+	}
+
+	t.Run("format", func(t *testing.T) {
+		d := mgobson.D{
+			{"_id", oid},
+			{"tags", mgobson.A{"a", mgobson.D{{"b", int64(1)}}}},
+			{"empty", mgobson.D{}},
+		}
+
+		require.Equal(t, `{ "_id" : ObjectId("5a4af6a50000000000000001"), "tags" : [ "a", { "b" : NumberLong(1) } ], "empty" : { } }`, fmt.Sprintf("%v", d))
+		require.Equal(t, d.String(), fmt.Sprintf("%s", d))
+		require.Equal(t, `{
+	"_id" : ObjectId("5a4af6a50000000000000001"),
+	"tags" : [
+		"a",
+		{
+			"b" : NumberLong(1)
+		}
+	],
+	"empty" : { }
+}`, fmt.Sprintf("%+v", d))
+
+		m := mgobson.M{"c": int32(1), "b": mgobson.M{"z": true, "y": false}, "a": mgobson.D{{"x", nil}, {"w", nil}}}
+		for i := 0; i < 10; i++ {
+			require.Equal(t, `{ "a" : { "x" : null, "w" : null }, "b" : { "y" : false, "z" : true }, "c" : 1 }`, m.String())
+		}
+
+		require.Equal(t, `[{ "a" : 1 }]`, fmt.Sprint([]interface{}{mgobson.M{"a": int32(1)}}))
+		require.Equal(t, `%!d(mgobson.D={ "a" : 1 })`, fmt.Sprintf("%d", mgobson.D{{"a", int32(1)}}))
+
+		// %#v prints Go syntax, as it would without Format.
+		require.Equal(t, `mgobson.D{mgobson.DocElem{Name:"a", Value:1}, mgobson.DocElem{Name:"b", Value:mgobson.M{"c":"x"}}}`,
+			fmt.Sprintf("%#v", mgobson.D{{"a", int32(1)}, {"b", mgobson.M{"c": "x"}}}))
+		require.Equal(t, `mgobson.RawD{mgobson.RawDocElem{Name:"a", Value:mgobson.Raw{Kind:0x8, Data:[]uint8{0x1}}}}`,
+			fmt.Sprintf("%#v", mgobson.RawD{{"a", mgobson.Raw{Kind: 0x08, Data: []byte{1}}}}))
+		require.Equal(t, `mgobson.M(nil)`, fmt.Sprintf("%#v", mgobson.M(nil)))
+	})
+
+	t.Run("mgo decode mode", func(t *testing.T) {
+		b, err := mgobson.D{{"a", mgobson.A{int32(1), int32(2)}}, {"b", int64(3)}}.MarshalBSON()
+		require.NoError(t, err)
+
+		var d mgobson.D
+		require.NoError(t, d.UnmarshalBSONWithMode(b, mgobson.MgoDecodeMode))
+		require.Equal(t, 1, d[0].Value.([]interface{})[0])
+		require.Equal(t, `{ "a" : [ 1, 2 ], "b" : NumberLong(3) }`, d.String())
+
+		var m mgobson.M
+		require.NoError(t, m.UnmarshalBSONWithMode(b, mgobson.MgoDecodeMode))
+		require.Equal(t, `{ "a" : [ 1, 2 ], "b" : NumberLong(3) }`, m.String())
+
+		require.Equal(t, `{ "a" : NumberLong(4294967296) }`, mgobson.D{{"a", 1 << 32}}.String())
+	})
+
+	t.Run("decode limits", func(t *testing.T) {
+		mgobson.SetDecodeLimits(mgobson.DecodeLimits{MaxDepth: 1, MaxElements: 1})
+		defer mgobson.SetDecodeLimits(mgobson.DecodeLimits{MaxDepth: 200})
+
+		// Printing doesn't decode, so the limits don't apply.
+		d := mgobson.D{{"a", mgobson.D{{"b", mgobson.A{int32(1), int32(2)}}}}, {"c", true}}
+		require.Equal(t, `{ "a" : { "b" : [ 1, 2 ] }, "c" : true }`, d.String())
+
+		out, err := mgobson.MarshalExtJSON(d, true)
+		require.NoError(t, err)
+		require.Equal(t, `{"a":{"b":[{"$numberInt":"1"},{"$numberInt":"2"}]},"c":true}`, string(out))
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		require.Contains(t, mgobson.D{{"a", mgobson.ObjectId("short")}}.String(), "%!(BADBSON=")
+		require.Contains(t, mgobson.RawD{{"a", mgobson.Raw{Kind: 0x03}}}.String(), "%!(BADBSON=")
+	})
+}
+
+func TestParseShell(t *testing.T) {
+	oid := mgobson.ObjectIdHex("5a4af6a50000000000000001")
+	dec, err := mgobson.ParseDecimal128("1.50")
+	require.NoError(t, err)
+
+	in := `{
+		a: { $gt: ISODate("2020-01-01"), $lt: new Date(1514862245006), },
+		_id: ObjectId('5a4af6a50000000000000001'),
+		'quoted key': 'it\'s',
+		"b": [1, 4294967296, 1.5, -Infinity, Infinity, ],
+		$or: [{ c: /a\/b[/]/i }, { d: { $regex: "^x", $options: "m" } }],
+		0: NumberLong("7"),
+		e: NumberDecimal("1.50"),
+		f: new NumberInt(3),
+		g: BinData(0, "AQID"),
+		h: HexData(128, "0102"),
+		i: UUID("00112233-4455-6677-8899-aabbccddeeff"),
+		j: Code("f()", { x: 1 }),
+		k: DBPointer("db.c", ObjectId("5a4af6a50000000000000001")),
+		l: Timestamp(5, 6),
+		m: [MinKey, MaxKey(), undefined, null, true],
+		n: { $date: 1 },
+	}`
+
+	d, err := mgobson.ParseShell(in)
+	require.NoError(t, err)
+	require.Equal(t, mgobson.D{
+		{"a", mgobson.D{
+			{"$gt", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+			{"$lt", time.Date(2018, 1, 2, 3, 4, 5, 6e6, time.UTC)},
+		}},
+		{"_id", oid},
+		{"quoted key", "it's"},
+		{"b", mgobson.A{int32(1), int64(4294967296), 1.5, math.Inf(-1), math.Inf(1)}},
+		{"$or", mgobson.A{
+			mgobson.D{{"c", mgobson.RegEx{Pattern: `a/b[/]`, Options: "i"}}},
+			mgobson.D{{"d", mgobson.D{{"$regex", "^x"}, {"$options", "m"}}}},
+		}},
+		{"0", int64(7)},
+		{"e", dec},
+		{"f", int32(3)},
+		{"g", []byte{1, 2, 3}},
+		{"h", mgobson.Binary{Kind: 0x80, Data: []byte{1, 2}}},
+		{"i", mgobson.Binary{Kind: 0x04, Data: []byte{0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff}}},
+		{"j", mgobson.JavaScript{Code: "f()", Scope: mgobson.D{{"x", int32(1)}}}},
+		{"k", mgobson.DBPointer{Namespace: "db.c", Id: oid}},
+		{"l", mgobson.MongoTimestamp(5<<32 | 6)},
+		{"m", mgobson.A{mgobson.MinKey, mgobson.MaxKey, mgobson.Undefined, nil, true}},
+		{"n", mgobson.D{{"$date", int32(1)}}},
+	}, d)
+
+	d, err = mgobson.ParseShell(`{a: NaN}`)
+	require.NoError(t, err)
+	require.True(t, math.IsNaN(d[0].Value.(float64)))
+
+	t.Run("round trip", func(t *testing.T) {
+		d := mgobson.D{
+			{"_id", oid},
+			{"n", mgobson.D{{"a", int64(1 << 60)}, {"b", 2.5}, {"c", mgobson.A{"x", int32(1)}}}},
+			{"date", time.Date(2018, 1, 2, 3, 4, 5, 6e6, time.UTC)},
+			{"re", mgobson.RegEx{Pattern: "a/b[/]", Options: "i"}},
+			{"bin", mgobson.Binary{Kind: 0x80, Data: []byte{1}}},
+		}
+
+		actual, err := mgobson.ParseShell(d.String())
+		require.NoError(t, err)
+		require.Equal(t, d, actual)
+
+		actual, err = mgobson.ParseShell(fmt.Sprintf("%+v", d))
+		require.NoError(t, err)
+		require.Equal(t, d, actual)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		invalid := []string{
+			``,
+			`[]`,
+			`{a: 1`,
+			`{a: 1,,}`,
+			`{,}`,
+			`{a b: 1}`,
+			`{a: 'x"}`,
+			`{a: //}`,
+			`{a: /x}`,
+			`{a: -Inf}`,
+			`{a: Foo(1)}`,
+			`{a: new Foo(1)}`,
+			`{a: ObjectId("xyz")}`,
+			`{a: UUID("0011")}`,
+			`{a: Code(1)}`,
+			`{a: 1} {}`,
+		}
+
+		for _, in := range invalid {
+			_, err := mgobson.ParseShell(in)
+			require.Error(t, err, in)
+		}
+
+		_, err := mgobson.ParseShell("{\n  a: 1,\n  b: ?\n}")
+		require.Equal(t, &mgobson.SyntaxError{
+			Msg:    `invalid character '?' looking for beginning of value`,
+			Offset: 15,
+			Line:   3,
+			Column: 6,
+		}, err)
+	})
+}
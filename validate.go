@@ -0,0 +1,321 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+//
+// Based on gopkg.in/mgo.v2/bson by Gustavo Niemeyer
+// See THIRD-PARTY-NOTICES for original license terms.
+
+package mgobson
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Validate checks that every element of r is valid according to the BSON
+// specification: its name must be valid UTF-8 without NUL bytes, its kind
+// must be known, and its data must have the length and content that the
+// kind requires. Embedded documents, arrays and JavaScript scopes are
+// checked at every depth. The first invalid element is reported as a
+// *MarshalError holding its path.
+//
+// Relevant documentation:
+//
+//	http://bsonspec.org/spec.html
+func (r RawD) Validate() error {
+	for _, elem := range r {
+		if err := validateElement(elem.Name, elem.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Validate checks that raw holds a single valid BSON value of its kind, as
+// RawD.Validate does for each of its elements. A Kind of 0x00 is taken as
+// an embedded document, as when marshaling.
+func (raw Raw) Validate() error {
+	kind := raw.Kind
+	if kind == 0x00 {
+		kind = 0x03
+	}
+
+	return validateElement("", Raw{Kind: kind, Data: raw.Data})
+}
+
+func validateElement(name string, raw Raw) error {
+	if strings.IndexByte(name, 0) >= 0 {
+		return &MarshalError{Path: name, Type: typeRaw, Err: fmt.Errorf("element name %q contains a NUL byte", name)}
+	}
+	if !utf8.ValidString(name) {
+		return &MarshalError{Path: name, Type: typeRaw, Err: fmt.Errorf("element name %q isn't valid UTF-8", name)}
+	}
+
+	if err := validateRaw(raw.Kind, raw.Data); err != nil {
+		return elementMarshalError(err, name, raw)
+	}
+	return nil
+}
+
+// validateRaw checks that data holds exactly one valid value of the given
+// kind. Errors are returned as a *MarshalError whose path is relative to the
+// value.
+func validateRaw(kind byte, data []byte) error {
+	s := scanner{strict: true}
+	if err := s.exact(kind, data); err != nil {
+		return &MarshalError{Path: err.path, Kind: err.kind, Err: err.err}
+	}
+	return nil
+}
+
+// checkDocument checks that b holds exactly one well-formed document, so that
+// it can be walked with splitDocument without checking each level again. No
+// DecodeLimits apply. Errors are returned as an *UnmarshalError.
+func checkDocument(b []byte) error {
+	var s scanner
+	if err := s.exact(0x03, b); err != nil {
+		return &UnmarshalError{Path: err.path, Kind: err.kind, Err: err.err}
+	}
+	return nil
+}
+
+// scanError reports invalid BSON data found by a scanner. Path is the
+// dotted path of the invalid element relative to the scanned value, and
+// kind is its BSON kind.
+type scanError struct {
+	path string
+	kind byte
+	err  error
+}
+
+func scanErrorf(kind byte, format string, args ...interface{}) *scanError {
+	return &scanError{kind: kind, err: fmt.Errorf(format, args...)}
+}
+
+// scanner checks that BSON data is well formed, so that it can be read
+// without going out of bounds: every length must be within the data that
+// holds it, and documents and strings must be terminated. In strict mode,
+// the rules of the specification on the content of values are checked as
+// well: strings and names must be valid UTF-8, booleans must be 0 or 1, the
+// elements of arrays must be named after their index, and binary values of
+// subtype 0x02 must repeat their length. A non-zero maxDepth and
+// maxElements bound the nesting depth of documents and the total number of
+// elements.
+type scanner struct {
+	strict      bool
+	maxDepth    int
+	maxElements int
+
+	depth    int
+	elements int
+}
+
+// exact checks that data holds exactly one value of the given kind.
+func (s *scanner) exact(kind byte, data []byte) *scanError {
+	n, err := s.value(kind, data)
+	if err != nil {
+		return err
+	}
+	if n != len(data) {
+		return scanErrorf(kind, "%d extra bytes after the value", len(data)-n)
+	}
+	return nil
+}
+
+// value checks the value of the given kind at the start of data, and
+// returns its length.
+func (s *scanner) value(kind byte, data []byte) (int, *scanError) {
+	n, err := valueLength(kind, data)
+	if err != nil {
+		return 0, &scanError{kind: kind, err: err}
+	}
+	data = data[:n]
+
+	switch kind {
+	case 0x02, 0x0D, 0x0E:
+		if err := s.string(data); err != nil {
+			return 0, &scanError{kind: kind, err: err}
+		}
+	case 0x03, 0x04:
+		if err := s.document(data, kind == 0x04); err != nil {
+			return 0, err
+		}
+	case 0x05:
+		l := int64(n - 5)
+		if s.strict && data[4] == 0x02 && (l < 4 || int64(int32(binary.LittleEndian.Uint32(data[5:]))) != l-4) {
+			return 0, scanErrorf(kind, "invalid inner length of binary subtype 0x02")
+		}
+	case 0x08:
+		if s.strict && data[0] > 1 {
+			return 0, scanErrorf(kind, "invalid boolean value 0x%02x", data[0])
+		}
+	case 0x0B:
+		i := bytes.IndexByte(data, 0)
+		if s.strict && (!utf8.Valid(data[:i]) || !utf8.Valid(data[i+1:n-1])) {
+			return 0, scanErrorf(kind, "regular expression isn't valid UTF-8")
+		}
+	case 0x0C:
+		if err := s.string(data[:n-12]); err != nil {
+			return 0, scanErrorf(kind, "invalid namespace: %s", err)
+		}
+	case 0x0F:
+		m, err := valueLength(0x02, data[4:])
+		if err == nil {
+			err = s.string(data[4 : 4+m])
+		}
+		if err != nil {
+			return 0, scanErrorf(kind, "invalid code: %s", err)
+		}
+		if err := s.exact(0x03, data[4+m:]); err != nil {
+			return 0, err
+		}
+	}
+
+	return n, nil
+}
+
+// string checks the length-prefixed string that fills data.
+func (s *scanner) string(data []byte) error {
+	if data[len(data)-1] != 0 {
+		return fmt.Errorf("string isn't terminated by a NUL byte")
+	}
+	if s.strict && !utf8.Valid(data[4:len(data)-1]) {
+		return fmt.Errorf("string isn't valid UTF-8")
+	}
+	return nil
+}
+
+// document checks the document or array that fills data, including all of
+// its elements.
+func (s *scanner) document(data []byte, array bool) *scanError {
+	kind := byte(0x03)
+	if array {
+		kind = 0x04
+	}
+
+	s.depth++
+	defer func() { s.depth-- }()
+	if s.maxDepth > 0 && s.depth > s.maxDepth {
+		return scanErrorf(kind, "document is nested deeper than the maximum depth of %d", s.maxDepth)
+	}
+
+	if data[len(data)-1] != 0 {
+		return scanErrorf(kind, "document isn't terminated by a NUL byte")
+	}
+
+	// The terminating NUL byte is left out, so that elements can't
+	// overrun it.
+	elems := data[4 : len(data)-1]
+	for i := 0; len(elems) > 0; i++ {
+		s.elements++
+		if s.maxElements > 0 && s.elements > s.maxElements {
+			return scanErrorf(kind, "document has more than the maximum of %d elements", s.maxElements)
+		}
+
+		ekind := elems[0]
+		n := bytes.IndexByte(elems[1:], 0)
+		if n < 0 {
+			return scanErrorf(kind, "element name isn't terminated by a NUL byte")
+		}
+		name := elems[1 : 1+n]
+		if s.strict && !utf8.Valid(name) {
+			return scanErrorf(kind, "element name %q isn't valid UTF-8", name)
+		}
+		if s.strict && array && string(name) != strconv.Itoa(i) {
+			return scanErrorf(kind, "array element %d is named %q", i, name)
+		}
+		elems = elems[2+n:]
+
+		m, err := s.value(ekind, elems)
+		if err != nil {
+			err.path = joinPath(string(name), err.path)
+			return err
+		}
+		elems = elems[m:]
+	}
+
+	return nil
+}
+
+// valueLength returns the length of the value of the given kind at the
+// start of data, checking that it fits within data. The content of the
+// value isn't checked.
+func valueLength(kind byte, data []byte) (int, error) {
+	var n int64
+	switch kind {
+	case 0x01, 0x09, 0x11, 0x12:
+		n = 8
+	case 0x07:
+		n = 12
+	case 0x10:
+		n = 4
+	case 0x13:
+		n = 16
+	case 0x08:
+		n = 1
+	case 0x06, 0x0A, 0xFF, 0x7F:
+		n = 0
+	case 0x02, 0x0D, 0x0E, 0x0C:
+		if len(data) < 4 {
+			return 0, fmt.Errorf("value needs at least 4 bytes, got %d", len(data))
+		}
+		l := int64(int32(binary.LittleEndian.Uint32(data)))
+		if l < 1 {
+			return 0, fmt.Errorf("invalid string length %d", l)
+		}
+		n = 4 + l
+		if kind == 0x0C {
+			n += 12
+		}
+	case 0x03, 0x04:
+		if len(data) < 4 {
+			return 0, fmt.Errorf("value needs at least 4 bytes, got %d", len(data))
+		}
+		n = int64(int32(binary.LittleEndian.Uint32(data)))
+		if n < 5 {
+			return 0, fmt.Errorf("invalid document length %d", n)
+		}
+	case 0x05:
+		if len(data) < 5 {
+			return 0, fmt.Errorf("value needs at least 5 bytes, got %d", len(data))
+		}
+		l := int64(int32(binary.LittleEndian.Uint32(data)))
+		if l < 0 {
+			return 0, fmt.Errorf("invalid binary length %d", l)
+		}
+		n = 5 + l
+	case 0x0B:
+		i := bytes.IndexByte(data, 0)
+		if i < 0 {
+			return 0, fmt.Errorf("regular expression pattern isn't terminated by a NUL byte")
+		}
+		j := bytes.IndexByte(data[i+1:], 0)
+		if j < 0 {
+			return 0, fmt.Errorf("regular expression options aren't terminated by a NUL byte")
+		}
+		n = int64(i + 1 + j + 1)
+	case 0x0F:
+		if len(data) < 4 {
+			return 0, fmt.Errorf("value needs at least 4 bytes, got %d", len(data))
+		}
+		n = int64(int32(binary.LittleEndian.Uint32(data)))
+		// The length, a string of at least 5 bytes and a document of at
+		// least 5 bytes.
+		if n < 14 {
+			return 0, fmt.Errorf("invalid code with scope length %d", n)
+		}
+	default:
+		return 0, fmt.Errorf("invalid BSON kind 0x%02x", kind)
+	}
+
+	if n > int64(len(data)) {
+		return 0, fmt.Errorf("value needs %d bytes, got %d", n, len(data))
+	}
+	return int(n), nil
+}
@@ -0,0 +1,176 @@
+// Copyright (C) MongoDB, Inc. 2017-present.
+//
+// Licensed under the Apache License, Version 2.0 (the "License"); you may
+// not use this file except in compliance with the License. You may obtain
+// a copy of the License at http://www.apache.org/licenses/LICENSE-2.0
+//
+// Based on gopkg.in/mgo.v2/bson by Gustavo Niemeyer
+// See THIRD-PARTY-NOTICES for original license terms.
+
+package mgobson_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mongodb-labs/mgobson"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	dec, err := mgobson.ParseDecimal128("1.5")
+	require.NoError(t, err)
+
+	b, err := mgobson.D{
+		{"double", 1.5},
+		{"string", "é"},
+		{"doc", mgobson.D{{"a", mgobson.A{int32(1), "b", mgobson.D{}}}}},
+		{"binary", []byte{1, 2}},
+		{"old binary", mgobson.Binary{Kind: 0x02, Data: []byte{0, 0, 0, 0}}},
+		{"undefined", mgobson.Undefined},
+		{"oid", mgobson.ObjectIdHex("5a4af6a50000000000000001")},
+		{"bool", true},
+		{"date", time.Now()},
+		{"null", nil},
+		{"regex", mgobson.RegEx{Pattern: "a", Options: "i"}},
+		{"dbpointer", mgobson.DBPointer{Namespace: "db.c", Id: mgobson.ObjectIdHex("5a4af6a50000000000000001")}},
+		{"code", mgobson.JavaScript{Code: "f()"}},
+		{"symbol", mgobson.Symbol("s")},
+		{"code with scope", mgobson.JavaScript{Code: "f()", Scope: mgobson.D{{"x", int32(1)}}}},
+		{"int32", int32(1)},
+		{"timestamp", mgobson.MongoTimestamp(1)},
+		{"int64", int64(1)},
+		{"decimal", dec},
+		{"minkey", mgobson.MinKey},
+		{"maxkey", mgobson.MaxKey},
+	}.MarshalBSON()
+	require.NoError(t, err)
+
+	var valid mgobson.RawD
+	require.NoError(t, valid.UnmarshalBSON(b))
+	require.NoError(t, valid.Validate())
+	for _, elem := range valid {
+		require.NoError(t, elem.Value.Validate(), elem.Name)
+	}
+
+	testCases := []struct {
+		name string
+		elem mgobson.RawDocElem
+		path string
+		kind byte
+	}{
+		{"unknown kind", mgobson.RawDocElem{"a", mgobson.Raw{Kind: 0x20}}, "a", 0x20},
+		{"zero kind", mgobson.RawDocElem{"a", mgobson.Raw{Kind: 0x00}}, "a", 0x00},
+		{"name with NUL", mgobson.RawDocElem{"a\x00b", mgobson.Raw{Kind: 0x0A}}, "a\x00b", 0x00},
+		{"invalid UTF-8 name", mgobson.RawDocElem{"\xff", mgobson.Raw{Kind: 0x0A}}, "\xff", 0x00},
+		{"short int32", mgobson.RawDocElem{"a", mgobson.Raw{Kind: 0x10, Data: []byte{1}}}, "a", 0x10},
+		{"long int32", mgobson.RawDocElem{"a", mgobson.Raw{Kind: 0x10, Data: []byte{1, 0, 0, 0, 0}}}, "a", 0x10},
+		{"null with data", mgobson.RawDocElem{"a", mgobson.Raw{Kind: 0x0A, Data: []byte{1}}}, "a", 0x0A},
+		{"bool", mgobson.RawDocElem{"a", mgobson.Raw{Kind: 0x08, Data: []byte{2}}}, "a", 0x08},
+		{"string length", mgobson.RawDocElem{"a", mgobson.Raw{Kind: 0x02, Data: []byte{3, 0, 0, 0, 'a', 0}}}, "a", 0x02},
+		{"string terminator", mgobson.RawDocElem{"a", mgobson.Raw{Kind: 0x02, Data: []byte{2, 0, 0, 0, 'a', 'b'}}}, "a", 0x02},
+		{"string UTF-8", mgobson.RawDocElem{"a", mgobson.Raw{Kind: 0x02, Data: []byte{2, 0, 0, 0, 0xff, 0}}}, "a", 0x02},
+		{"binary length", mgobson.RawDocElem{"a", mgobson.Raw{Kind: 0x05, Data: []byte{2, 0, 0, 0, 0, 1}}}, "a", 0x05},
+		{"old binary length", mgobson.RawDocElem{"a", mgobson.Raw{Kind: 0x05, Data: []byte{5, 0, 0, 0, 2, 0, 0, 0, 0, 1}}}, "a", 0x05},
+		{"regex", mgobson.RawDocElem{"a", mgobson.Raw{Kind: 0x0B, Data: []byte{'a', 0}}}, "a", 0x0B},
+		{"document length", mgobson.RawDocElem{"a", mgobson.Raw{Kind: 0x03, Data: []byte{6, 0, 0, 0, 0}}}, "a", 0x03},
+		{"document terminator", mgobson.RawDocElem{"a", mgobson.Raw{Kind: 0x03, Data: []byte{5, 0, 0, 0, 1}}}, "a", 0x03},
+		{"nested", mgobson.RawDocElem{"a", mgobson.Raw{Kind: 0x03, Data: []byte{
+			17, 0, 0, 0,
+			0x04, 'b', 0, 9, 0, 0, 0,
+			0x10, '0', 0, 1, 0,
+			0,
+		}}}, "a.b.0", 0x10},
+		{"array names", mgobson.RawDocElem{"a", mgobson.Raw{Kind: 0x04, Data: []byte{
+			8, 0, 0, 0,
+			0x0A, '1', 0,
+			0,
+		}}}, "a", 0x04},
+		{"scope", mgobson.RawDocElem{"a", mgobson.Raw{Kind: 0x0F, Data: []byte{
+			20, 0, 0, 0,
+			2, 0, 0, 0, 'f', 0,
+			10, 0, 0, 0, 0x08, 'x', 0, 5, 0,
+			0,
+		}}}, "a.x", 0x08},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := append(mgobson.RawD{}, valid...)
+			r = append(r, tc.elem)
+
+			err := r.Validate()
+			require.IsType(t, &mgobson.MarshalError{}, err)
+			require.Equal(t, tc.path, err.(*mgobson.MarshalError).Path)
+			require.Equal(t, tc.kind, err.(*mgobson.MarshalError).Kind)
+
+			// Raw.Validate checks the value alone, without the name.
+			if tc.kind != 0x00 {
+				require.Error(t, tc.elem.Value.Validate())
+			}
+
+			// Without strict marshaling the data is copied as is.
+			_, err = r.MarshalBSON()
+			require.NoError(t, err)
+		})
+	}
+
+	t.Run("strict marshal", func(t *testing.T) {
+		mgobson.SetStrictMarshal(true)
+		defer mgobson.SetStrictMarshal(false)
+
+		_, err := valid.MarshalBSON()
+		require.NoError(t, err)
+
+		invalid := mgobson.Raw{Kind: 0x10, Data: []byte{1}}
+
+		_, err = mgobson.RawD{{"a", invalid}}.MarshalBSON()
+		require.Equal(t, "a", err.(*mgobson.MarshalError).Path)
+
+		_, err = mgobson.D{{"a", mgobson.D{{"b", mgobson.RawD{{"c", invalid}}}}}}.MarshalBSON()
+		require.Equal(t, "a.b.c", err.(*mgobson.MarshalError).Path)
+
+		_, err = mgobson.Marshal(mgobson.M{"a": mgobson.A{invalid}})
+		require.Equal(t, "a.0", err.(*mgobson.MarshalError).Path)
+		require.Equal(t, byte(0x10), err.(*mgobson.MarshalError).Kind)
+	})
+
+	t.Run("every path", func(t *testing.T) {
+		r := mgobson.RawD{{"a", mgobson.Raw{Kind: 0x10, Data: []byte{1}}}}
+		b := []byte{9, 0, 0, 0, 0x10, 'a', 0, 1, 0}
+
+		paths := []struct {
+			name string
+			path string
+			fn   func() error
+		}{
+			{"RawD.MarshalBSON", "a", func() error { _, err := r.MarshalBSON(); return err }},
+			{"RawD.AppendBSON", "a", func() error { _, err := r.AppendBSON(nil); return err }},
+			{"Marshal", "a", func() error { _, err := mgobson.Marshal(r); return err }},
+			{"D.MarshalBSON", "x.a", func() error { _, err := mgobson.D{{"x", r}}.MarshalBSON(); return err }},
+			{"D.AppendBSON", "x.a", func() error { _, err := mgobson.D{{"x", r}}.AppendBSON(nil); return err }},
+			{"M.MarshalBSON", "x.a", func() error { _, err := mgobson.M{"x": r}.MarshalBSON(); return err }},
+			{"struct", "x.a", func() error {
+				_, err := mgobson.Marshal(struct{ X mgobson.RawD }{r})
+				return err
+			}},
+			{"Raw", "x.a", func() error {
+				_, err := mgobson.D{{"x", mgobson.Raw{Kind: 0x03, Data: b}}}.MarshalBSON()
+				return err
+			}},
+		}
+
+		for _, p := range paths {
+			require.NoError(t, p.fn(), p.name)
+		}
+
+		mgobson.SetStrictMarshal(true)
+		defer mgobson.SetStrictMarshal(false)
+
+		for _, p := range paths {
+			err := p.fn()
+			require.IsType(t, &mgobson.MarshalError{}, err, p.name)
+			require.Equal(t, p.path, err.(*mgobson.MarshalError).Path, p.name)
+		}
+	})
+}